@@ -5,8 +5,8 @@ import (
 )
 
 func TestTx_allocatePageStats(t *testing.T) {
-	f := newFreelist()
-	f.ids = []pgid{2, 3}
+	f := newTestFreelist()
+	f.readIDs([]pgid{2, 3})
 
 	tx := &Tx{
 		db: &DB{
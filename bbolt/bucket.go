@@ -58,6 +58,8 @@ type Bucket struct {
 	page     *page              // inline page reference
 	rootNode *node              // materialized node for the root page.
 	nodes    map[pgid]*node     // node cache
+	ext      *bucketExt         // persistent settings, nil if none
+	path     [][]byte           // names from the root, only set if changes are captured
 
 	// Sets the threshold for filling nodes when they split. By default,
 	// the bucket will fill to 50% but it can be useful to increase this
@@ -117,9 +119,33 @@ func (b *Bucket) Cursor() *Cursor {
 }
 
 // Bucket retrieves a nested bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist, or can not be opened. Use
+// OpenBucket() to tell these cases apart.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) Bucket(name []byte) *Bucket {
+	defer b.tx.recoverRead()
+	// Buckets with an unregistered comparator or codec can not be used.
+	return b.childBucket(name).usableOrNil()
+}
+
+// OpenBucket retrieves a nested bucket by name, like Bucket().
+// Returns ErrBucketNotFound if the bucket does not exist, and
+// ErrComparatorNotFound or ErrCodecNotFound if the comparator or the codec of
+// the bucket is not registered.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) OpenBucket(name []byte) (_ *Bucket, err error) {
+	defer b.tx.recoverError(&err)
+	child := b.childBucket(name)
+	if child == nil {
+		return nil, ErrBucketNotFound
+	} else if err := child.usable(); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// childBucket retrieves a nested bucket by name, even if it is not usable.
+func (b *Bucket) childBucket(name []byte) *Bucket {
 	if b.buckets != nil {
 		if child := b.buckets[string(name)]; child != nil {
 			return child
@@ -137,6 +163,7 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 
 	// Otherwise create a bucket and cache it.
 	var child = b.openBucket(v)
+	child.path = b.tx.childPath(b.path, name)
 	if b.buckets != nil {
 		b.buckets[string(name)] = child
 	}
@@ -167,8 +194,11 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 	}
 
 	// Save a reference to the inline page if the bucket is inline.
+	// Otherwise the header may be followed by the settings of the bucket.
 	if child.root == 0 {
 		child.page = (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+	} else if len(value) > bucketHeaderSize {
+		child.ext = decodeBucketExt(value[bucketHeaderSize:])
 	}
 
 	return &child
@@ -177,6 +207,12 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 // This method is called, if we've already called (*Cursor).Seek() and we know,
 // that the key-value pair is a Bucket (eg: (flags & bucketLeafFlag)!=0 )!
 func (b *Bucket) obtainBucket(k, v []byte) *Bucket {
+	return b.obtainChild(k, v).usableOrNil()
+}
+
+// obtainChild works like obtainBucket, but returns the bucket even if it is
+// not usable.
+func (b *Bucket) obtainChild(k, v []byte) *Bucket {
 	// Return the bucket if it is cached.
 	if b.buckets != nil {
 		if child := b.buckets[string(k)]; child != nil {
@@ -186,6 +222,7 @@ func (b *Bucket) obtainBucket(k, v []byte) *Bucket {
 
 	// Otherwise create a bucket and cache it.
 	var child = b.openBucket(v)
+	child.path = b.tx.childPath(b.path, k)
 	if b.buckets != nil {
 		b.buckets[string(k)] = child
 	}
@@ -219,7 +256,11 @@ func (b *Bucket) createOrObtainBucketEx(key []byte,obtain bool) (*Bucket, error)
 	// Return an error if there is an existing key.
 	if bytes.Equal(key, k) {
 		if (flags & bucketLeafFlag) != 0 {
-			if obtain { return b.obtainBucket(k,v),nil }
+			if obtain {
+				child := b.obtainChild(k,v)
+				if err := child.usable(); err != nil { return nil,err }
+				return child,nil
+			}
 			return nil, ErrBucketExists
 		}
 		return nil, ErrIncompatibleValue
@@ -237,6 +278,7 @@ func (b *Bucket) createOrObtainBucketEx(key []byte,obtain bool) (*Bucket, error)
 	// Insert into node.
 	key = cloneBytes(key)
 	c.node().put(key, key, value, 0, bucketLeafFlag)
+	b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 
 	// Since subbuckets are not allowed on inline buckets, we need to
 	// dereference the inline page, if it exists. This will cause the bucket
@@ -246,23 +288,39 @@ func (b *Bucket) createOrObtainBucketEx(key []byte,obtain bool) (*Bucket, error)
 	return b.Bucket(key), nil
 }
 
+// createBucketExt creates a new bucket with the given settings. The root node
+// is materialized, so that the settings are written on commit.
+func (b *Bucket) createBucketExt(key []byte, ext *bucketExt) (*Bucket, error) {
+	child, err := b.createOrObtainBucketEx(key, false)
+	if err != nil {
+		return nil, err
+	}
+	child.ext = ext
+	child.node(child.root, nil)
+	b.tx.recordStructure(changeBucketExt, b.path, key, ext.encode(nil))
+	return child, nil
+}
+
 // CreateBucket creates a new bucket at the given key and returns the new bucket.
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
-func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
+func (b *Bucket) CreateBucket(key []byte) (child *Bucket, err error) {
+	defer b.tx.recoverError(&err)
 	return b.createOrObtainBucketEx(key,false)
 }
 
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist and returns a reference to it.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
-func (b *Bucket) CreateBucketIfNotExists(key []byte) (*Bucket, error) {
+func (b *Bucket) CreateBucketIfNotExists(key []byte) (child *Bucket, err error) {
+	defer b.tx.recoverError(&err)
 	return b.createOrObtainBucketEx(key,true)
 }
 
 // DeleteBucket deletes a bucket at the given key.
 // Returns an error if the bucket does not exists, or if the key represents a non-bucket value.
-func (b *Bucket) DeleteBucket(key []byte) error {
+func (b *Bucket) DeleteBucket(key []byte) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
@@ -281,51 +339,49 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 	}
 
 	// Recursively delete all child buckets (and radix trees).
-	child := b.Bucket(key)
-	var err error
-	{
-		iter := b.Cursor()
-		for k, _ := iter.First(); k != nil; k, _ = iter.Next() {
-			_,_,flags := iter.keyValue()
-			switch {
-			case (flags & bucketLeafFlag)!=0 :
-				err = child.DeleteBucket(k)
-			case (flags & radixLeafFlag)!=0 :
-				err = child.DeleteRadixBucket(k)
-			}
-			if err!=nil { break }
-		}
-	}
-	/*err := child.ForEach(func(k, v []byte) error {
-		if v == nil {
-			if err := child.DeleteBucket(k); err != nil {
-				return fmt.Errorf("delete bucket: %s", err)
-			}
-		}
-		return nil
-	})*/
-	if err != nil {
-		return err
-	}
+	b.childBucket(key).erase()
 
 	// Remove cached copy.
 	delete(b.buckets, string(key))
 
-	// Release all bucket pages to freelist.
-	child.nodes = nil
-	child.rootNode = nil
-	child.free()
-
 	// Delete the node if we have a matching key.
 	c.node().del(key)
+	b.tx.recordStructure(changeDeleteBucket, b.path, key, nil)
 
 	return nil
 }
 
+// erase recursively deletes all child buckets (and radix trees) and releases
+// all bucket pages to the freelist. The children are opened from the values
+// of the cursor instead of seeking their keys, so that buckets, whose
+// comparator is not registered, can be deleted.
+func (b *Bucket) erase() {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		_, v, flags := c.keyValue()
+		switch {
+		case (flags & bucketLeafFlag) != 0:
+			b.obtainChild(k, v).erase()
+			b.tx.recordStructure(changeDeleteBucket, b.path, k, nil)
+		case (flags & radixLeafFlag) != 0:
+			b.deleteRadixBucketInner(k, v)
+			b.tx.recordStructure(changeDeleteBucket, b.path, k, nil)
+		case flags == 0:
+			b.recordDelete(k, v)
+		}
+	}
+
+	// Release all bucket pages to freelist.
+	b.nodes = nil
+	b.rootNode = nil
+	b.free()
+}
+
 // Get retrieves the value for a key in the bucket.
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
 // The returned value is only valid for the life of the transaction.
 func (b *Bucket) Get(key []byte) []byte {
+	defer b.tx.recoverRead()
 	k, v, flags := b.Cursor().seek(key)
 
 	// Return nil if this is a bucket.
@@ -337,14 +393,15 @@ func (b *Bucket) Get(key []byte) []byte {
 	if !bytes.Equal(key, k) {
 		return nil
 	}
-	return v
+	return b.value(v)
 }
 
 // Put sets the value for a key in the bucket.
 // If the key exist then its previous value will be overwritten.
 // Supplied value must remain valid for the life of the transaction.
 // Returns an error if the bucket was created from a read-only transaction, if the key is blank, if the key is too large, or if the value is too large.
-func (b *Bucket) Put(key []byte, value []byte) error {
+func (b *Bucket) Put(key []byte, value []byte) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
@@ -357,18 +414,26 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 		return ErrValueTooLarge
 	}
 
+	// Compress the value, if the bucket has a codec.
+	encoded, err := b.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, v, flags := c.seek(key)
 
 	// Return an error if there is an existing key with a bucket value.
-	if bytes.Equal(key, k) && notValue(flags) {
+	found := bytes.Equal(key, k)
+	if found && notValue(flags) {
 		return ErrIncompatibleValue
 	}
+	b.recordPut(key, v, found, value)
 
 	// Insert into node.
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	c.node().put(key, key, encoded, 0, 0)
 
 	return nil
 }
@@ -378,7 +443,8 @@ Accepts a visitor to a record. The record may or may not exist.
 
 This API is inspired by the internals of Kyoto Carbinet.
 */
-func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) error {
+func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if writable && !b.Writable() {
@@ -404,7 +470,9 @@ func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) error {
 		case vop.set():
 			if !writable { return ErrInvalidWriteAttempt }
 			key = cloneBytes(key)
-			value := vop.getBuf()
+			value, err := b.encodeValue(vop.getBuf())
+			if err != nil { return err }
+			b.recordPut(key, nil, false, vop.getBuf())
 			c.node().put(key, key, value, 0, 0)
 		case vop.bkt():
 			if !writable { return ErrInvalidWriteAttempt }
@@ -412,6 +480,7 @@ func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) error {
 			// Insert into node.
 			key = cloneBytes(key)
 			c.node().put(key, key, value, 0, bucketLeafFlag)
+			b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 			if vop.isset(voVISITBUCKET) {
 				vis.VisitBucket(k,b.Bucket(key))
 			}
@@ -429,24 +498,31 @@ func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) error {
 	if notValue(flags) { return nil }
 	
 	// Case 3: Record exists
-	vop := vis.VisitFull(k,v)
+	dec, err := b.decodeValue(v)
+	if err != nil { return err }
+	vop := vis.VisitFull(k,dec)
 	switch {
 	case vop.set():
 		if !writable { return ErrInvalidWriteAttempt }
 		key = cloneBytes(key)
-		value := vop.getBuf()
+		value, err := b.encodeValue(vop.getBuf())
+		if err != nil { return err }
+		b.recordPut(key, v, true, vop.getBuf())
 		c.node().put(key, key, value, 0, 0)
 	case vop.del():
 		if !writable { return ErrInvalidWriteAttempt }
+		b.recordDelete(key, v)
 		c.node().del(key)
 	case vop.bkt():
 		if !writable { return ErrInvalidWriteAttempt }
+		b.recordDelete(key, v)
 		// NOTE: We simply replace a key-value-pair with a bucket. So we don't have to delete it.
 		// c.node().del(key)
 		var value = createInlineBucket()
 		// Insert into node.
 		key = cloneBytes(key)
 		c.node().put(key, key, value, 0, bucketLeafFlag)
+		b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 		if vop.isset(voVISITBUCKET) {
 			vis.VisitBucket(k,b.Bucket(key))
 		}
@@ -460,7 +536,8 @@ func (b *Bucket) Accept(key []byte,vis Visitor,writable bool) error {
 // Delete removes a key from the bucket.
 // If the key does not exist then nothing is done and a nil error is returned.
 // Returns an error if the bucket was created from a read-only transaction.
-func (b *Bucket) Delete(key []byte) error {
+func (b *Bucket) Delete(key []byte) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
@@ -469,7 +546,7 @@ func (b *Bucket) Delete(key []byte) error {
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, v, flags := c.seek(key)
 
 	// Return nil if the key doesn't exist.
 	if !bytes.Equal(key, k) {
@@ -480,6 +557,7 @@ func (b *Bucket) Delete(key []byte) error {
 	if notValue(flags) {
 		return ErrIncompatibleValue
 	}
+	b.recordDelete(key, v)
 
 	// Delete the node if we have a matching key.
 	c.node().del(key)
@@ -491,7 +569,8 @@ func (b *Bucket) Delete(key []byte) error {
 func (b *Bucket) Sequence() uint64 { return b.bucket.sequence }
 
 // SetSequence updates the sequence number for the bucket.
-func (b *Bucket) SetSequence(v uint64) error {
+func (b *Bucket) SetSequence(v uint64) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
@@ -506,11 +585,13 @@ func (b *Bucket) SetSequence(v uint64) error {
 
 	// Increment and return the sequence.
 	b.bucket.sequence = v
+	b.tx.recordSequence(b.path, v)
 	return nil
 }
 
 // NextSequence returns an autoincrementing integer for the bucket.
-func (b *Bucket) NextSequence() (uint64, error) {
+func (b *Bucket) NextSequence() (seq uint64, err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return 0, ErrTxClosed
 	} else if !b.Writable() {
@@ -525,6 +606,7 @@ func (b *Bucket) NextSequence() (uint64, error) {
 
 	// Increment and return the sequence.
 	b.bucket.sequence++
+	b.tx.recordSequence(b.path, b.bucket.sequence)
 	return b.bucket.sequence, nil
 }
 
@@ -532,21 +614,25 @@ func (b *Bucket) NextSequence() (uint64, error) {
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller. The provided function must not modify
 // the bucket; this will result in undefined behavior.
-func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+func (b *Bucket) ForEach(fn func(k, v []byte) error) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	}
+	// The cursor stops with nil at a page, that fails its checksum, and
+	// the transaction keeps the error.
 	c := b.Cursor()
-	for k, v := c.First(); k != nil; k, v = c.Next() {
+	for k, v := c.First(); k != nil && b.tx.err == nil; k, v = c.Next() {
 		if err := fn(k, v); err != nil {
 			return err
 		}
 	}
-	return nil
+	return b.tx.err
 }
 
 // Stat returns stats on a bucket.
 func (b *Bucket) Stats() BucketStats {
+	defer b.tx.recoverRead()
 	var s, subStats BucketStats
 	pageSize := b.tx.db.pageSize
 	s.BucketN += 1
@@ -591,6 +677,11 @@ func (b *Bucket) Stats() BucketStats {
 						// For any bucket element, open the element value
 						// and recursively call Stats on the contained bucket.
 						subStats.Add(b.openBucket(e.value()).Stats())
+					} else if (e.flags & radixLeafFlag) != 0 {
+						// For any radix tree element, collect the radix stats.
+						if rad := b.peekRadixBucket(e.key(), e.value()); rad != nil {
+							subStats.Radix.Add(rad.Stats())
+						}
 					}
 				}
 			}
@@ -690,9 +781,7 @@ func (b *Bucket) spill() error {
 			}
 
 			// Update the child bucket header in this bucket.
-			value = make([]byte, unsafe.Sizeof(bucket{}))
-			var bucket = (*bucket)(unsafe.Pointer(&value[0]))
-			*bucket = *child.bucket
+			value = child.header()
 		}
 
 		// Skip writing the bucket if there are no materialized nodes.
@@ -725,7 +814,7 @@ func (b *Bucket) spill() error {
 		if flags&radixLeafFlag == 0 {
 			panic(fmt.Sprintf("unexpected radix-tree header flag: %x", flags))
 		}
-		value := radixPgid2bytes(child.acc.root)
+		value := child.header()
 		c.node().put([]byte(name), []byte(name), value, 0, radixLeafFlag)
 	}
 	// END Radix-tree patch.
@@ -760,13 +849,18 @@ func (b *Bucket) inlineable() bool {
 		return false
 	}
 
-	// Bucket is not inlineable if it contains subbuckets or if it goes beyond
-	// our threshold for inline bucket size.
+	// The settings of a bucket are only stored with non-inline buckets.
+	if b.ext != nil {
+		return false
+	}
+
+	// Bucket is not inlineable if it contains subbuckets (or radix trees) or if
+	// it goes beyond our threshold for inline bucket size.
 	var size = pageHeaderSize
 	for _, inode := range n.inodes {
 		size += leafPageElementSize + len(inode.key) + len(inode.value)
 
-		if inode.flags&bucketLeafFlag != 0 {
+		if notValue(inode.flags) {
 			return false
 		} else if size > b.maxInlineBucketSize() {
 			return false
@@ -806,6 +900,9 @@ func (b *Bucket) rebalance() {
 	for _, child := range b.buckets {
 		child.rebalance()
 	}
+	for _, child := range b.radixes {
+		child.rebalance()
+	}
 }
 
 // node creates a node from a page and associates it with a given parent.
@@ -867,6 +964,10 @@ func (b *Bucket) dereference() {
 	for _, child := range b.buckets {
 		child.dereference()
 	}
+
+	for _, child := range b.radixes {
+		child.dereference()
+	}
 }
 
 // pageNode returns the in-memory node, if it exists.
@@ -917,6 +1018,9 @@ type BucketStats struct {
 	BucketN           int // total number of buckets including the top bucket
 	InlineBucketN     int // total number on inlined buckets
 	InlineBucketInuse int // bytes used for inlined buckets (also accounted for in LeafInuse)
+
+	// Radix tree statistics (not accounted for in the page statistics above)
+	Radix RadixStats
 }
 
 func (s *BucketStats) Add(other BucketStats) {
@@ -936,6 +1040,8 @@ func (s *BucketStats) Add(other BucketStats) {
 	s.BucketN += other.BucketN
 	s.InlineBucketN += other.InlineBucketN
 	s.InlineBucketInuse += other.InlineBucketInuse
+
+	s.Radix.Add(other.Radix)
 }
 
 // cloneBytes returns a copy of a given slice.
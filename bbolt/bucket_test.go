@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
 
@@ -144,6 +145,277 @@ func TestBucket_Put(t *testing.T) {
 	}
 }
 
+// Ensure that the values of a bucket with a codec are compressed transparently.
+func TestBucket_CreateBucketWithCodec(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	doc := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"widget"},`, i), 200))
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketWithCodec([]byte("x"), "no-such-codec"); err != bolt.ErrCodecNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := tx.CreateBucketWithCodec([]byte("widgets"), "flate")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketWithCodec([]byte("unused"), "flate"); err != nil {
+			return err
+		}
+		plain, err := tx.CreateBucket([]byte("plain"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if err := b.Put(k, doc(i)); err != nil {
+				return err
+			}
+			if err := plain.Put(k, doc(i)); err != nil {
+				return err
+			}
+		}
+		if err := b.Put([]byte("small"), []byte("x")); err != nil {
+			return err
+		}
+		return b.Put([]byte("empty"), []byte{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if name := b.Codec(); name != "flate" {
+			t.Fatalf("unexpected codec: %q", name)
+		}
+		if name := tx.Bucket([]byte("unused")).Codec(); name != "flate" {
+			t.Fatalf("unexpected codec of empty bucket: %q", name)
+		}
+		if v := b.Get([]byte("0042")); !bytes.Equal(v, doc(42)) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("small")); !bytes.Equal(v, []byte("x")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("empty")); v == nil || len(v) != 0 {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		c := b.Cursor()
+		if k, v := c.Seek([]byte("0007")); !bytes.Equal(v, doc(7)) {
+			t.Fatalf("unexpected value at %q: %q", k, v)
+		}
+		if k, v := c.Next(); !bytes.Equal(v, doc(8)) {
+			t.Fatalf("unexpected value at %q: %q", k, v)
+		}
+		if k, v := c.First(); !bytes.Equal(v, doc(0)) {
+			t.Fatalf("unexpected value at %q: %q", k, v)
+		}
+
+		// The compressed bucket needs fewer pages.
+		s, ps := b.Stats(), tx.Bucket([]byte("plain")).Stats()
+		if s.LeafAlloc*4 > ps.LeafAlloc {
+			t.Fatalf("values not compressed: %d bytes, %d uncompressed", s.LeafAlloc, ps.LeafAlloc)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Visitors see and replace decoded values.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		vis := &radixTestVisitor{op: bolt.VisitOpSET(doc(1000))}
+		if err := b.Accept([]byte("0001"), vis, true); err != nil {
+			return err
+		}
+		if !bytes.Equal(vis.value, doc(1)) {
+			t.Fatalf("unexpected visited value: %q", vis.value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0001")); !bytes.Equal(v, doc(1000)) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// brokenCodec encodes values, that it can not decode.
+type brokenCodec struct{}
+
+func (brokenCodec) Encode(dst, src []byte) []byte { return append(dst, src[0]) }
+func (brokenCodec) Decode(dst, src []byte) ([]byte, error) {
+	return nil, errors.New("broken codec")
+}
+
+var registerBroken sync.Once
+
+// Ensure that values, that can not be decoded, are not reported as missing.
+func TestBucket_CreateBucketWithCodec_DecodeError(t *testing.T) {
+	registerBroken.Do(func() { bolt.RegisterCodec("test-broken", brokenCodec{}) })
+
+	// The database does not pass the consistency check of MustClose.
+	db := MustOpenDB()
+	defer os.Remove(db.Path())
+	defer db.DB.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithCodec([]byte("widgets"), "test-broken")
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		// Values, that the codec does not shrink, are stored as is.
+		return b.Put([]byte("raw"), []byte("x"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("raw")); !bytes.Equal(v, []byte("x")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		return nil
+	}); err != bolt.ErrDecode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("widgets")).Cursor().First()
+		return nil
+	}); err != bolt.ErrDecode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			if err == bolt.ErrDecode {
+				return nil
+			}
+		}
+		t.Fatal("expected decode error")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions started with Begin() keep the error.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tx.Bucket([]byte("widgets"))
+	if err := b.Accept([]byte("foo"), &radixTestVisitor{}, true); err != bolt.ErrDecode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k, v := b.Cursor().First(); !bytes.Equal(k, []byte("foo")) || v != nil {
+		t.Fatalf("unexpected key/value: %q=%q", k, v)
+	} else if err := tx.Err(); err != bolt.ErrDecode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Commit(); err != bolt.ErrDecode {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+var registerNumeric sync.Once
+
+// Ensure that the keys of a bucket with a comparator are ordered by it.
+func TestBucket_CreateBucketWithComparator(t *testing.T) {
+	registerNumeric.Do(func() {
+		bolt.RegisterComparator("test-numeric", func(a, b []byte) int {
+			x, _ := strconv.Atoi(string(a))
+			y, _ := strconv.Atoi(string(b))
+			if x != y {
+				return x - y
+			}
+			return bytes.Compare(a, b)
+		})
+	})
+
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketWithComparator([]byte("x"), "no-such-comparator"); err != bolt.ErrComparatorNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rev, err := tx.CreateBucketWithComparator([]byte("reverse"), "reverse")
+		if err != nil {
+			return err
+		}
+		num, err := tx.CreateBucketWithComparator([]byte("numeric"), "test-numeric")
+		if err != nil {
+			return err
+		}
+		for _, i := range rand.Perm(1000) {
+			k := []byte(strconv.Itoa(i))
+			if err := rev.Put(k, k); err != nil {
+				return err
+			}
+			if err := num.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		rev, num := tx.Bucket([]byte("reverse")), tx.Bucket([]byte("numeric"))
+		if name := num.Comparator(); name != "test-numeric" {
+			t.Fatalf("unexpected comparator: %q", name)
+		}
+
+		var prev []byte
+		c := rev.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if prev != nil && bytes.Compare(prev, k) <= 0 {
+				t.Fatalf("keys out of order: %q before %q", prev, k)
+			}
+			prev = k
+		}
+		if k, _ := rev.Cursor().Seek([]byte("55")); !bytes.Equal(k, []byte("55")) {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		if k, _ := rev.Cursor().Seek([]byte("555a")); !bytes.Equal(k, []byte("555")) {
+			t.Fatalf("unexpected key: %q", k)
+		}
+
+		i := 0
+		c = num.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if string(k) != strconv.Itoa(i) {
+				t.Fatalf("unexpected key at %d: %q", i, k)
+			}
+			i++
+		}
+		if k, _ := num.Cursor().Seek([]byte("99")); !bytes.Equal(k, []byte("99")) {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		if v := num.Get([]byte("500")); !bytes.Equal(v, []byte("500")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a bucket can rewrite a key in the same transaction.
 func TestBucket_Put_Repeat(t *testing.T) {
 	db := MustOpenDB()
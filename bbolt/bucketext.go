@@ -0,0 +1,68 @@
+package bbolt
+
+import "unsafe"
+
+// Tags of the settings in a bucket extension.
+const (
+	bucketExtCodec      = 0x01 // Name of the Codec of the values.
+	bucketExtComparator = 0x02 // Name of the Comparator of the keys.
+)
+
+// bucketExt holds the persistent settings of a bucket. It is stored after the
+// bucket header as a sequence of (tag, length, name) triples.
+//
+// Buckets with settings are never inlined. Thus their header is followed by
+// the extension, and not by an inline page.
+type bucketExt struct {
+	codecName string
+	codec     Codec // nil, if codecName is not registered.
+	cmpName   string
+	cmp       Comparator // nil, if cmpName is not registered.
+}
+
+// encode appends the encoded extension to dst.
+func (e *bucketExt) encode(dst []byte) []byte {
+	if e.codecName != "" {
+		dst = append(dst, bucketExtCodec, byte(len(e.codecName)))
+		dst = append(dst, e.codecName...)
+	}
+	if e.cmpName != "" {
+		dst = append(dst, bucketExtComparator, byte(len(e.cmpName)))
+		dst = append(dst, e.cmpName...)
+	}
+	return dst
+}
+
+// decodeBucketExt decodes the extension following a bucket header.
+// It returns nil, if buf is malformed.
+func decodeBucketExt(buf []byte) *bucketExt {
+	e := &bucketExt{}
+	for len(buf) > 0 {
+		if len(buf) < 2 || len(buf) < 2+int(buf[1]) {
+			return nil
+		}
+		name := string(buf[2 : 2+int(buf[1])])
+		switch buf[0] {
+		case bucketExtCodec:
+			e.codecName = name
+			e.codec = lookupCodec(name)
+		case bucketExtComparator:
+			e.cmpName = name
+			e.cmp = lookupComparator(name)
+		default:
+			return nil
+		}
+		buf = buf[2+int(buf[1]):]
+	}
+	return e
+}
+
+// header returns the value, that stores the bucket in its parent.
+func (b *Bucket) header() []byte {
+	value := make([]byte, bucketHeaderSize, bucketHeaderSize+32)
+	*(*bucket)(unsafe.Pointer(&value[0])) = *b.bucket
+	if b.ext != nil {
+		value = b.ext.encode(value)
+	}
+	return value
+}
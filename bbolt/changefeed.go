@@ -0,0 +1,300 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Change describes the modification of a single key by a committed
+// transaction.
+type Change struct {
+	// Bucket is the path of names from the root to the bucket or radix tree
+	// holding the key.
+	Bucket [][]byte
+
+	Key []byte
+	Old []byte // Value before the change, nil if the key was created.
+	New []byte // Value after the change, nil if the key was deleted.
+
+	op changeOp
+}
+
+// changeOp identifies structural changes. They are only delivered to internal
+// subscribers, which replicate the database, see DB.Compact(). Key is the name
+// of the nested bucket in Bucket, that is affected.
+type changeOp uint8
+
+const (
+	changeKey          changeOp = iota // Value of Key changed.
+	changeCreateBucket                 // Bucket Key was created.
+	changeCreateRadix                  // Radix tree Key was created.
+	changeDeleteBucket                 // Bucket or radix tree Key was deleted.
+	changeBucketExt                    // New holds the settings of the new bucket Key.
+	changeSequence                     // New holds the sequence of bucket or radix tree Key.
+	changeToRadix                      // Bucket Key was converted into a radix tree.
+	changeToBucket                     // Radix tree Key was converted into a bucket.
+)
+
+// ChangeSet holds the changes of a committed transaction, in the order they
+// were made. A key may occur more than once.
+type ChangeSet struct {
+	Txid    int
+	Changes []Change
+}
+
+// ChangeFilter selects the changes a subscriber is interested in.
+type ChangeFilter func(bucket [][]byte, key []byte) bool
+
+// Subscription delivers the changes of committed transactions.
+// The ChangeSets are delivered in the order of the transaction ids. A
+// subscriber that does not keep up does not block the writers, its changes
+// are queued instead.
+type Subscription struct {
+	db       *DB
+	filter   ChangeFilter
+	internal bool // Receives structural changes, but through drain().
+	ch       chan *ChangeSet
+	done     chan struct{}
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*ChangeSet
+	closed bool
+}
+
+// Subscribe starts delivering the changes of every transaction committed from
+// now on. If filter is not nil, only the changes it selects are delivered and
+// transactions without any selected change are skipped. Values and deletions
+// of keys are reported, including the keys of deleted buckets, but not the
+// creation or deletion of the buckets themselves. Converting between Bucket
+// and RadixBucket does not produce changes.
+//
+// The ChangeSets are shared between subscribers and must not be modified.
+// The subscription must be closed once it is no longer needed.
+func (db *DB) Subscribe(filter ChangeFilter) *Subscription {
+	s := db.subscribe(filter, false)
+	go s.run()
+	return s
+}
+
+func (db *DB) subscribe(filter ChangeFilter, internal bool) *Subscription {
+	s := &Subscription{db: db, filter: filter, internal: internal, ch: make(chan *ChangeSet), done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+
+	db.sublock.Lock()
+	db.subs = append(db.subs, s)
+	db.sublock.Unlock()
+	return s
+}
+
+// Changes returns the channel the ChangeSets are delivered on. The channel is
+// closed when the subscription or the database is closed.
+func (s *Subscription) Changes() <-chan *ChangeSet {
+	return s.ch
+}
+
+// Close stops the subscription. Queued ChangeSets are discarded.
+func (s *Subscription) Close() {
+	db := s.db
+	db.sublock.Lock()
+	for i, o := range db.subs {
+		if o == s {
+			db.subs = append(db.subs[:i], db.subs[i+1:]...)
+			break
+		}
+	}
+	db.sublock.Unlock()
+	s.close()
+}
+
+func (s *Subscription) close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.queue = nil
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// run moves ChangeSets from the queue to the channel.
+func (s *Subscription) run() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		cs := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- cs:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// drain removes all queued ChangeSets of an internal subscription.
+func (s *Subscription) drain() []*ChangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.queue
+	s.queue = nil
+	return queue
+}
+
+// enqueue queues the changes selected by the filter for delivery.
+func (s *Subscription) enqueue(id txid, changes []Change) {
+	if s.filter != nil || !s.internal {
+		var selected []Change
+		for _, c := range changes {
+			if c.op != changeKey && !s.internal {
+				continue
+			}
+			if s.filter == nil || s.filter(c.Bucket, c.Key) {
+				selected = append(selected, c)
+			}
+		}
+		changes = selected
+	}
+	if len(changes) == 0 {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.queue = append(s.queue, &ChangeSet{Txid: int(id), Changes: changes})
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// subscribed reports whether the database has any subscribers.
+func (db *DB) subscribed() bool {
+	db.sublock.Lock()
+	defer db.sublock.Unlock()
+	return len(db.subs) > 0
+}
+
+// publish delivers the changes of the committed transaction id to all
+// subscribers. It is called by the writer, so the ChangeSets are queued in
+// the order of the transaction ids.
+func (db *DB) publish(id txid, changes []Change) {
+	db.sublock.Lock()
+	defer db.sublock.Unlock()
+	for _, s := range db.subs {
+		s.enqueue(id, changes)
+	}
+}
+
+// closeSubscriptions closes all subscriptions of the database.
+func (db *DB) closeSubscriptions() {
+	db.sublock.Lock()
+	subs := db.subs
+	db.subs = nil
+	db.sublock.Unlock()
+	for _, s := range subs {
+		s.close()
+	}
+}
+
+// childPath returns the path of the nested bucket name below parent, if the
+// transaction captures changes. Otherwise it returns nil.
+func (tx *Tx) childPath(parent [][]byte, name []byte) [][]byte {
+	if !tx.capture {
+		return nil
+	}
+	path := make([][]byte, len(parent)+1)
+	copy(path, parent)
+	path[len(parent)] = cloneBytes(name)
+	return path
+}
+
+// recordChange remembers the modification of key in the bucket at path.
+// old and new must already be copies, nil denotes a missing key.
+func (tx *Tx) recordChange(path [][]byte, key, old, new []byte) {
+	tx.changes = append(tx.changes, Change{Bucket: path, Key: cloneBytes(key), Old: old, New: new})
+}
+
+// recordStructure remembers a structural change of the nested bucket name
+// below path. Structural changes are recorded even while muted.
+func (tx *Tx) recordStructure(op changeOp, path [][]byte, name, value []byte) {
+	if !tx.capture {
+		return
+	}
+	tx.changes = append(tx.changes, Change{Bucket: path, Key: cloneBytes(name), New: value, op: op})
+}
+
+// recordSequence remembers the sequence of the bucket or radix tree at path.
+func (tx *Tx) recordSequence(path [][]byte, seq uint64) {
+	if !tx.capture || len(path) == 0 {
+		return
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, seq)
+	tx.recordStructure(changeSequence, path[:len(path)-1], path[len(path)-1], value)
+}
+
+// recording reports whether changes are currently captured.
+func (tx *Tx) recording() bool {
+	return tx.capture && !tx.muted
+}
+
+// mute suspends the capture of changes until the returned function is
+// called. It is used while converting between Bucket and RadixBucket, which
+// moves keys without changing them.
+func (tx *Tx) mute() (unmute func()) {
+	muted := tx.muted
+	tx.muted = true
+	return func() { tx.muted = muted }
+}
+
+// recordPut remembers that key was set to value. v is the stored previous
+// value, which is only used if found is set.
+func (b *Bucket) recordPut(key, v []byte, found bool, value []byte) {
+	if !b.tx.recording() {
+		return
+	}
+	var old []byte
+	if found {
+		old = cloneBytes(b.value(v))
+	}
+	b.tx.recordChange(b.path, key, old, cloneBytes(value))
+}
+
+// recordDelete remembers that key was deleted. v is the stored previous value.
+func (b *Bucket) recordDelete(key, v []byte) {
+	if !b.tx.recording() {
+		return
+	}
+	b.tx.recordChange(b.path, key, cloneBytes(b.value(v)), nil)
+}
+
+// recordPut remembers that key was set to value. old is the previous value,
+// which is empty if the key did not exist.
+func (r *RadixBucket) recordPut(key, old, value []byte) {
+	if !r.acc.tx.recording() {
+		return
+	}
+	var o []byte
+	if len(old) != 0 {
+		o = cloneBytes(old)
+	}
+	r.acc.tx.recordChange(r.path, key, o, cloneBytes(value))
+}
+
+// recordDelete remembers that key was deleted. old is the previous value.
+func (r *RadixBucket) recordDelete(key, old []byte) {
+	if !r.acc.tx.recording() || len(old) == 0 {
+		return
+	}
+	r.acc.tx.recordChange(r.path, key, cloneBytes(old), nil)
+}
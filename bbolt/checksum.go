@@ -0,0 +1,177 @@
+package bbolt
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"unsafe"
+)
+
+// metaPageChecksums is set in meta.flags, if every page except the meta pages
+// ends in a checksum of its contents.
+const metaPageChecksums = 0x01
+
+// pageChecksumSize is the size of the checksum at the end of a page.
+const pageChecksumSize = 8
+
+// pageReserve returns the number of bytes of a page, that hold no data.
+func (db *DB) pageReserve() int {
+	return pageHeaderSize + db.pageTrailer
+}
+
+// pageSpan returns the number of bytes a page and its overflow pages occupy.
+func (db *DB) pageSpan(p *page) int {
+	return (int(p.overflow) + 1) * db.pageSize
+}
+
+// pageSum computes the checksum of the page. The page must be fully mapped.
+func (db *DB) pageSum(p *page) (sum uint64, stored *uint64) {
+	n := db.pageSpan(p) - pageChecksumSize
+	var h = fnv.New64a()
+	_, _ = h.Write((*[maxAllocSize]byte)(unsafe.Pointer(p))[:n:n])
+	return h.Sum64(), (*uint64)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + uintptr(n)))
+}
+
+// sealPage stores the checksum of the page, or encrypts it, before it is
+// written.
+func (db *DB) sealPage(p *page) error {
+	if db.pageTrailer == 0 {
+		return nil
+	} else if db.cipher != nil {
+		return db.encryptPage(p)
+	}
+	sum, stored := db.pageSum(p)
+	*stored = sum
+	return nil
+}
+
+// verifyPage checks the checksum of the mapped page with the given id.
+// Encrypted pages are checked by decrypting them.
+func (db *DB) verifyPage(id pgid) error {
+	if db.pageTrailer == 0 || id <= 1 {
+		return nil
+	}
+	p, err := db.mappedPage(id)
+	if err != nil {
+		return err
+	}
+	if db.cipher != nil {
+		_, err := db.decryptPage(p)
+		return err
+	}
+	if sum, stored := db.pageSum(p); sum != *stored {
+		return fmt.Errorf("page %d: checksum error", int(id))
+	}
+	return nil
+}
+
+// mappedPage returns the mapped page with the given id, after making sure,
+// that it is mapped entirely.
+func (db *DB) mappedPage(id pgid) (*page, error) {
+	if p := db.walPage(id); p != nil {
+		return p, nil
+	}
+	if (int(id)+1)*db.pageSize > db.datasz {
+		return nil, fmt.Errorf("page %d: checksum error: out of bounds", int(id))
+	}
+	p := (*page)(unsafe.Pointer(&db.data[id*pgid(db.pageSize)]))
+	if p.id != id {
+		return nil, fmt.Errorf("page %d: checksum error: page id mismatch: %d", int(id), int(p.id))
+	}
+	if (int(id)+int(p.overflow)+1)*db.pageSize > db.datasz {
+		return nil, fmt.Errorf("page %d: checksum error: overflow out of bounds: %d", int(id), int(p.overflow))
+	}
+	return p, nil
+}
+
+// checkPage verifies the page with the given id on first read. It panics with
+// ErrChecksum if the page is corrupted, which every exported method, that
+// reads pages, recovers and reports. Encrypted pages are verified by
+// decryptedPage().
+func (db *DB) checkPage(id pgid) {
+	if id <= 1 || int(id) >= len(db.verified) || atomic.LoadUint32(&db.verified[id]) != 0 {
+		return
+	}
+	if db.verifyPage(id) != nil {
+		panic(ErrChecksum)
+	}
+	atomic.StoreUint32(&db.verified[id], 1)
+}
+
+// unverifyPage forgets that the page was verified or decrypted, after it
+// was written.
+func (db *DB) unverifyPage(id pgid) {
+	if db.cipher != nil {
+		db.forgetDecrypted(id)
+	}
+	if int(id) < len(db.verified) {
+		atomic.StoreUint32(&db.verified[id], 0)
+	}
+}
+
+// resizeVerified adjusts the verification record to the size of the mmap.
+// It is called with the mmap lock held.
+func (db *DB) resizeVerified() {
+	if db.pageTrailer == 0 || db.cipher != nil {
+		db.verified = nil
+		return
+	}
+	n := db.datasz / db.pageSize
+	if n <= len(db.verified) {
+		db.verified = db.verified[:n]
+		return
+	}
+	verified := make([]uint32, n)
+	copy(verified, db.verified)
+	db.verified = verified
+}
+
+// checksumError returns the error of a panic caused by a corrupted or
+// tampered page. Any other panic is passed on.
+func checksumError(r interface{}) error {
+	if r != ErrChecksum && r != ErrDecrypt {
+		panic(r)
+	}
+	return r.(error)
+}
+
+// recoverChecksum turns a checksum panic into an error.
+func recoverChecksum(err *error) {
+	if r := recover(); r != nil {
+		*err = checksumError(r)
+	}
+}
+
+// recoverError turns a checksum panic into the error of a method, that reads
+// pages of the transaction. The transaction keeps the error, see Tx.Err().
+func (tx *Tx) recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = checksumError(r)
+		tx.fail(*err)
+	}
+}
+
+// recoverRead turns a checksum panic in a method without an error result
+// into the error of the transaction, see Tx.Err(). The method returns its
+// zero values.
+func (tx *Tx) recoverRead() {
+	if r := recover(); r != nil {
+		tx.fail(checksumError(r))
+	}
+}
+
+// fail keeps the first read error of the transaction.
+func (tx *Tx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// tryLoadFreelist loads the freelist. Without a synced freelist, the free
+// pages are found by reading every page, thus it can fail with ErrChecksum
+// or ErrDecrypt.
+func (db *DB) tryLoadFreelist() (err error) {
+	defer recoverChecksum(&err)
+	db.loadFreelist()
+	return nil
+}
@@ -0,0 +1,105 @@
+package bbolt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// metaPageEncrypted is set in meta.flags, if every page except the meta pages
+// is encrypted.
+const metaPageEncrypted = 0x02
+
+// decryptedPageN is the number of decrypted pages kept in the page cache.
+const decryptedPageN = 4096
+
+// An encrypted page consists of the page header in plain text, followed by
+// the encrypted data and the tag. The nonce is stored at the end of the page.
+// The header is authenticated along with the data, so pages can neither be
+// modified nor moved.
+
+// cipherTrailer returns the number of bytes the encryption adds to a page.
+func (db *DB) cipherTrailer() int {
+	return db.cipher.NonceSize() + db.cipher.Overhead()
+}
+
+// encryptPage encrypts a page in place, before it is written.
+func (db *DB) encryptPage(p *page) error {
+	span := db.pageSpan(p)
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(p))[:span:span]
+	nonce := buf[span-db.cipher.NonceSize():]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("page %d: nonce: %s", int(p.id), err)
+	}
+	data := buf[pageHeaderSize : span-db.pageTrailer]
+	db.cipher.Seal(data[:0], nonce, data, buf[:pageHeaderSize])
+	return nil
+}
+
+// decryptPage decrypts a mapped page into a new buffer. The page must be
+// fully mapped.
+func (db *DB) decryptPage(p *page) (*page, error) {
+	span := db.pageSpan(p)
+	enc := (*[maxAllocSize]byte)(unsafe.Pointer(p))[:span:span]
+	buf := make([]byte, span)
+	copy(buf, enc[:pageHeaderSize])
+	nonce := enc[span-db.cipher.NonceSize():]
+	if _, err := db.cipher.Open(buf[pageHeaderSize:pageHeaderSize], nonce, enc[pageHeaderSize:span-len(nonce)], enc[:pageHeaderSize]); err != nil {
+		return nil, fmt.Errorf("page %d: %w: %s", int(p.id), ErrDecrypt, err)
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// decryptedPage returns the decrypted page with the given id from the page
+// cache. It panics with ErrDecrypt, if the page can not be decrypted, and
+// with ErrChecksum, if it lies outside of the file.
+//
+// Pages are not modified while they are reachable by any transaction, so
+// evicted pages stay valid for the readers holding them.
+func (db *DB) decryptedPage(id pgid) *page {
+	db.decrypted.Lock()
+	p := db.decrypted.m[id]
+	db.decrypted.Unlock()
+	if p != nil {
+		return p
+	}
+
+	p, err := db.mappedPage(id)
+	if err == nil {
+		p, err = db.decryptPage(p)
+	}
+	if err != nil {
+		panic(verifyError(err))
+	}
+
+	db.decrypted.Lock()
+	if db.decrypted.m == nil {
+		db.decrypted.m = make(map[pgid]*page)
+	}
+	for k := range db.decrypted.m {
+		if len(db.decrypted.m) < decryptedPageN {
+			break
+		}
+		delete(db.decrypted.m, k)
+	}
+	db.decrypted.m[id] = p
+	db.decrypted.Unlock()
+	return p
+}
+
+// verifyError returns ErrDecrypt or ErrChecksum for an error of verifyPage().
+func verifyError(err error) error {
+	if errors.Is(err, ErrDecrypt) {
+		return ErrDecrypt
+	}
+	return ErrChecksum
+}
+
+// forgetDecrypted removes a page from the page cache, after it was written.
+func (db *DB) forgetDecrypted(id pgid) {
+	db.decrypted.Lock()
+	delete(db.decrypted.m, id)
+	db.decrypted.Unlock()
+}
@@ -0,0 +1,168 @@
+package bbolt
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec compresses the values of a bucket.
+//
+// Codecs are registered by name with RegisterCodec. The name is stored with
+// the bucket, so every transaction reading the bucket decodes its values, as
+// long as the codec is registered in the program. Buckets, whose codec is not
+// registered, can not be opened.
+type Codec interface {
+	// Encode appends the encoded form of src to dst and returns the result.
+	Encode(dst, src []byte) []byte
+
+	// Decode appends the decoded form of src to dst and returns the result.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{"flate": flateCodec{}}}
+
+// RegisterCodec makes a Codec available under the given name.
+// It panics, if the name is empty, longer than 255 bytes or already taken.
+//
+// The codec "flate" is always registered.
+func RegisterCodec(name string, c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if name == "" || len(name) > 255 {
+		panic(fmt.Sprintf("invalid codec name %q", name))
+	} else if c == nil {
+		panic("codec is nil")
+	} else if _, ok := codecs.m[name]; ok {
+		panic(fmt.Sprintf("codec %q registered twice", name))
+	}
+	codecs.m[name] = c
+}
+
+// lookupCodec returns the codec with the given name, or nil.
+func lookupCodec(name string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.m[name]
+}
+
+// Each encoded value starts with one of these bytes.
+const (
+	valueRaw     = 0x00 // The value is stored as is.
+	valueEncoded = 0x01 // The value is encoded by the codec.
+)
+
+// encodeValue encodes a value, that is put into the bucket.
+// Values, that the codec would not shrink, are stored as is.
+func (b *Bucket) encodeValue(v []byte) ([]byte, error) {
+	if b.ext == nil || b.ext.codecName == "" {
+		return v, nil
+	} else if b.ext.codec == nil {
+		return nil, ErrCodecNotFound
+	}
+	enc := b.ext.codec.Encode([]byte{valueEncoded}, v)
+	if len(enc) <= len(v) {
+		return enc, nil
+	}
+	raw := make([]byte, len(v)+1)
+	raw[0] = valueRaw
+	copy(raw[1:], v)
+	return raw, nil
+}
+
+// decodeValue decodes a value of the bucket. It returns ErrDecode, if the
+// value is empty, has an unknown tag, or the codec fails.
+//
+// Buckets, whose codec is not registered, are only reached by traversals,
+// that do not use the values, like Tx.Check(). They get the stored value.
+func (b *Bucket) decodeValue(v []byte) ([]byte, error) {
+	if b.ext == nil || b.ext.codecName == "" || b.ext.codec == nil || v == nil {
+		return v, nil
+	} else if len(v) == 0 {
+		return nil, ErrDecode
+	}
+	switch v[0] {
+	case valueRaw:
+		return v[1:], nil
+	case valueEncoded:
+		dec, err := b.ext.codec.Decode(nil, v[1:])
+		if err != nil {
+			return nil, ErrDecode
+		} else if dec == nil {
+			dec = []byte{}
+		}
+		return dec, nil
+	}
+	return nil, ErrDecode
+}
+
+// value decodes a value for a method without an error result. A value, that
+// can not be decoded, is returned as nil and the transaction keeps the error.
+func (b *Bucket) value(v []byte) []byte {
+	dec, err := b.decodeValue(v)
+	if err != nil {
+		b.tx.fail(err)
+	}
+	return dec
+}
+
+// Codec returns the name of the codec of the bucket, or "" if the values are
+// stored as is.
+func (b *Bucket) Codec() string {
+	if b.ext == nil {
+		return ""
+	}
+	return b.ext.codecName
+}
+
+// CreateBucketWithCodec creates a new bucket, whose values are compressed by
+// the named codec. Nested buckets are not compressed.
+// Returns ErrCodecNotFound, if no codec is registered under the name.
+func (b *Bucket) CreateBucketWithCodec(key []byte, codec string) (child *Bucket, err error) {
+	defer b.tx.recoverError(&err)
+	c := lookupCodec(codec)
+	if c == nil {
+		return nil, ErrCodecNotFound
+	}
+	return b.createBucketExt(key, &bucketExt{codecName: codec, codec: c})
+}
+
+// CreateBucketWithCodec creates a new top-level bucket, whose values are
+// compressed by the named codec.
+func (tx *Tx) CreateBucketWithCodec(name []byte, codec string) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.CreateBucketWithCodec(name, codec)
+}
+
+// flateCodec compresses values with DEFLATE.
+type flateCodec struct{}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+func (flateCodec) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	_, _ = w.Write(src)
+	_ = w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+func (flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	dec, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, dec...), nil
+}
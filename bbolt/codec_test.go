@@ -0,0 +1,74 @@
+package bbolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Ensure that a bucket, whose codec is not registered, is not opened, instead
+// of reporting its values as missing.
+func TestBucket_CodecNotRegistered(t *testing.T) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	RegisterCodec("test-unregistered", flateCodec{})
+	defer func() {
+		codecs.Lock()
+		delete(codecs.m, "test-unregistered")
+		codecs.Unlock()
+	}()
+
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketWithCodec([]byte("widgets"), "test-unregistered")
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte(strings.Repeat("bar", 100)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	codecs.Lock()
+	delete(codecs.m, "test-unregistered")
+	codecs.Unlock()
+
+	if err := db.View(func(tx *Tx) error {
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			t.Fatalf("unexpected bucket with codec %q", b.Codec())
+		}
+		if _, err := tx.OpenBucket([]byte("widgets")); err != ErrCodecNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0], `codec "test-unregistered" not registered`) {
+			t.Fatalf("unexpected errors: %q", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.ConvertToRadix([]byte("widgets"))
+		return err
+	}); err != ErrCodecNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Compact(context.Background()); err != ErrCodecNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,698 @@
+package bbolt
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"sync"
+)
+
+// compactTxSize is the amount of data, that DB.Compact() writes per
+// transaction into the new file.
+const compactTxSize = 16 << 20
+
+// compactRounds is the number of times DB.Compact() replays the transactions
+// committed in the meantime, before it blocks the writers for the last round.
+const compactRounds = 4
+
+// Compact rewrites the database into a new file, that only holds the live
+// data, and replaces the database file by it. Buckets, inline buckets and
+// radix trees are rebuilt with densely filled pages, so the new file is
+// usually much smaller than a file with many free pages.
+//
+// The copy is made from a read-only transaction, so readers and writers
+// continue while it runs. The transactions committed in the meantime are
+// replayed on the copy afterwards. Only the last round of replays blocks the
+// writers, and the files are swapped once all open transactions have been
+// closed. Thus Compact must not be called while the calling goroutine holds
+// a transaction. Transaction ids continue where the old file left off.
+//
+// The new file is created next to the database file, with the suffix
+// ".compact". If ctx is cancelled or an error occurs, it is removed and the
+// database is left unchanged. Snapshots can not be carried over to the new
+// file, so Compact returns ErrSnapshotsExist, unless they are dropped before.
+// If a page checksum does not match, or a page fails to decrypt, ErrChecksum
+// or ErrDecrypt is returned.
+func (db *DB) Compact(ctx context.Context) (err error) {
+	// Report corrupted pages instead of crashing.
+	defer recoverChecksum(&err)
+
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	} else if len(db.Snapshots()) != 0 {
+		return ErrSnapshotsExist
+	}
+
+	// Capture every transaction, that commits after the copy was started.
+	// Waiting for the writer ensures, that no transaction is in progress,
+	// which began before the subscription.
+	sub := db.subscribe(nil, true)
+	defer sub.Close()
+	db.rwlock.Lock()
+	db.rwlock.Unlock()
+
+	src, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if src != nil {
+			_ = src.Rollback()
+		}
+	}()
+	base := src.meta.txid
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	path := db.path + ".compact"
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dst, err := Open(path, info.Mode(), &Options{
+		NoSync:         true,
+		NoFreelistSync: db.NoFreelistSync,
+		PageSize:       db.pageSize,
+		PageChecksums:  db.pageTrailer != 0,
+		Cipher:         db.cipher,
+		RadixPacking:   db.RadixPacking,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dst.Close()
+		_ = os.Remove(path)
+		_ = os.Remove(path + deltaSuffix)
+	}()
+
+	// Copy the snapshot. The values remain valid until the read-only
+	// transaction is closed, thus the copy is committed before.
+	w := &compactWriter{db: dst}
+	defer func() {
+		if w.tx != nil {
+			_ = w.tx.Rollback()
+		}
+	}()
+	if err := w.copyBucket(ctx, &src.root, nil); err != nil {
+		return err
+	} else if err := src.Err(); err != nil {
+		return err
+	}
+	if err := w.commit(); err != nil {
+		return err
+	}
+	_ = src.Rollback()
+	src = nil
+
+	// Catch up with the writers.
+	for i := 0; i < compactRounds; i++ {
+		sets := sub.drain()
+		if len(sets) == 0 {
+			break
+		}
+		if err := w.replay(ctx, sets, base); err != nil {
+			return err
+		}
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if len(db.snapshots) != 0 {
+		return ErrSnapshotsExist
+	}
+	if err := w.replay(ctx, sub.drain(), base); err != nil {
+		return err
+	}
+	if err := w.commit(); err != nil {
+		return err
+	}
+	id := db.meta().txid
+	if err := dst.stampMeta(id); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return db.swapFile(func() error {
+		if err := funlock(db); err != nil {
+			log.Printf("bolt.Compact(): funlock error: %s", err)
+		}
+		if err := db.file.Close(); err != nil {
+			return err
+		}
+		rerr := os.Rename(path, db.path)
+
+		// Reopen the database file, whether it was replaced or not.
+		f, err := os.OpenFile(db.path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		db.file = f
+		if err := flock(db, true, 0); err != nil {
+			return err
+		}
+		if !hasanyflag(db.db_Flags, DB_WriteSharedMmap|DB_WriteSeperatedMmap) {
+			db.ops.writeAt = db.file.WriteAt
+		}
+		if rerr != nil {
+			return rerr
+		}
+
+		// The pages of the new file are unknown to WriteDeltaTo().
+		db.deltalock.Lock()
+		db.written = nil
+		db.writtenSince = id
+		db.deltalock.Unlock()
+		return nil
+	})
+}
+
+// Shrink returns free pages at the end of the database file to the file
+// system. The pages stored beyond the number of used pages are moved into
+// free pages further in front, then the free pages at the end are removed
+// from the freelist, and the file is truncated, if enough trailing pages are
+// free to shrink it by at least one step of the mmap size.
+//
+// Shrink is much cheaper than Compact, as it only moves the pages near the
+// end of the file, but it does not reclaim the free pages in between. Pages
+// still in use by open read-only transactions are not reclaimed. Like
+// Compact, it waits until all open transactions are closed for truncating the
+// file, so it must not be called while the calling goroutine holds a
+// transaction. If a page checksum does not match, or a page fails to decrypt,
+// ErrChecksum or ErrDecrypt is returned.
+func (db *DB) Shrink() (err error) {
+	// Report corrupted pages instead of crashing.
+	defer recoverChecksum(&err)
+
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	// Move every page at or beyond the number of used pages. The free pages
+	// beyond are held back, so the moved pages can only land in front.
+	// Pages still pending for readers can not be allocated by the move, so
+	// only the immediately allocatable pages are counted.
+	if err := db.Update(func(tx *Tx) error {
+		n := db.freelist.free_count() - db.freelist.pending_count()
+		if n <= 0 {
+			return nil
+		}
+		limit := tx.meta.pgid - pgid(n)
+		db.freelist.hold(tx.meta.txid, limit)
+		return tx.root.relocate(limit)
+	}); err != nil {
+		return err
+	}
+
+	// Drop the pages freed by the move. They are released to the freelist,
+	// when the next transaction begins. As the freelist written by the move
+	// may be stored at the end of the file, this is done twice: the first
+	// commit writes the freelist to a page further in front.
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			tx.meta.pgid = db.freelist.truncate(tx.meta.pgid)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := int(db.meta().pgid) * db.pageSize
+	if !hasflags(db.db_Flags, DB_DontTruncateOnMmap) {
+		if size, err = db.mmapSize(size); err != nil {
+			return err
+		}
+	}
+	if int64(size) >= info.Size() {
+		return nil
+	}
+	return db.swapFile(func() error {
+		return db.file.Truncate(int64(size))
+	})
+}
+
+// swapFile replaces or truncates the database file, while no transaction is
+// open. The caller must hold the writer lock. fn is called while the file is
+// unmapped, afterwards the file is mapped again and the state derived from
+// its contents is reset.
+func (db *DB) swapFile(fn func() error) error {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+
+	// The log refers to the pages of the current file.
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	if err := db.munmap(); err != nil {
+		return err
+	}
+	ferr := fn()
+	db.verified = nil
+	if err := db.remap(0); err != nil {
+		return err
+	}
+	db.filesz = 0
+
+	db.decrypted.Lock()
+	db.decrypted.m = nil
+	db.decrypted.Unlock()
+
+	if err := db.loadSnapshots(); err != nil {
+		return err
+	}
+
+	// Writers update the statistics after releasing the writer lock.
+	db.statlock.Lock()
+	db.freelist = nil
+	db.freelistLoad = sync.Once{}
+	db.loadFreelist()
+	db.statlock.Unlock()
+	return ferr
+}
+
+// stampMeta rewrites both meta pages, such that the last committed
+// transaction gets the given id.
+func (db *DB) stampMeta(id txid) error {
+	if err := fdatasync(db); err != nil {
+		return err
+	}
+	var m meta
+	db.meta().copy(&m)
+	buf := make([]byte, db.pageSize)
+	for _, t := range []txid{id - 1, id} {
+		m.txid = t
+		p := db.pageInBuffer(buf, 0)
+		m.write(p)
+		if _, err := db.ops.writeAt(buf, int64(p.id)*int64(db.pageSize)); err != nil {
+			return err
+		}
+	}
+	return fdatasync(db)
+}
+
+// relocate materializes every node stored at or beyond the page limit,
+// together with its ancestors, so that it is written to a new page on commit.
+// Nested buckets and radix trees are relocated as well.
+func (b *Bucket) relocate(limit pgid) error {
+	if b.root == 0 {
+		return nil
+	}
+	marked := make(map[pgid]bool)
+	if b.markTail(b.root, limit, marked) {
+		b.materialize(b.root, nil, marked)
+	}
+
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		_, _, flags := c.keyValue()
+		switch {
+		case flags&bucketLeafFlag != 0:
+			child, err := b.OpenBucket(k)
+			if err != nil {
+				return err
+			}
+			if err := child.relocate(limit); err != nil {
+				return err
+			}
+		case flags&radixLeafFlag != 0:
+			if err := b.RadixBucket(k).relocate(limit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markTail marks the pages, whose subtree holds a page at or beyond limit.
+func (b *Bucket) markTail(id, limit pgid, marked map[pgid]bool) bool {
+	p := b.tx.page(id)
+	tail := id+pgid(p.overflow) >= limit
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			if b.markTail(p.branchPageElement(uint16(i)).pgid, limit, marked) {
+				tail = true
+			}
+		}
+	}
+	if tail {
+		marked[id] = true
+	}
+	return tail
+}
+
+// materialize creates the nodes of the marked pages.
+func (b *Bucket) materialize(id pgid, parent *node, marked map[pgid]bool) {
+	n := b.node(id, parent)
+	if n.isLeaf {
+		return
+	}
+	for _, inode := range n.inodes {
+		if marked[inode.pgid] {
+			b.materialize(inode.pgid, n, marked)
+		}
+	}
+}
+
+// compactWriter writes the new file of DB.Compact(). It commits its
+// transaction, whenever compactTxSize bytes have been written.
+type compactWriter struct {
+	db   *DB
+	tx   *Tx
+	size int
+	gen  int // incremented, whenever the opened buckets become invalid
+}
+
+// compactTarget is a bucket or a radix tree of the new file.
+type compactTarget struct {
+	b *Bucket
+	r *RadixBucket
+}
+
+// compactDst caches a bucket of the new file, while it is copied.
+type compactDst struct {
+	path [][]byte
+	t    compactTarget
+	gen  int
+}
+
+// copyBucket copies the contents of src into the bucket at path.
+func (w *compactWriter) copyBucket(ctx context.Context, src *Bucket, path [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := &compactDst{path: path}
+	c := src.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		_, _, flags := c.keyValue()
+		var err error
+		switch {
+		case flags&bucketLeafFlag != 0:
+			var child *Bucket
+			if child, err = src.OpenBucket(k); err == nil {
+				err = w.copyNested(ctx, d, k, child, nil)
+			}
+		case flags&radixLeafFlag != 0:
+			if rad := src.RadixBucket(k); rad != nil {
+				err = w.copyNested(ctx, d, k, nil, rad)
+			} else {
+				err = ErrIncompatibleValue
+			}
+		default:
+			err = w.put(d, k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRadix copies the contents of src into the radix tree at path.
+func (w *compactWriter) copyRadix(ctx context.Context, src *RadixBucket, path [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := &compactDst{path: path}
+	it := src.Iterator()
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		var err error
+		if v != nil {
+			err = w.put(d, k, v)
+		} else if child := src.Bucket(k); child != nil {
+			err = w.copyNested(ctx, d, cloneBytes(k), child, nil)
+		} else if rad := src.RadixBucket(k); rad != nil {
+			err = w.copyNested(ctx, d, cloneBytes(k), nil, rad)
+		} else {
+			// The header of the radix tree can not be read.
+			err = ErrIncompatibleValue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyNested creates the nested bucket or radix tree name in d and copies
+// src or rad into it.
+func (w *compactWriter) copyNested(ctx context.Context, d *compactDst, name []byte, src *Bucket, rad *RadixBucket) error {
+	parent, err := w.target(d)
+	if err != nil {
+		return err
+	}
+	path := make([][]byte, len(d.path)+1)
+	copy(path, d.path)
+	path[len(d.path)] = cloneBytes(name)
+
+	if rad != nil {
+		child, err := parent.createRadix(name)
+		if err == nil {
+			err = child.setSequence(rad.Sequence())
+		}
+		if err != nil {
+			return err
+		}
+		return w.copyRadix(ctx, rad, path)
+	}
+
+	var ext *bucketExt
+	if src.ext != nil {
+		ext = decodeBucketExt(src.ext.encode(nil))
+	}
+	child, err := parent.createBucket(name, ext)
+	if err == nil {
+		err = child.setSequence(src.Sequence())
+	}
+	if err != nil {
+		return err
+	}
+	return w.copyBucket(ctx, src, path)
+}
+
+// put sets key to value in d.
+func (w *compactWriter) put(d *compactDst, key, value []byte) error {
+	t, err := w.target(d)
+	if err != nil {
+		return err
+	}
+	if err := t.put(key, value); err != nil {
+		return err
+	}
+	return w.add(len(key) + len(value))
+}
+
+// replay applies the changes of the transactions committed after base.
+func (w *compactWriter) replay(ctx context.Context, sets []*ChangeSet, base txid) error {
+	for _, cs := range sets {
+		if txid(cs.Txid) <= base {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, c := range cs.Changes {
+			if err := w.apply(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply applies a single change.
+func (w *compactWriter) apply(c Change) error {
+	t, err := w.resolve(c.Bucket)
+	if err != nil {
+		return err
+	}
+	switch c.op {
+	case changeKey:
+		if c.New == nil {
+			err = t.delete(c.Key)
+		} else {
+			err = t.put(c.Key, c.New)
+		}
+		if err != nil {
+			return err
+		}
+		return w.add(len(c.Key) + len(c.New))
+	case changeCreateBucket:
+		_, err = t.createBucket(c.Key, nil)
+	case changeCreateRadix:
+		_, err = t.createRadix(c.Key)
+	case changeDeleteBucket:
+		err = t.deleteNested(c.Key)
+	case changeSequence:
+		if child := t.child(c.Key); child.b == nil && child.r == nil {
+			err = ErrBucketNotFound
+		} else {
+			err = child.setSequence(binary.BigEndian.Uint64(c.New))
+		}
+	case changeBucketExt, changeToRadix, changeToBucket:
+		if t.b == nil {
+			return ErrIncompatibleValue
+		}
+		switch c.op {
+		case changeBucketExt:
+			// The bucket has just been created, without the settings.
+			if err = t.b.DeleteBucket(c.Key); err == nil {
+				_, err = t.b.createBucketExt(c.Key, decodeBucketExt(c.New))
+			}
+		case changeToRadix:
+			_, err = t.b.ConvertToRadix(c.Key)
+		default:
+			_, err = t.b.ConvertToBucket(c.Key)
+		}
+	}
+
+	// The opened buckets may have been replaced.
+	w.gen++
+	return err
+}
+
+// target returns the bucket cached by d, resolving it again if necessary.
+func (w *compactWriter) target(d *compactDst) (compactTarget, error) {
+	if w.tx == nil || d.gen != w.gen || (d.t.b == nil && d.t.r == nil) {
+		t, err := w.resolve(d.path)
+		if err != nil {
+			return t, err
+		}
+		d.t, d.gen = t, w.gen
+	}
+	return d.t, nil
+}
+
+// resolve looks up a bucket by its path, beginning a transaction if needed.
+func (w *compactWriter) resolve(path [][]byte) (compactTarget, error) {
+	if w.tx == nil {
+		tx, err := w.db.Begin(true)
+		if err != nil {
+			return compactTarget{}, err
+		}
+		w.tx = tx
+	}
+	t := compactTarget{b: &w.tx.root}
+	for _, name := range path {
+		if t = t.child(name); t.b == nil && t.r == nil {
+			return t, ErrBucketNotFound
+		}
+	}
+	return t, nil
+}
+
+// add accounts for n bytes written and commits, once the transaction is
+// large enough.
+func (w *compactWriter) add(n int) error {
+	if w.size += n; w.size < compactTxSize {
+		return nil
+	}
+	return w.commit()
+}
+
+// commit commits the open transaction.
+func (w *compactWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx, w.size = nil, 0
+	w.gen++
+	return err
+}
+
+// child returns the nested bucket or radix tree name. Buckets are filled
+// completely, as they are mostly written in order.
+func (t compactTarget) child(name []byte) compactTarget {
+	var b *Bucket
+	var r *RadixBucket
+	if t.b != nil {
+		if b = t.b.Bucket(name); b == nil {
+			r = t.b.RadixBucket(name)
+		}
+	} else if b = t.r.Bucket(name); b == nil {
+		r = t.r.RadixBucket(name)
+	}
+	if b != nil {
+		b.FillPercent = maxFillPercent
+	}
+	return compactTarget{b: b, r: r}
+}
+
+func (t compactTarget) put(key, value []byte) error {
+	if t.b != nil {
+		return t.b.Put(key, value)
+	}
+	return t.r.Put(key, value)
+}
+
+func (t compactTarget) delete(key []byte) error {
+	if t.b != nil {
+		return t.b.Delete(key)
+	}
+	return t.r.Delete(key)
+}
+
+func (t compactTarget) createBucket(name []byte, ext *bucketExt) (compactTarget, error) {
+	var b *Bucket
+	var err error
+	switch {
+	case t.b == nil:
+		b, err = t.r.CreateBucket(name)
+	case ext != nil:
+		b, err = t.b.createBucketExt(name, ext)
+	default:
+		b, err = t.b.CreateBucket(name)
+	}
+	if err != nil {
+		return compactTarget{}, err
+	}
+	b.FillPercent = maxFillPercent
+	return compactTarget{b: b}, nil
+}
+
+func (t compactTarget) createRadix(name []byte) (compactTarget, error) {
+	var r *RadixBucket
+	var err error
+	if t.b != nil {
+		r, err = t.b.CreateRadixBucket(name)
+	} else {
+		r, err = t.r.CreateRadixBucket(name)
+	}
+	return compactTarget{r: r}, err
+}
+
+func (t compactTarget) deleteNested(name []byte) error {
+	child := t.child(name)
+	switch {
+	case child.b != nil && t.b != nil:
+		return t.b.DeleteBucket(name)
+	case child.b != nil:
+		return t.r.DeleteBucket(name)
+	case child.r != nil && t.b != nil:
+		return t.b.DeleteRadixBucket(name)
+	case child.r != nil:
+		return t.r.DeleteRadixBucket(name)
+	}
+	return ErrBucketNotFound
+}
+
+func (t compactTarget) setSequence(v uint64) error {
+	if t.b != nil {
+		return t.b.SetSequence(v)
+	}
+	return t.r.SetSequence(v)
+}
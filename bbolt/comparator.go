@@ -0,0 +1,106 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Comparator orders the keys of a bucket. It returns a negative number, if
+// a sorts before b, a positive number, if a sorts after b, and 0 only if a and
+// b are identical.
+type Comparator func(a, b []byte) int
+
+var comparators = struct {
+	sync.RWMutex
+	m map[string]Comparator
+}{m: map[string]Comparator{"reverse": reverseCompare}}
+
+// RegisterComparator makes a Comparator available under the given name.
+// It panics, if the name is empty, longer than 255 bytes or already taken.
+//
+// The comparator "reverse", which orders keys descending, is always registered.
+func RegisterComparator(name string, cmp Comparator) {
+	comparators.Lock()
+	defer comparators.Unlock()
+	if name == "" || len(name) > 255 {
+		panic(fmt.Sprintf("invalid comparator name %q", name))
+	} else if cmp == nil {
+		panic("comparator is nil")
+	} else if _, ok := comparators.m[name]; ok {
+		panic(fmt.Sprintf("comparator %q registered twice", name))
+	}
+	comparators.m[name] = cmp
+}
+
+// lookupComparator returns the comparator with the given name, or nil.
+func lookupComparator(name string) Comparator {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	return comparators.m[name]
+}
+
+// reverseCompare orders keys descending.
+func reverseCompare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+// compare orders two keys of the bucket.
+func (b *Bucket) compare(x, y []byte) int {
+	if b.ext == nil || b.ext.cmpName == "" {
+		return bytes.Compare(x, y)
+	}
+	_assert(b.ext.cmp != nil, "comparator %q not registered", b.ext.cmpName)
+	return b.ext.cmp(x, y)
+}
+
+// usable returns ErrCodecNotFound or ErrComparatorNotFound, if the codec or
+// the comparator of the bucket is not registered, so that it can not be used.
+func (b *Bucket) usable() error {
+	if b.ext == nil {
+		return nil
+	} else if b.ext.codecName != "" && b.ext.codec == nil {
+		return ErrCodecNotFound
+	} else if b.ext.cmpName != "" && b.ext.cmp == nil {
+		return ErrComparatorNotFound
+	}
+	return nil
+}
+
+// usableOrNil returns the bucket, if it can be used. Otherwise it returns nil.
+func (b *Bucket) usableOrNil() *Bucket {
+	if b == nil || b.usable() != nil {
+		return nil
+	}
+	return b
+}
+
+// Comparator returns the name of the comparator of the bucket, or "" if the
+// keys are ordered by bytes.Compare.
+func (b *Bucket) Comparator() string {
+	if b.ext == nil {
+		return ""
+	}
+	return b.ext.cmpName
+}
+
+// CreateBucketWithComparator creates a new bucket, whose keys are ordered by
+// the named comparator. The name is stored with the bucket, so the comparator
+// must be registered by every program opening the bucket. Bucket() returns nil
+// for buckets with an unregistered comparator.
+// Returns ErrComparatorNotFound, if no comparator is registered under the name.
+func (b *Bucket) CreateBucketWithComparator(key []byte, cmpName string) (child *Bucket, err error) {
+	defer b.tx.recoverError(&err)
+	cmp := lookupComparator(cmpName)
+	if cmp == nil {
+		return nil, ErrComparatorNotFound
+	}
+	return b.createBucketExt(key, &bucketExt{cmpName: cmpName, cmp: cmp})
+}
+
+// CreateBucketWithComparator creates a new top-level bucket, whose keys are
+// ordered by the named comparator.
+func (tx *Tx) CreateBucketWithComparator(name []byte, cmpName string) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.CreateBucketWithComparator(name, cmpName)
+}
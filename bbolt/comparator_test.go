@@ -0,0 +1,145 @@
+package bbolt
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Ensure that a bucket, whose comparator is not registered, is reported as
+// such, instead of as a missing bucket.
+func TestBucket_ComparatorNotRegistered(t *testing.T) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	RegisterComparator("test-unregistered", reverseCompare)
+	defer func() {
+		comparators.Lock()
+		delete(comparators.m, "test-unregistered")
+		comparators.Unlock()
+	}()
+
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketWithComparator([]byte("widgets"), "test-unregistered")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(strconv.Itoa(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	comparators.Lock()
+	delete(comparators.m, "test-unregistered")
+	comparators.Unlock()
+
+	if err := db.Update(func(tx *Tx) error {
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			t.Fatalf("unexpected bucket with comparator %q", b.Comparator())
+		}
+		if _, err := tx.OpenBucket([]byte("widgets")); err != ErrComparatorNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.OpenBucket([]byte("gadgets")); err != ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("widgets")); err != ErrComparatorNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Shrink(); err != ErrComparatorNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that the parent of a bucket, whose comparator is not registered, can
+// be deleted.
+func TestBucket_ComparatorNotRegistered_DeleteParent(t *testing.T) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	RegisterComparator("test-unregistered", reverseCompare)
+	defer func() {
+		comparators.Lock()
+		delete(comparators.m, "test-unregistered")
+		comparators.Unlock()
+	}()
+
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		parent, err := tx.CreateBucket([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		b, err := parent.CreateBucketWithComparator([]byte("widgets"), "test-unregistered")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			child, err := b.CreateBucket([]byte(strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			if err := child.Put([]byte("foo"), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	comparators.Lock()
+	delete(comparators.m, "test-unregistered")
+	comparators.Unlock()
+
+	db, err = Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("parent"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if b := tx.Bucket([]byte("parent")); b != nil {
+			t.Fatal("expected bucket to be deleted")
+		}
+		for err := range tx.Check() {
+			t.Error(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
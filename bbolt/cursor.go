@@ -25,7 +25,6 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package bbolt
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 )
@@ -54,7 +53,8 @@ Accepts a visitor to the current record.
 
 This API is inspired by the internals of Kyoto Carbinet.
 */
-func (c *Cursor) Accept(vis Visitor, writable bool) error {
+func (c *Cursor) Accept(vis Visitor, writable bool) (err error) {
+	defer c.bucket.tx.recoverError(&err)
 	if c.bucket.tx.db == nil {
 		return ErrTxClosed
 	} else if writable && !c.bucket.Writable() {
@@ -77,25 +77,32 @@ func (c *Cursor) Accept(vis Visitor, writable bool) error {
 	if notValue(flags) { return nil }
 	
 	// Case 2: Record exists
-	vop := vis.VisitFull(k,v)
+	dec, err := b.decodeValue(v)
+	if err != nil { return err }
+	vop := vis.VisitFull(k,dec)
 	switch {
 	case vop.set():
 		if !writable { return ErrInvalidWriteAttempt }
 		key := cloneBytes(k)
-		value := vop.getBuf()
+		value, err := b.encodeValue(vop.getBuf())
+		if err != nil { return err }
+		b.recordPut(key, v, true, vop.getBuf())
 		c.node().put(key, key, value, 0, 0)
 	case vop.del():
 		if !writable { return ErrInvalidWriteAttempt }
 		key := cloneBytes(k)
+		b.recordDelete(key, v)
 		c.node().del(key)
 	case vop.bkt():
 		if !writable { return ErrInvalidWriteAttempt }
+		b.recordDelete(k, v)
 		// NOTE: We simply replace a key-value-pair with a bucket. So we don't have to delete it.
 		// c.node().del(key)
 		var value = createInlineBucket()
 		// Insert into node.
 		key := cloneBytes(k)
 		c.node().put(key, key, value, 0, bucketLeafFlag)
+		b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 		if vop.isset(voVISITBUCKET) {
 			vis.VisitBucket(k,b.Bucket(key))
 		}
@@ -124,6 +131,7 @@ func (c *Cursor) Descending() *Bucket {
 // If the bucket is empty then a nil key and value are returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) First() (key []byte, value []byte) {
+	defer c.bucket.tx.recoverRead()
 	_assert(c.bucket.tx.db != nil, "tx closed")
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
@@ -140,7 +148,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 	if notValue(flags) {
 		return k, nil
 	}
-	return k, v
+	return k, c.bucket.value(v)
 
 }
 
@@ -148,6 +156,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 // If the bucket is empty then a nil key and value are returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Last() (key []byte, value []byte) {
+	defer c.bucket.tx.recoverRead()
 	_assert(c.bucket.tx.db != nil, "tx closed")
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
@@ -159,25 +168,27 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 	if notValue(flags){
 		return k, nil
 	}
-	return k, v
+	return k, c.bucket.value(v)
 }
 
 // Next moves the cursor to the next item in the bucket and returns its key and value.
 // If the cursor is at the end of the bucket then a nil key and value are returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Next() (key []byte, value []byte) {
+	defer c.bucket.tx.recoverRead()
 	_assert(c.bucket.tx.db != nil, "tx closed")
 	k, v, flags := c.next()
 	if notValue(flags) {
 		return k, nil
 	}
-	return k, v
+	return k, c.bucket.value(v)
 }
 
 // Prev moves the cursor to the previous item in the bucket and returns its key and value.
 // If the cursor is at the beginning of the bucket then a nil key and value are returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Prev() (key []byte, value []byte) {
+	defer c.bucket.tx.recoverRead()
 	_assert(c.bucket.tx.db != nil, "tx closed")
 
 	// Attempt to move back one element until we're successful.
@@ -202,7 +213,7 @@ func (c *Cursor) Prev() (key []byte, value []byte) {
 	if notValue(flags) {
 		return k, nil
 	}
-	return k, v
+	return k, c.bucket.value(v)
 }
 
 // Seek moves the cursor to a given key and returns it.
@@ -210,6 +221,7 @@ func (c *Cursor) Prev() (key []byte, value []byte) {
 // follow, a nil key is returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
+	defer c.bucket.tx.recoverRead()
 	k, v, flags := c.seek(seek)
 
 	// If we ended up after the last element of a page then move to the next one.
@@ -222,23 +234,25 @@ func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
 	} else if notValue(flags) {
 		return k, nil
 	}
-	return k, v
+	return k, c.bucket.value(v)
 }
 
 // Delete removes the current key/value under the cursor from the bucket.
 // Delete fails if current key/value is a bucket or if the transaction is not writable.
-func (c *Cursor) Delete() error {
+func (c *Cursor) Delete() (err error) {
+	defer c.bucket.tx.recoverError(&err)
 	if c.bucket.tx.db == nil {
 		return ErrTxClosed
 	} else if !c.bucket.Writable() {
 		return ErrTxNotWritable
 	}
 
-	key, _, flags := c.keyValue()
+	key, v, flags := c.keyValue()
 	// Return an error if current value is a bucket.
 	if notValue(flags) {
 		return ErrIncompatibleValue
 	}
+	c.bucket.recordDelete(key, v)
 	c.node().del(key)
 
 	return nil
@@ -365,11 +379,11 @@ func (c *Cursor) searchNode(key []byte, n *node) {
 	index := sort.Search(len(n.inodes), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(n.inodes[i].key, key)
+		ret := c.bucket.compare(n.inodes[i].key, key)
 		if ret == 0 {
 			exact = true
 		}
-		return ret != -1
+		return ret >= 0
 	})
 	if !exact && index > 0 {
 		index--
@@ -388,11 +402,11 @@ func (c *Cursor) searchPage(key []byte, p *page) {
 	index := sort.Search(int(p.count), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(inodes[i].key(), key)
+		ret := c.bucket.compare(inodes[i].key(), key)
 		if ret == 0 {
 			exact = true
 		}
-		return ret != -1
+		return ret >= 0
 	})
 	if !exact && index > 0 {
 		index--
@@ -411,7 +425,7 @@ func (c *Cursor) nsearch(key []byte) {
 	// If we have a node then search its inodes.
 	if n != nil {
 		index := sort.Search(len(n.inodes), func(i int) bool {
-			return bytes.Compare(n.inodes[i].key, key) != -1
+			return c.bucket.compare(n.inodes[i].key, key) >= 0
 		})
 		e.index = index
 		return
@@ -420,7 +434,7 @@ func (c *Cursor) nsearch(key []byte) {
 	// If we have a page then search its leaf elements.
 	inodes := p.leafPageElements()
 	index := sort.Search(int(p.count), func(i int) bool {
-		return bytes.Compare(inodes[i].key(), key) != -1
+		return c.bucket.compare(inodes[i].key(), key) >= 0
 	})
 	e.index = index
 }
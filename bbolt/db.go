@@ -25,6 +25,7 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package bbolt
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"hash/fnv"
@@ -43,6 +44,11 @@ const maxMmapStep = 1 << 30 // 1GB
 // The data file format version.
 const version = 2
 
+// The data file format version of files with a snapshot table. Older
+// versions would reclaim the pages of the table and of the snapshots, so
+// they refuse to open these files. Files without snapshots keep version.
+const versionSnapshots = 3
+
 // Represents a marker value to indicate that a file is a Bolt DB.
 const magic uint32 = 0xED0CDAED
 
@@ -62,6 +68,9 @@ const (
 	DefaultMaxBatchSize  int = 1000
 	DefaultMaxBatchDelay     = 10 * time.Millisecond
 	DefaultAllocSize         = 16 * 1024 * 1024
+
+	DefaultCheckpointInterval       = time.Second
+	DefaultCheckpointSize     int64 = 16 * 1024 * 1024
 )
 
 // Additional flags.
@@ -129,6 +138,14 @@ type DB struct {
 	// re-sync during recovery.
 	NoFreelistSync bool
 
+	// FreelistType sets the backend freelist type. There are two options.
+	// Array, which is simple but its allocation gets slow when the database
+	// is large and the freelist is fragmented. Hashmap, which indexes the free
+	// pages by extent and is fast in almost all circumstances, but does not
+	// guarantee that the lowest free page id is allocated first.
+	// The default type is array.
+	FreelistType FreelistType
+
 	// When true, skips the truncate call when growing the database.
 	// Setting this to true is only safe on non-ext3/ext4 systems.
 	// Skipping truncation avoids preallocation of hard drive space and
@@ -158,6 +175,10 @@ type DB struct {
 	// of truncate() and fsync() when growing the data file.
 	AllocSize int
 
+	// RadixPacking selects, how the nodes of radix trees are packed into
+	// pages on commit. Default value is copied from Options in Open.
+	RadixPacking RadixPacking
+
 	// Additional flags.
 	// dont't change this flag during operation. Otherwise read and write operations may panic.
 	db_Flags uint
@@ -173,12 +194,23 @@ type DB struct {
 	meta1    *meta
 	pageSize int
 	opened   bool
+
+	pageTrailer int      // Size of the checksum or nonce and tag at the end of each page.
+	verified    []uint32 // Pages, whose checksum was verified.
+
+	cipher    cipher.AEAD // Encrypts all pages but the meta pages, if set.
+	decrypted struct {
+		sync.Mutex
+		m map[pgid]*page
+	}
 	rwtx     *Tx
 	txs      []*Tx
 	stats    Stats
 
+	wal          *wal // Write-ahead log, if in WAL mode.
 	freelist     *freelist
 	freelistLoad sync.Once
+	snapshots    []snapshot // Snapshot table of the last commit, sorted by name.
 
 	pagePool sync.Pool
 
@@ -190,6 +222,13 @@ type DB struct {
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
 	statlock sync.RWMutex // Protects stats access.
 
+	deltalock    sync.Mutex // Protects the page write record.
+	written      []txid     // Transaction that last wrote each page, 0 if unknown.
+	writtenSince txid       // Transaction from which on written is complete.
+
+	sublock sync.Mutex      // Protects the subscriptions.
+	subs    []*Subscription // Receivers of committed changes.
+
 	ops struct {
 		writeAt func(b []byte, off int64) (n int, err error)
 	}
@@ -232,7 +271,15 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	db.NoSync = options.NoSync
 	db.NoGrowSync = options.NoGrowSync
 	db.NoFreelistSync = options.NoFreelistSync
+	db.FreelistType = options.FreelistType
 	db.db_Flags = options.DB_Flags
+	db.RadixPacking = options.RadixPacking
+	db.cipher = options.Cipher
+
+	// Encrypted pages can not be written through the mmap.
+	if db.cipher != nil && hasanyflag(db.db_Flags, DB_WriteSharedMmap|DB_WriteSeperatedMmap) {
+		return nil, ErrCipherMmap
+	}
 
 	// Set default values for later DB operations.
 	db.MaxBatchSize = DefaultMaxBatchSize
@@ -268,6 +315,13 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	// Default values for test hooks
 	db.ops.writeAt = db.file.WriteAt
 
+	// Replay the commits, that were not checkpointed before the database was
+	// closed the last time.
+	if err := db.openWAL(mode, options); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
 	if db.pageSize = options.PageSize; db.pageSize == 0 {
 		// Set the default page size to the OS page size.
 		db.pageSize = defaultPageSize
@@ -279,6 +333,11 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		return nil, err
 	} else if info.Size() == 0 {
 		// Initialize new files with meta pages.
+		if db.cipher != nil {
+			db.pageTrailer = db.cipherTrailer()
+		} else if options.PageChecksums {
+			db.pageTrailer = pageChecksumSize
+		}
 		if err := db.init(); err != nil {
 			// clean up file descriptor on initialization fail
 			_ = db.close()
@@ -319,11 +378,39 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		return nil, err
 	}
 
+	// Pages written before this point are unknown to WriteDeltaTo(), unless
+	// the record of the last Close() is still valid.
+	db.writtenSince = db.meta().txid
+	if err := db.loadWritten(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	if err := db.loadSnapshots(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
 	if db.readOnly {
 		return db, nil
 	}
 
-	db.loadFreelist()
+	// Refuse to load a corrupted freelist. This also detects a wrong key of
+	// an encrypted database, using the root page without a freelist.
+	if id := db.meta().freelist; id != pgidNoFreelist {
+		if err := db.verifyPage(id); err != nil {
+			_ = db.close()
+			return nil, verifyError(err)
+		}
+	} else if err := db.verifyPage(db.meta().root.root); err != nil {
+		_ = db.close()
+		return nil, verifyError(err)
+	}
+
+	if err := db.tryLoadFreelist(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
 
 	// Flush freelist when transitioning from no sync to sync so
 	// NoFreelistSync unaware boltdb can open the db later.
@@ -342,6 +429,10 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		db.ops.writeAt = db.writeMmapAt
 	}
 
+	if db.wal != nil {
+		go db.checkpointLoop(db.wal)
+	}
+
 	// Mark the database as opened and return.
 	return db, nil
 }
@@ -351,7 +442,7 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 // concurrent accesses being made to the freelist.
 func (db *DB) loadFreelist() {
 	db.freelistLoad.Do(func() {
-		db.freelist = newFreelist()
+		db.freelist = newFreelist(db.FreelistType)
 		if !db.hasSyncedFreelist() {
 			// Reconstruct free list by scanning the DB.
 			db.freelist.readIDs(db.freepages())
@@ -359,7 +450,8 @@ func (db *DB) loadFreelist() {
 			// Read free list from freelist page.
 			db.freelist.read(db.page(db.meta().freelist))
 		}
-		db.stats.FreePageN = len(db.freelist.ids)
+		db.pinSnapshots()
+		db.stats.FreePageN = db.freelist.free_count()
 	})
 }
 
@@ -372,7 +464,11 @@ func (db *DB) hasSyncedFreelist() bool {
 func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
+	return db.remap(minsz)
+}
 
+// remap is mmap() for callers holding the mmaplock.
+func (db *DB) remap(minsz int) error {
 	info, err := db.file.Stat()
 	if err != nil {
 		return fmt.Errorf("mmap stat error: %s", err)
@@ -393,6 +489,9 @@ func (db *DB) mmap(minsz int) error {
 	// Dereference all mmap references before unmapping.
 	if db.rwtx != nil {
 		db.rwtx.root.dereference()
+		for _, sp := range db.rwtx.savepoints {
+			sp.dereference()
+		}
 	}
 
 	// Unmap existing data before continuing.
@@ -418,6 +517,23 @@ func (db *DB) mmap(minsz int) error {
 		return err0
 	}
 
+	// The file format determines whether pages carry checksums or are
+	// encrypted.
+	switch flags := db.meta().flags; {
+	case flags&metaPageEncrypted != 0:
+		if db.cipher == nil {
+			return ErrCipherMismatch
+		}
+		db.pageTrailer = db.cipherTrailer()
+	case db.cipher != nil:
+		return ErrCipherMismatch
+	case flags&metaPageChecksums != 0:
+		db.pageTrailer = pageChecksumSize
+	default:
+		db.pageTrailer = 0
+	}
+	db.resizeVerified()
+
 	return nil
 }
 
@@ -484,6 +600,11 @@ func (db *DB) init() error {
 		m.root = bucket{root: 3}
 		m.pgid = 4
 		m.txid = txid(i)
+		if db.cipher != nil {
+			m.flags |= metaPageEncrypted
+		} else if db.pageTrailer != 0 {
+			m.flags |= metaPageChecksums
+		}
 		m.checksum = m.sum64()
 	}
 
@@ -499,6 +620,13 @@ func (db *DB) init() error {
 	p.flags = leafPageFlag
 	p.count = 0
 
+	if err := db.sealPage(db.pageInBuffer(buf[:], pgid(2))); err != nil {
+		return err
+	}
+	if err := db.sealPage(db.pageInBuffer(buf[:], pgid(3))); err != nil {
+		return err
+	}
+
 	// Write the buffer to our data file.
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
@@ -514,6 +642,11 @@ func (db *DB) init() error {
 // It will block waiting for any open transactions to finish
 // before closing the database and returning.
 func (db *DB) Close() error {
+	// The checkpointer waits for the writer lock.
+	if db.wal != nil {
+		db.wal.stopCheckpointer()
+	}
+
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
@@ -523,6 +656,13 @@ func (db *DB) Close() error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
+	// Keep the page write record for WriteDeltaTo() after reopening.
+	if db.opened && !db.readOnly {
+		if err := db.saveWritten(); err != nil {
+			log.Printf("bolt.Close(): delta record error: %s", err)
+		}
+	}
+
 	return db.close()
 }
 
@@ -535,6 +675,16 @@ func (db *DB) close() error {
 
 	db.freelist = nil
 
+	// Stop delivering changes.
+	db.closeSubscriptions()
+
+	// Fold the write-ahead log into the database file.
+	if db.wal != nil {
+		if err := db.closeWAL(); err != nil {
+			log.Printf("bolt.Close(): checkpoint error: %s", err)
+		}
+	}
+
 	// Clear ops.
 	db.ops.writeAt = nil
 
@@ -589,6 +739,12 @@ func (db *DB) Begin(writable bool) (*Tx, error) {
 }
 
 func (db *DB) beginTx() (*Tx, error) {
+	return db.beginTxAt("")
+}
+
+// beginTxAt begins a read-only transaction on the snapshot name, or on the
+// last committed transaction, if name is empty.
+func (db *DB) beginTxAt(name string) (*Tx, error) {
 	// Lock the meta pages while we initialize the transaction. We obtain
 	// the meta lock before the mmap lock because that's the order that the
 	// write transaction will obtain them.
@@ -606,9 +762,21 @@ func (db *DB) beginTx() (*Tx, error) {
 		return nil, ErrDatabaseNotOpen
 	}
 
+	var s *snapshot
+	if name != "" {
+		if s = db.snapshot(name); s == nil {
+			db.mmaplock.RUnlock()
+			db.metalock.Unlock()
+			return nil, ErrSnapshotNotFound
+		}
+	}
+
 	// Create a transaction associated with the database.
 	t := &Tx{}
 	t.init(db)
+	if s != nil {
+		s.pin(t)
+	}
 
 	// Keep track of transaction until it closes.
 	db.txs = append(db.txs, t)
@@ -648,7 +816,7 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	}
 
 	// Create a transaction associated with the database.
-	t := &Tx{writable: true}
+	t := &Tx{writable: true, capture: db.subscribed()}
 	t.init(db)
 	db.rwtx = t
 	db.freePages()
@@ -657,30 +825,33 @@ func (db *DB) beginRWTx() (*Tx, error) {
 
 // freePages releases any pages associated with closed read-only transactions.
 func (db *DB) freePages() {
+	// Snapshots pin their transaction like open read-only transactions.
+	ids := make([]txid, 0, len(db.txs)+len(db.snapshots))
+	for _, t := range db.txs {
+		ids = append(ids, t.meta.txid)
+	}
+	for _, s := range db.snapshots {
+		ids = append(ids, s.txid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
 	// Free all pending pages prior to earliest open transaction.
-	sort.Sort(txsById(db.txs))
 	minid := txid(0xFFFFFFFFFFFFFFFF)
-	if len(db.txs) > 0 {
-		minid = db.txs[0].meta.txid
+	if len(ids) > 0 {
+		minid = ids[0]
 	}
 	if minid > 0 {
 		db.freelist.release(minid - 1)
 	}
 	// Release unused txid extents.
-	for _, t := range db.txs {
-		db.freelist.releaseRange(minid, t.meta.txid-1)
-		minid = t.meta.txid + 1
+	for _, id := range ids {
+		db.freelist.releaseRange(minid, id-1)
+		minid = id + 1
 	}
 	db.freelist.releaseRange(minid, txid(0xFFFFFFFFFFFFFFFF))
 	// Any page both allocated and freed in an extent is safe to release.
 }
 
-type txsById []*Tx
-
-func (t txsById) Len() int           { return len(t) }
-func (t txsById) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t txsById) Less(i, j int) bool { return t[i].meta.txid < t[j].meta.txid }
-
 // removeTx removes a transaction from the database.
 func (db *DB) removeTx(tx *Tx) {
 	// Release the read lock on the mmap.
@@ -718,12 +889,18 @@ func (db *DB) removeTx(tx *Tx) {
 // returned from the Update() method.
 //
 // Attempting to manually commit or rollback within the function will cause a panic.
-func (db *DB) Update(fn func(*Tx) error) error {
+//
+// If a page checksum does not match, ErrChecksum is returned. If a page of an
+// encrypted database fails authentication, ErrDecrypt is returned.
+func (db *DB) Update(fn func(*Tx) error) (err error) {
 	t, err := db.Begin(true)
 	if err != nil {
 		return err
 	}
 
+	// Report corrupted pages instead of crashing.
+	defer recoverChecksum(&err)
+
 	// Make sure the transaction rolls back in the event of a panic.
 	defer func() {
 		if t.db != nil {
@@ -749,12 +926,18 @@ func (db *DB) Update(fn func(*Tx) error) error {
 // Any error that is returned from the function is returned from the View() method.
 //
 // Attempting to manually rollback within the function will cause a panic.
-func (db *DB) View(fn func(*Tx) error) error {
+//
+// If a page checksum does not match, ErrChecksum is returned. If a page of an
+// encrypted database fails authentication, ErrDecrypt is returned.
+func (db *DB) View(fn func(*Tx) error) (err error) {
 	t, err := db.Begin(false)
 	if err != nil {
 		return err
 	}
 
+	// Report corrupted pages instead of crashing.
+	defer recoverChecksum(&err)
+
 	// Make sure the transaction rolls back in the event of a panic.
 	defer func() {
 		if t.db != nil {
@@ -926,6 +1109,15 @@ func (db *DB) Info() *Info {
 
 // page retrieves a page reference from the mmap based on the current page size.
 func (db *DB) page(id pgid) *page {
+	if db.pageTrailer != 0 && id > 1 {
+		if db.cipher != nil {
+			return db.decryptedPage(id)
+		}
+		db.checkPage(id)
+	}
+	if p := db.walPage(id); p != nil {
+		return p
+	}
 	pos := id * pgid(db.pageSize)
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
@@ -1027,36 +1219,60 @@ func (db *DB) IsReadOnly() bool {
 	return db.readOnly
 }
 
+// freepages returns the pages, that are not reachable from the current meta
+// page, by reading the whole database. The pages are read through a Tx, that
+// is not registered with beginTx(): it would take the mmap lock, which the
+// callers either hold already (swapFile(), and Check() through its
+// transaction), or do not need, as Open() has not returned the database yet.
+// In each case, no writer can change the meta page or remap the file.
 func (db *DB) freepages() []pgid {
-	tx, err := db.beginTx()
-	defer func() {
-		err = tx.Rollback()
-		if err != nil {
-			panic("freepages: failed to rollback tx")
+	tx := &Tx{}
+	tx.init(db)
+	reachable := tx.reachable()
+
+	var fids []pgid
+	for i := pgid(2); i < db.meta().pgid; i++ {
+		if _, ok := reachable[i]; !ok {
+			fids = append(fids, i)
 		}
-	}()
-	if err != nil {
-		panic("freepages: failed to open read only tx")
 	}
+	return fids
+}
 
+// reachable returns the pages reachable from the root bucket and the
+// snapshot table of the transaction.
+func (tx *Tx) reachable() map[pgid]*page {
 	reachable := make(map[pgid]*page)
 	nofreed := make(map[pgid]bool)
 	ech := make(chan error)
+	done := make(chan error)
 	go func() {
+		var err error
 		for e := range ech {
-			panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", e))
+			if err == nil {
+				err = e
+			}
 		}
+		done <- err
 	}()
 	tx.checkBucket(&tx.root, reachable, nofreed, ech)
 	close(ech)
+	if err := <-done; tx.corrupted {
+		// Fail like reading the corrupted page, so the caller can recover.
+		if tx.db.cipher != nil {
+			panic(ErrDecrypt)
+		}
+		panic(ErrChecksum)
+	} else if err != nil {
+		panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", err))
+	}
 
-	var fids []pgid
-	for i := pgid(2); i < db.meta().pgid; i++ {
-		if _, ok := reachable[i]; !ok {
-			fids = append(fids, i)
+	if id := tx.meta.snapshotTable(); id != 0 {
+		for i := uint32(0); i <= tx.page(id).overflow; i++ {
+			reachable[id+pgid(i)] = tx.page(id)
 		}
 	}
-	return fids
+	return reachable
 }
 
 // Options represents the options that can be set when opening a database.
@@ -1073,6 +1289,10 @@ type Options struct {
 	// under normal operation, but requires a full database re-sync during recovery.
 	NoFreelistSync bool
 
+	// FreelistType sets the backend freelist type. The on-disk format of the
+	// freelist is the same for all types. If empty, FreelistArrayType is used.
+	FreelistType FreelistType
+
 	// Open database in read-only mode. Uses flock(..., LOCK_SH |LOCK_NB) to
 	// grab a shared lock (UNIX).
 	ReadOnly bool
@@ -1095,6 +1315,43 @@ type Options struct {
 	// is useful in APIs which expose Options but not the underlying DB.
 	NoSync bool
 
+	// RadixPacking sets the initial value of DB.RadixPacking.
+	RadixPacking RadixPacking
+
+	// PageChecksums creates new databases with a checksum at the end of every
+	// page. The checksum is verified, when a page is first read. Corrupted
+	// pages are reported by Tx.Check() and make managed transactions return
+	// ErrChecksum. Existing databases keep their format.
+	PageChecksums bool
+
+	// Cipher encrypts every page of a new database, except the meta pages.
+	// Pages are decrypted into a page cache when read. An encrypted database
+	// must always be opened with a cipher using the same key. Tampered pages
+	// or a wrong key are reported with ErrDecrypt, where corrupted pages of
+	// a database with PageChecksums are reported with ErrChecksum.
+	// PageChecksums is ignored, as the cipher authenticates each page.
+	//
+	// Cipher can not be combined with DB_WriteSharedMmap or
+	// DB_WriteSeperatedMmap, which write pages through the mmap.
+	Cipher cipher.AEAD
+
+	// WAL enables write-ahead log mode. A commit appends the pages it writes
+	// to the log file next to the database, named like the database with a
+	// "-wal" suffix, and only syncs the log. Reads find the pages in the log,
+	// until a background checkpoint writes them into the database file and
+	// truncates the log. Open replays the commits in the log, whether WAL is
+	// set or not. A database with a log, that is not empty, can not be
+	// opened read-only.
+	WAL bool
+
+	// CheckpointInterval is the time between checkpoints in WAL mode.
+	// If <=0, DefaultCheckpointInterval is used.
+	CheckpointInterval time.Duration
+
+	// CheckpointSize is the size in bytes of the log, that triggers a
+	// checkpoint in WAL mode. If <=0, DefaultCheckpointSize is used.
+	CheckpointSize int64
+
 	// Additional flags.
 	DB_Flags uint
 }
@@ -1102,8 +1359,9 @@ type Options struct {
 // DefaultOptions represent the options used if nil options are passed into Open().
 // No timeout is used which will cause Bolt to wait indefinitely for a lock.
 var DefaultOptions = &Options{
-	Timeout:    0,
-	NoGrowSync: false,
+	Timeout:      0,
+	NoGrowSync:   false,
+	FreelistType: FreelistArrayType,
 }
 
 // Stats represents statistics about the database.
@@ -1153,13 +1411,18 @@ type meta struct {
 	pgid     pgid
 	txid     txid
 	checksum uint64
+
+	// snapshots is the first page of the snapshot table, or 0. It follows
+	// the checksum, so that meta pages of version keep their layout, and is
+	// only valid in versionSnapshots.
+	snapshots pgid
 }
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
 func (m *meta) validate() error {
 	if m.magic != magic {
 		return ErrInvalid
-	} else if m.version != version {
+	} else if m.version != version && m.version != versionSnapshots {
 		return ErrVersionMismatch
 	} else if m.checksum != 0 && m.checksum != m.sum64() {
 		return ErrChecksum
@@ -1195,9 +1458,31 @@ func (m *meta) write(p *page) {
 func (m *meta) sum64() uint64 {
 	var h = fnv.New64a()
 	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	if m.version == versionSnapshots {
+		_, _ = h.Write((*[unsafe.Sizeof(m.snapshots)]byte)(unsafe.Pointer(&m.snapshots))[:])
+	}
 	return h.Sum64()
 }
 
+// snapshotTable returns the first page of the snapshot table, or 0.
+func (m *meta) snapshotTable() pgid {
+	if m.version != versionSnapshots {
+		return 0
+	}
+	return m.snapshots
+}
+
+// setSnapshotTable references the snapshot table at id, or none, if id is 0,
+// and selects the format version accordingly.
+func (m *meta) setSnapshotTable(id pgid) {
+	m.snapshots = id
+	if id == 0 {
+		m.version = version
+	} else {
+		m.version = versionSnapshots
+	}
+}
+
 // _assert will panic with a given formatted message if the given condition is false.
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
@@ -2,6 +2,9 @@ package bbolt_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"flag"
@@ -12,7 +15,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -38,8 +43,10 @@ type meta struct {
 	_        [16]byte
 	_        uint64
 	pgid     uint64
-	_        uint64
+	txid     uint64
 	checksum uint64
+
+	snapshots uint64
 }
 
 // Ensure that a database can be opened without error.
@@ -150,11 +157,11 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Rewrite meta pages.
+	// Rewrite meta pages. Version 3 is used by files with snapshots.
 	meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
-	meta0.version++
+	meta0.version = 4
 	meta1 := (*meta)(unsafe.Pointer(&buf[pageSize+pageHeaderSize]))
-	meta1.version++
+	meta1.version = 4
 	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
 		t.Fatal(err)
 	}
@@ -202,6 +209,371 @@ func TestOpen_ErrChecksum(t *testing.T) {
 	}
 }
 
+// Ensure that corrupted pages of a database with page checksums are detected.
+func TestOpen_PageChecksums(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{PageChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%08d", i))
+			if err := b.Put(k, make([]byte, 100)); err != nil {
+				return err
+			}
+			if err := r.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	(&DB{DB: db}).MustCheck()
+	psize := db.Info().PageSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The format is kept, when reopening without the option.
+	if db, err = bolt.Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	(&DB{DB: db}).MustCheck()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a data byte in every leaf and radix page.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 2 * psize; off < len(buf); off += psize {
+		if flags := *(*uint16)(unsafe.Pointer(&buf[off+8])); flags&(0x02|0x20) != 0 {
+			buf[off+pageHeaderSize+20] ^= 0xff
+		}
+	}
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = bolt.Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Reading returns an error instead of crashing.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			b.Get([]byte("00000500"))
+		}
+		return nil
+	}); err != bolt.ErrChecksum {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if r := tx.RadixBucket([]byte("radix")); r != nil {
+			r.Get([]byte("00000500"))
+		}
+		return nil
+	}); err != bolt.ErrChecksum {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Check reports the corrupted pages.
+	var n int
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			if !strings.Contains(err.Error(), "checksum error") {
+				t.Errorf("unexpected error: %s", err)
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("expected checksum errors")
+	}
+}
+
+// Ensure that corrupted pages are reported outside of managed transactions.
+func TestOpen_PageChecksums_Begin(t *testing.T) {
+	for _, noFreelistSync := range []bool{false, true} {
+		path := tempfile()
+		defer os.Remove(path)
+
+		opts := &bolt.Options{PageChecksums: true, NoFreelistSync: noFreelistSync}
+		db, err := bolt.Open(path, 0666, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		psize := db.Info().PageSize
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a data byte in every leaf page of the bucket. The leaf of the
+		// root bucket only holds the bucket.
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 2 * psize; off < len(buf); off += psize {
+			flags := *(*uint16)(unsafe.Pointer(&buf[off+8]))
+			count := *(*uint16)(unsafe.Pointer(&buf[off+10]))
+			if flags&0x02 != 0 && count > 1 {
+				buf[off+pageHeaderSize+20] ^= 0xff
+			}
+		}
+		if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		// Without a synced freelist, every page is read when opening.
+		db, err = bolt.Open(path, 0666, opts)
+		if noFreelistSync {
+			if err != bolt.ErrChecksum {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		// Methods without an error result return nil, the transaction keeps
+		// the error.
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		} else if err := tx.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v := b.Get([]byte("00000000")); v != nil {
+			t.Fatalf("unexpected value: %x", v)
+		} else if err := tx.Err(); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c := b.Cursor()
+		if k, _ := c.First(); k != nil {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		var n int
+		for err := range tx.Check() {
+			if !strings.Contains(err.Error(), "checksum error") {
+				t.Errorf("unexpected error: %s", err)
+			}
+			n++
+		}
+		if n == 0 {
+			t.Fatal("expected checksum errors")
+		}
+		if err := tx.Rollback(); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			tx.Bucket([]byte("widgets")).Cursor().Last()
+			return nil
+		}); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Methods of Tx with an error result return it.
+		tx, err = db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("00000000"), []byte("x")); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tx.Commit(); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := db.Compact(context.Background()); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Shrink(); err != bolt.ErrChecksum {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that the pages of a database with a cipher are encrypted.
+func TestOpen_Cipher(t *testing.T) {
+	newCipher := func(key byte) cipher.AEAD {
+		block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aead
+	}
+	path := tempfile()
+	defer os.Remove(path)
+
+	if _, err := bolt.Open(path, 0666, &bolt.Options{Cipher: newCipher(1), DB_Flags: bolt.DB_WriteSharedMmap}); err != bolt.ErrCipherMmap {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{Cipher: newCipher(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("secret-%08d", i))
+			if err := b.Put(k, k); err != nil {
+				return err
+			}
+			if err := r.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte("secret-")) {
+		t.Fatal("plain text found in encrypted database")
+	}
+
+	// The database can only be opened with the right key.
+	if _, err := bolt.Open(path, 0666, nil); err != bolt.ErrCipherMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bolt.Open(path, 0666, &bolt.Options{Cipher: newCipher(2)}); err != bolt.ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db, err = bolt.Open(path, 0666, &bolt.Options{Cipher: newCipher(1)}); err != nil {
+		t.Fatal(err)
+	}
+	(&DB{DB: db}).MustCheck()
+	if err := db.View(func(tx *bolt.Tx) error {
+		k := []byte("secret-00000500")
+		if v := tx.Bucket([]byte("widgets")).Get(k); !bytes.Equal(v, k) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := tx.RadixBucket([]byte("radix")).Get(k); !bytes.Equal(v, k) {
+			t.Fatalf("unexpected radix value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	psize := db.Info().PageSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database in plain text can not be opened with a cipher.
+	plain := tempfile()
+	defer os.Remove(plain)
+	if db, err := bolt.Open(plain, 0666, nil); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bolt.Open(plain, 0666, &bolt.Options{Cipher: newCipher(1)}); err != bolt.ErrCipherMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Tampered pages are detected.
+	for off := 2 * psize; off < len(buf); off += psize {
+		if flags := *(*uint16)(unsafe.Pointer(&buf[off+8])); flags&0x02 != 0 {
+			buf[off+pageHeaderSize+20] ^= 0xff
+		}
+	}
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = bolt.Open(path, 0666, &bolt.Options{Cipher: newCipher(1)}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			b.Get([]byte("secret-00000500"))
+		}
+		return nil
+	}); err != bolt.ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Outside of managed transactions, reads return nil and the transaction
+	// keeps the error.
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := tx.Bucket([]byte("widgets")); b != nil {
+		t.Fatal("unexpected bucket")
+	} else if err := tx.Err(); err != bolt.ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != bolt.ErrDecrypt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // Ensure that opening a database does not increase its size.
 // https://github.com/boltdb/bolt/issues/291
 func TestOpen_Size(t *testing.T) {
@@ -586,6 +958,64 @@ func TestOpen_RecoverFreeList(t *testing.T) {
 	}
 }
 
+// Ensure that the freelist types share the on-disk format.
+func TestOpen_FreelistType(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{FreelistType: bolt.FreelistMapType})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 500)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i += 2 {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Release the pending pages.
+	if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	freepages := db.Stats().FreePageN
+	if freepages == 0 {
+		t.Fatal("no free pages")
+	}
+
+	for _, typ := range []bolt.FreelistType{bolt.FreelistArrayType, bolt.FreelistMapType} {
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db.o = &bolt.Options{FreelistType: typ}
+		db.MustReopen()
+		if fp := db.Stats().FreePageN; fp < freepages {
+			t.Fatalf("%s: closed with %d free pages, opened with %d", typ, freepages, fp)
+		}
+		db.MustCheck()
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("key"), make([]byte, 2000))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		freepages = db.Stats().FreePageN
+	}
+}
+
 // Ensure that a database cannot open a transaction when it's not open.
 func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
 	var db bolt.DB
@@ -1275,8 +1705,1152 @@ func TestDB_BatchTime(t *testing.T) {
 	}
 }
 
-func ExampleDB_Update() {
-	// Open the database.
+// Ensure that optimistic transactions commit independent writes and report
+// conflicting reads.
+func TestDB_BeginOptimistic(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("counter"), []byte("0"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both read the counter, a also writes a disjoint key.
+	if v := a.Bucket([]byte("widgets")).Get([]byte("counter")); string(v) != "0" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if v := b.Bucket([]byte("widgets")).Get([]byte("counter")); string(v) != "0" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if err := a.Bucket([]byte("widgets")).Put([]byte("counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Bucket([]byte("widgets")).Put([]byte("counter"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes are visible within the transaction only.
+	if v := a.Bucket([]byte("widgets")).Get([]byte("counter")); string(v) != "1" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+
+	// The first commit wins, the second one read a stale counter.
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != bolt.ErrConflict {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Commit(); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Blind writes and writes to unrelated keys do not conflict.
+	c, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Bucket([]byte("widgets")).Get([]byte("other")); v != nil {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	cb := c.Bucket([]byte("widgets"))
+	if err := cb.Put([]byte("other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Delete(nil); err != bolt.ErrKeyRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("counter"), []byte("3"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Delete([]byte("other")); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("counter")); string(v) != "3" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("other")); string(v) != "x" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that concurrent optimistic increments are serializable.
+func TestDB_BeginOptimistic_Concurrent(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n, m = 8, 20
+	var wg sync.WaitGroup
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < m; {
+				otx, err := db.BeginOptimistic()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				b := otx.Bucket([]byte("widgets"))
+				var v uint64
+				if buf := b.Get([]byte("counter")); buf != nil {
+					v = binary.BigEndian.Uint64(buf)
+				}
+				if err := b.Put([]byte("counter"), u64tob(v+1)); err != nil {
+					errCh <- err
+					return
+				}
+				switch err := otx.Commit(); err {
+				case nil:
+					j++
+				case bolt.ErrConflict:
+				default:
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		v := binary.BigEndian.Uint64(tx.Bucket([]byte("widgets")).Get([]byte("counter")))
+		if v != n*m {
+			t.Fatalf("unexpected counter: %d", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changeString formats a change for comparison.
+func changeString(c bolt.Change) string {
+	var path []string
+	for _, name := range c.Bucket {
+		path = append(path, string(name))
+	}
+	old, new := "-", "-"
+	if c.Old != nil {
+		old = string(c.Old)
+	}
+	if c.New != nil {
+		new = string(c.New)
+	}
+	return fmt.Sprintf("%s/%s:%s>%s", strings.Join(path, "/"), c.Key, old, new)
+}
+
+// nextChanges receives the next ChangeSet of a subscription.
+func nextChanges(t *testing.T, s *bolt.Subscription) (int, []string) {
+	select {
+	case cs, ok := <-s.Changes():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		var changes []string
+		for _, c := range cs.Changes {
+			changes = append(changes, changeString(c))
+		}
+		return cs.Txid, changes
+	case <-time.After(5 * time.Second):
+		t.Fatal("no changes delivered")
+	}
+	return 0, nil
+}
+
+// Ensure that subscribers receive the changes of committed transactions.
+func TestDB_Subscribe(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	all := db.Subscribe(nil)
+	defer all.Close()
+	widgets := db.Subscribe(func(bucket [][]byte, key []byte) bool {
+		return len(bucket) == 1 && string(bucket[0]) == "widgets"
+	})
+	defer widgets.Close()
+
+	var id int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("1")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("2")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("bar"), []byte("3")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("bar")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("missing")); err != nil {
+			return err
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		if err := sub.Put([]byte("baz"), []byte("4")); err != nil {
+			return err
+		}
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		if err := r.Put([]byte("qux"), []byte("5")); err != nil {
+			return err
+		}
+		return r.Accept([]byte("qux"), &radixTestVisitor{op: bolt.VisitOpSET([]byte("6"))}, true)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rolled back transaction is not delivered.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("x")); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		c.First()
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		return tx.DeleteRadixBucket([]byte("radix"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txid, changes := nextChanges(t, all)
+	if txid != id {
+		t.Fatalf("unexpected txid: %d", txid)
+	}
+	exp := []string{
+		"widgets/foo:->1",
+		"widgets/foo:1>2",
+		"widgets/bar:->3",
+		"widgets/bar:3>-",
+		"widgets/sub/baz:->4",
+		"radix/qux:->5",
+		"radix/qux:5>6",
+	}
+	if !reflect.DeepEqual(changes, exp) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	txid, changes = nextChanges(t, all)
+	if txid != id+1 {
+		t.Fatalf("unexpected txid: %d", txid)
+	}
+	if exp := []string{"widgets/foo:2>-", "radix/qux:6>-"}; !reflect.DeepEqual(changes, exp) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// The filtered subscription only sees the top-level widgets.
+	if _, changes := nextChanges(t, widgets); len(changes) != 4 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if _, changes := nextChanges(t, widgets); !reflect.DeepEqual(changes, []string{"widgets/foo:2>-"}) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// Deleting a bucket reports its keys as deleted.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, changes := nextChanges(t, all); !reflect.DeepEqual(changes, []string{"widgets/sub/baz:4>-"}) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// Closing the subscription closes the channel.
+	all.Close()
+	if _, ok := <-all.Changes(); ok {
+		t.Fatal("expected closed channel")
+	}
+}
+
+func TestDB_Compact(t *testing.T)           { testDB_Compact(t, nil) }
+func TestDB_Compact_Checksums(t *testing.T) { testDB_Compact(t, &bolt.Options{PageChecksums: true}) }
+
+func TestDB_Compact_Cipher(t *testing.T) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB_Compact(t, &bolt.Options{Cipher: aead})
+}
+
+// compactSetup fills a database with buckets, inline buckets and radix trees
+// and frees most of its pages.
+func compactSetup(db *DB) error {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20000; i++ {
+			if err := b.Put(u64tob(uint64(i)), bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+				return err
+			}
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		if err := sub.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		c, err := tx.CreateBucketWithCodec([]byte("compressed"), "flate")
+		if err != nil {
+			return err
+		}
+		if err := c.Put([]byte("foo"), bytes.Repeat([]byte("x"), 1000)); err != nil {
+			return err
+		}
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := r.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		if err := r.SetSequence(7); err != nil {
+			return err
+		}
+		nested, err := r.CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		if err := nested.Put([]byte("baz"), []byte("3")); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	}); err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 20000; i++ {
+			if i%10 == 0 {
+				continue
+			}
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// compactWrite is the i-th transaction of the writer running during
+// DB.Compact().
+func compactWrite(tx *bolt.Tx, i int) error {
+	if err := tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("live%05d", i)), []byte(fmt.Sprint(i))); err != nil {
+		return err
+	}
+	r := tx.RadixBucket([]byte("radix"))
+	if err := r.Delete([]byte(fmt.Sprintf("key%d", i))); err != nil {
+		return err
+	}
+	switch i % 6 {
+	case 0:
+		b, err := tx.CreateBucket([]byte(fmt.Sprintf("b%d", i)))
+		if err != nil {
+			return err
+		}
+		if _, err := b.NextSequence(); err != nil {
+			return err
+		}
+		_, err = b.CreateBucket([]byte("child"))
+		return err
+	case 1:
+		if i > 6 {
+			return tx.DeleteBucket([]byte(fmt.Sprintf("b%d", i-7)))
+		}
+	case 2:
+		nested, err := r.CreateRadixBucket([]byte(fmt.Sprintf("r%d", i)))
+		if err != nil {
+			return err
+		}
+		return nested.Put([]byte("foo"), []byte("bar"))
+	case 3:
+		c, err := tx.CreateBucketWithCodec([]byte(fmt.Sprintf("c%d", i)), "flate")
+		if err != nil {
+			return err
+		}
+		return c.Put([]byte("foo"), []byte("bar"))
+	case 4:
+		v, err := tx.CreateBucket([]byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			return err
+		}
+		if err := v.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		_, err = tx.ConvertToRadix([]byte(fmt.Sprintf("v%d", i)))
+		return err
+	}
+	return nil
+}
+
+// dumpDB lists all buckets, radix trees and values of the database.
+func dumpDB(t *testing.T, db *DB) []string {
+	var out []string
+	if err := db.View(func(tx *bolt.Tx) error {
+		out = dumpTx(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// dumpTx returns the contents of all buckets and radix trees seen by tx.
+func dumpTx(tx *bolt.Tx) []string {
+	var out []string
+	var dumpBucket func(path string, b *bolt.Bucket)
+	var dumpRadix func(path string, r *bolt.RadixBucket)
+	dumpBucket = func(path string, b *bolt.Bucket) {
+		out = append(out, fmt.Sprintf("%s seq=%d codec=%s", path, b.Sequence(), b.Codec()))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil {
+				out = append(out, fmt.Sprintf("%s/%x=%x", path, k, v))
+			} else if child := b.Bucket(k); child != nil {
+				dumpBucket(path+"/"+string(k), child)
+			} else {
+				dumpRadix(path+"/"+string(k), b.RadixBucket(k))
+			}
+		}
+	}
+	dumpRadix = func(path string, r *bolt.RadixBucket) {
+		out = append(out, fmt.Sprintf("%s radix seq=%d", path, r.Sequence()))
+		it := r.Iterator()
+		for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+			if v != nil {
+				out = append(out, fmt.Sprintf("%s/%x=%x", path, k, v))
+			} else if child := r.Bucket(k); child != nil {
+				dumpBucket(path+"/"+string(k), child)
+			} else {
+				dumpRadix(path+"/"+string(k), r.RadixBucket(k))
+			}
+		}
+	}
+	c := tx.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if b := tx.Bucket(k); b != nil {
+			dumpBucket(string(k), b)
+		} else {
+			dumpRadix(string(k), tx.RadixBucket(k))
+		}
+	}
+	return out
+}
+
+func testDB_Compact(t *testing.T, o *bolt.Options) {
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+	ref := MustOpenWithOption(o)
+	defer ref.MustClose()
+
+	if err := compactSetup(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactSetup(ref); err != nil {
+		t.Fatal(err)
+	}
+	size := fileSize(db.Path())
+
+	// A cancelled compaction leaves the database unchanged.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Compact(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(db.Path() + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Transactions committed during the copy are replayed.
+	var n int
+	stop, done := make(chan struct{}), make(chan error)
+	go func() {
+		for ; ; n++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if err := db.Update(func(tx *bolt.Tx) error { return compactWrite(tx, n) }); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	var id int
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := ref.Update(func(tx *bolt.Tx) error { return compactWrite(tx, i) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := dumpDB(t, ref)
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected contents after %d writes: %d records, expected %d", n, len(got), len(exp))
+	}
+	if sz := fileSize(db.Path()); sz >= size {
+		t.Fatalf("unexpected file size: %d, was %d", sz, size)
+	}
+	if _, err := os.Stat(db.Path() + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Transaction ids continue and the database remains writable.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if tx.ID() != id+1 {
+			t.Fatalf("unexpected txid: %d, expected %d", tx.ID(), id+1)
+		}
+		return compactWrite(tx, n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ref.Update(func(tx *bolt.Tx) error { return compactWrite(tx, n) }); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, dumpDB(t, ref)) {
+		t.Fatal("unexpected contents after reopening")
+	}
+}
+
+func TestDB_Shrink(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// Free the pages at the front of the file, while the data written last
+	// remains at the end.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"front", "back"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 20000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.Bucket([]byte("back")).CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5000; i++ {
+			if err := r.Put([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte{'x'}, 200)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("front"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp := dumpDB(t, db)
+	size := fileSize(db.Path())
+
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if sz := fileSize(db.Path()); sz >= size {
+		t.Fatalf("unexpected file size: %d, was %d", sz, size)
+	}
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, exp) {
+		t.Fatal("unexpected contents")
+	}
+	db.MustCheck()
+
+	// Nothing is left to shrink.
+	size = fileSize(db.Path())
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if sz := fileSize(db.Path()); sz != size {
+		t.Fatalf("unexpected file size: %d, was %d", sz, size)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, exp) {
+		t.Fatal("unexpected contents after reopening")
+	}
+}
+
+// Ensure that Shrink only moves pages into free pages, that can be allocated
+// right away, while pages freed earlier are still pending for a reader.
+func TestDB_Shrink_Pending(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// The buckets are written one after the other, so the pending pages lie
+	// in front of the free ones.
+	for _, bucket := range []struct {
+		name string
+		n    int
+	}{{"pending", 2000}, {"front", 20000}, {"back", 20000}} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(bucket.name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < bucket.n; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"front", "pending"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket([]byte(name))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The pages of the last deleted bucket stay pending, while the reader is
+	// open. The pages of the first one are free.
+	reader, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := dumpDB(t, db)
+	size := fileSize(db.Path())
+	var high int
+	if err := db.View(func(tx *bolt.Tx) error {
+		high = int(tx.Size())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrink waits for the reader, before it truncates the file.
+	done := make(chan error)
+	go func() { done <- db.Shrink() }()
+	time.Sleep(100 * time.Millisecond)
+	if err := reader.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if int(tx.Size()) > high {
+			t.Fatalf("database grew: %d, was %d", tx.Size(), high)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sz := fileSize(db.Path()); sz >= size {
+		t.Fatalf("unexpected file size: %d, was %d", sz, size)
+	}
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, exp) {
+		t.Fatal("unexpected contents")
+	}
+}
+
+// Ensure that snapshots keep their contents while the database changes and
+// is reopened, until they are dropped.
+func TestDB_Snapshot(t *testing.T) {
+	testDB_Snapshot(t, nil)
+}
+
+func TestDB_Snapshot_NoFreelistSync(t *testing.T) {
+	testDB_Snapshot(t, &bolt.Options{NoFreelistSync: true})
+}
+
+func TestDB_Snapshot_Cipher(t *testing.T) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB_Snapshot(t, &bolt.Options{Cipher: aead})
+}
+
+func testDB_Snapshot(t *testing.T, o *bolt.Options) {
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+
+	if err := compactSetup(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	expA := dumpDB(t, db)
+
+	n := 0
+	churn := func() {
+		for end := n + 50; n < end; n++ {
+			if err := db.Update(func(tx *bolt.Tx) error { return compactWrite(tx, n) }); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func(name string, exp []string) {
+		tx, err := db.OpenSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = tx.Rollback() }()
+		if got := dumpTx(tx); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected contents of snapshot %q", name)
+		}
+	}
+
+	churn()
+	if err := db.Snapshot("b"); err != nil {
+		t.Fatal(err)
+	}
+	expB := dumpDB(t, db)
+	churn()
+	verify("a", expA)
+	verify("b", expB)
+	db.MustCheck()
+
+	// The pinned pages are recovered from the snapshots when reopening.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if names := db.Snapshots(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("unexpected snapshots: %v", names)
+	}
+	churn()
+	verify("a", expA)
+	verify("b", expB)
+	db.MustCheck()
+
+	if err := db.Snapshot("a"); err != bolt.ErrSnapshotExists {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := db.Snapshot(""); err != bolt.ErrSnapshotNameRequired {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := db.OpenSnapshot("c"); err != bolt.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := db.Compact(context.Background()); err != bolt.ErrSnapshotsExist {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A copy of a snapshot is a database of its own.
+	tx, err := db.OpenSnapshot("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := tempfile()
+	defer os.Remove(path)
+	if err := tx.CopyFile(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	cp := &DB{f: path, o: o}
+	cp.MustReopen()
+	if got := dumpDB(t, cp); !reflect.DeepEqual(got, expA) {
+		t.Fatal("unexpected contents of the copy")
+	}
+	if names := cp.Snapshots(); len(names) != 0 {
+		t.Fatalf("unexpected snapshots in the copy: %v", names)
+	}
+	cp.MustCheck()
+	if err := cp.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropped snapshots release their pages, the others keep theirs.
+	if err := db.DropSnapshot("a"); err != nil {
+		t.Fatal(err)
+	} else if err := db.DropSnapshot("a"); err != bolt.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	churn()
+	verify("b", expB)
+	db.MustCheck()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	verify("b", expB)
+	if err := db.DropSnapshot("b"); err != nil {
+		t.Fatal(err)
+	}
+	if names := db.Snapshots(); len(names) != 0 {
+		t.Fatalf("unexpected snapshots: %v", names)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that the snapshot table is referenced by a meta page of its own
+// format version, which is only used while there are snapshots, and not by
+// the root bucket.
+func TestDB_Snapshot_Meta(t *testing.T) {
+	if pageSize != os.Getpagesize() {
+		t.Skip("page size mismatch")
+	}
+
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// lastMeta returns the meta page of the last transaction in the file.
+	lastMeta := func() meta {
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.MustReopen()
+		buf, err := ioutil.ReadFile(db.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
+		meta1 := (*meta)(unsafe.Pointer(&buf[pageSize+pageHeaderSize]))
+		if meta1.txid > meta0.txid {
+			return *meta1
+		}
+		return *meta0
+	}
+
+	if err := db.Snapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m := lastMeta(); m.version != 3 || m.snapshots == 0 {
+		t.Fatalf("unexpected meta: version %d, snapshot table %d", m.version, m.snapshots)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if seq := tx.Cursor().Bucket().Sequence(); seq != 0 {
+			t.Fatalf("unexpected root sequence: %d", seq)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.DropSnapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m := lastMeta(); m.version != 2 || m.snapshots != 0 {
+		t.Fatalf("unexpected meta: version %d, snapshot table %d", m.version, m.snapshots)
+	}
+	db.MustCheck()
+}
+
+// Ensure that commits in WAL mode are only logged, that reads find the
+// logged pages, and that a checkpoint writes them into the database file and
+// truncates the log.
+func TestDB_WAL(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WAL: true, CheckpointInterval: time.Hour})
+	defer db.MustClose()
+	if err := compactSetup(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	logPath := db.Path() + "-wal"
+
+	before := dumpDB(t, db)
+	data, err := ioutil.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return compactWrite(tx, i)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fileSize(logPath) == 0 {
+		t.Fatal("expected commits in the log")
+	}
+
+	// The commits did not write to the database file, but are visible.
+	buf, err := ioutil.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buf) < len(data) || !bytes.Equal(buf[:len(data)], data) {
+		t.Fatal("expected the database file to be unchanged before the checkpoint")
+	}
+	want := dumpDB(t, db)
+	if reflect.DeepEqual(want, before) {
+		t.Fatal("expected the commits to be visible")
+	}
+	db.MustCheck()
+
+	// A copy reads the pages from the log.
+	path := tempfile()
+	defer os.Remove(path)
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpDB(t, &DB{DB: cdb}); !reflect.DeepEqual(got, want) {
+		t.Fatal("unexpected contents of the copy")
+	}
+	if err := cdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if sz := fileSize(logPath); sz != 0 {
+		t.Fatalf("unexpected log size after checkpoint: %d", sz)
+	}
+	if buf, err := ioutil.ReadFile(db.Path()); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(buf[:len(data)], data) {
+		t.Fatal("expected the checkpoint to write the database file")
+	}
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, want) {
+		t.Fatal("unexpected contents after checkpoint")
+	}
+
+	// Compaction replaces the file, which the log refers to.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return compactWrite(tx, 10)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return compactWrite(tx, 11)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want = dumpDB(t, db)
+
+	// Closing the database takes a checkpoint and removes the log.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Fatalf("expected log to be removed: %v", err)
+	}
+	db.MustReopen()
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, want) {
+		t.Fatal("unexpected contents after reopen")
+	}
+}
+
+// Ensure that Open replays the commits in the log, that did not reach the
+// database file, and ignores a torn record at its end.
+func TestDB_WAL_Recovery(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WAL: true, CheckpointInterval: time.Hour})
+	defer db.MustClose()
+	if err := compactSetup(db); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(i int) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return compactWrite(tx, i)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(0)
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the state of the last checkpoint is in the database file.
+	data, err := ioutil.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 5; i++ {
+		update(i)
+	}
+	var wants [][]string
+	var logs [][]byte
+	for i := 5; i < 7; i++ {
+		wants = append(wants, dumpDB(t, db))
+		update(i)
+		buf, err := ioutil.ReadFile(db.Path() + "-wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, buf)
+	}
+
+	for i, buf := range logs {
+		path := tempfile()
+		defer os.Remove(path)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// The record of the last commit is torn.
+		if err := ioutil.WriteFile(path+"-wal", buf[:len(buf)-10], 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// A log, that is not replayed, can not be opened read-only.
+		if _, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true}); err != bolt.ErrWALNotReplayed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The log is replayed without WAL mode, and removed.
+		rdb, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+			t.Fatalf("expected log to be removed: %v", err)
+		}
+		if got := dumpDB(t, &DB{DB: rdb}); !reflect.DeepEqual(got, wants[i]) {
+			t.Fatalf("unexpected contents after recovery %d", i)
+		}
+		(&DB{DB: rdb}).MustCheck()
+		if err := rdb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a checkpoint is taken, once the log grows beyond its limit.
+func TestDB_WAL_Size(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WAL: true, CheckpointInterval: time.Hour, CheckpointSize: 1})
+	defer db.MustClose()
+	if err := compactSetup(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return compactWrite(tx, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; fileSize(db.Path()+"-wal") != 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the log to be truncated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func ExampleDB_Update() {
+	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -1605,6 +3179,15 @@ func MustOpenDB() *DB {
 // MustOpenDBWithOption returns a new, open DB at a temporary location with given options.
 func MustOpenWithOption(o *bolt.Options) *DB {
 	f := tempfile()
+	if env := os.Getenv("TEST_FREELIST_TYPE"); env != "" {
+		if o == nil {
+			o = &bolt.Options{}
+		} else {
+			copied := *o
+			o = &copied
+		}
+		o.FreelistType = bolt.FreelistType(env)
+	}
 	db, err := bolt.Open(f, 0666, o)
 	if err != nil {
 		panic(err)
@@ -1628,6 +3211,7 @@ func (db *DB) Close() error {
 
 	// Close database and remove file.
 	defer os.Remove(db.Path())
+	defer os.Remove(db.Path() + "-delta")
 	return db.DB.Close()
 }
 
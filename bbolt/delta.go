@@ -0,0 +1,363 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"unsafe"
+)
+
+// deltaMagic identifies a delta stream written by Tx.WriteDeltaTo().
+const deltaMagic uint32 = 0xDE17ABB0
+
+// deltaVersion is the version of the delta stream format.
+const deltaVersion uint32 = 1
+
+// deltaHeader starts every delta stream. It is followed by a sequence of
+// deltaRuns, each followed by count pages of data, a terminating run with a
+// zero count and finally the meta page of the transaction.
+type deltaHeader struct {
+	Magic    uint32
+	Version  uint32
+	PageSize uint32
+	_        uint32
+	Since    uint64 // Base transaction of the delta.
+	Txid     uint64 // Transaction the delta brings the database to.
+	Pgid     uint64 // High water mark of the transaction.
+}
+
+// deltaRun describes count consecutive pages starting at id.
+type deltaRun struct {
+	ID    uint64
+	Count uint64
+}
+
+// deltaSuffix is appended to the path of the database to get the path of the
+// page write record, that Close() saves for the next Open().
+const deltaSuffix = "-delta"
+
+// writtenMagic identifies a saved page write record.
+const writtenMagic uint32 = 0xDE17A5ED
+
+// writtenHeader starts a saved page write record. It is followed by Count
+// txids, one per page, and the FNV-64a checksum of the header and the txids.
+type writtenHeader struct {
+	Magic   uint32
+	Version uint32
+	Txid    uint64 // Transaction of the database, when the record was saved.
+	Since   uint64 // Transaction from which on the record is complete.
+	Count   uint64
+}
+
+// saveWritten saves the page write record, so that WriteDeltaTo() can still
+// write deltas after the database was reopened.
+func (db *DB) saveWritten() error {
+	db.deltalock.Lock()
+	defer db.deltalock.Unlock()
+
+	var buf bytes.Buffer
+	hdr := writtenHeader{
+		Magic:   writtenMagic,
+		Version: deltaVersion,
+		Txid:    uint64(db.meta().txid),
+		Since:   uint64(db.writtenSince),
+		Count:   uint64(len(db.written)),
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, &hdr)
+	_ = binary.Write(&buf, binary.LittleEndian, db.written)
+	h := fnv.New64a()
+	_, _ = h.Write(buf.Bytes())
+	_ = binary.Write(&buf, binary.LittleEndian, h.Sum64())
+	return ioutil.WriteFile(db.path+deltaSuffix, buf.Bytes(), 0600)
+}
+
+// loadWritten restores the page write record saved by Close(), if the
+// database was not changed since. The record is removed, when the database is
+// opened for writing, as it is only valid until the next commit. A missing or
+// damaged record only causes the next delta to contain every page.
+func (db *DB) loadWritten() error {
+	path := db.path + deltaSuffix
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	} else if !db.readOnly {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	var hdr writtenHeader
+	size := int(unsafe.Sizeof(hdr))
+	if len(data) < size+8 {
+		return nil
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data[:len(data)-8])
+	if h.Sum64() != binary.LittleEndian.Uint64(data[len(data)-8:]) {
+		return nil
+	}
+	_ = binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr)
+	if hdr.Magic != writtenMagic || hdr.Version != deltaVersion || txid(hdr.Txid) != db.meta().txid {
+		return nil
+	} else if uint64(len(data)-size-8) != hdr.Count*8 {
+		return nil
+	}
+	written := make([]txid, hdr.Count)
+	_ = binary.Read(bytes.NewReader(data[size:]), binary.LittleEndian, written)
+
+	db.deltalock.Lock()
+	db.written, db.writtenSince = written, txid(hdr.Since)
+	db.deltalock.Unlock()
+	return nil
+}
+
+// recordWritten remembers that the given pages were written by transaction id.
+func (db *DB) recordWritten(pages pages, id txid) {
+	db.deltalock.Lock()
+	defer db.deltalock.Unlock()
+
+	for _, p := range pages {
+		end := int(p.id) + int(p.overflow) + 1
+		if end > cap(db.written) {
+			n := make([]txid, end, 2*end)
+			copy(n, db.written)
+			db.written = n
+		} else if end > len(db.written) {
+			db.written = db.written[:end]
+		}
+		for i := int(p.id); i < end; i++ {
+			db.written[i] = id
+		}
+	}
+}
+
+// changedRuns returns the runs of pages below high, that may have been
+// written after the transaction since.
+func (db *DB) changedRuns(since txid, high pgid) []deltaRun {
+	db.deltalock.Lock()
+	defer db.deltalock.Unlock()
+
+	// Pages written before the database was opened are unknown. They have to
+	// be included, unless the base is at least as recent as the open.
+	unknown := since < db.writtenSince
+
+	var runs []deltaRun
+	for id := pgid(2); id < high; id++ {
+		var changed bool
+		if int(id) < len(db.written) && db.written[id] != 0 {
+			changed = db.written[id] > since
+		} else {
+			changed = unknown
+		}
+		if !changed {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].ID+runs[n-1].Count == uint64(id) {
+			runs[n-1].Count++
+		} else {
+			runs = append(runs, deltaRun{ID: uint64(id), Count: 1})
+		}
+	}
+	return runs
+}
+
+// WriteDeltaTo writes the pages changed since the transaction sinceTxid to a
+// writer. Applying the delta with ApplyDelta() to a copy of the database made
+// at any transaction between sinceTxid and this one turns it into a copy of
+// this transaction.
+//
+// Pages are tracked in memory from the moment the database is opened. Close()
+// saves the record next to the database file, and Open() restores it, unless
+// the database was changed in between. If the database was not closed, or
+// sinceTxid lies before the record starts, every page of the database is
+// written, which FullDelta() reports in advance.
+func (tx *Tx) WriteDeltaTo(w io.Writer, sinceTxid int) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if sinceTxid < 0 || txid(sinceTxid) > tx.meta.txid {
+		return 0, fmt.Errorf("since txid %d out of range", sinceTxid)
+	}
+
+	// Attempt to open reader with WriteFlag
+	f, err := os.OpenFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	hdr := deltaHeader{
+		Magic:    deltaMagic,
+		Version:  deltaVersion,
+		PageSize: uint32(tx.db.pageSize),
+		Since:    uint64(sinceTxid),
+		Txid:     uint64(tx.meta.txid),
+		Pgid:     uint64(tx.meta.pgid),
+	}
+	cw := &countWriter{w: w}
+	if err := binary.Write(cw, binary.LittleEndian, &hdr); err != nil {
+		return cw.n, fmt.Errorf("delta header: %s", err)
+	}
+
+	// Copy changed pages. Pages reachable from this transaction are not
+	// reused while it is open, so reading them from the file is safe.
+	r := tx.db.fileReader(f)
+	for _, run := range tx.db.changedRuns(txid(sinceTxid), tx.meta.pgid) {
+		if err := binary.Write(cw, binary.LittleEndian, &run); err != nil {
+			return cw.n, err
+		}
+		off := int64(run.ID) * int64(tx.db.pageSize)
+		if _, err := io.Copy(cw, io.NewSectionReader(r, off, int64(run.Count)*int64(tx.db.pageSize))); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := binary.Write(cw, binary.LittleEndian, &deltaRun{}); err != nil {
+		return cw.n, err
+	}
+
+	// Generate the meta page.
+	buf := make([]byte, tx.db.pageSize)
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = metaPageFlag
+	*page.meta() = *tx.meta
+	page.meta().checksum = page.meta().sum64()
+	if _, err := cw.Write(buf); err != nil {
+		return cw.n, fmt.Errorf("meta copy: %s", err)
+	}
+
+	return cw.n, nil
+}
+
+// FullDelta reports whether WriteDeltaTo() has to write every page of the
+// database for sinceTxid, because the pages written since are not known.
+func (tx *Tx) FullDelta(sinceTxid int) bool {
+	tx.db.deltalock.Lock()
+	defer tx.db.deltalock.Unlock()
+	return txid(sinceTxid) < tx.db.writtenSince
+}
+
+// ApplyDelta applies a delta written by Tx.WriteDeltaTo() to the database
+// file at path. The database must not be open. Its most recent transaction
+// must lie between the base of the delta and the transaction of the delta.
+//
+// Pages are written in place, so an interrupted ApplyDelta leaves the file
+// inconsistent. Apply deltas to a backup, not to the only copy.
+func ApplyDelta(path string, r io.Reader) error {
+	var hdr deltaHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return ErrDeltaInvalid
+	} else if hdr.Magic != deltaMagic || hdr.Version != deltaVersion {
+		return ErrDeltaInvalid
+	} else if hdr.PageSize < 1024 || hdr.PageSize > maxAllocSize {
+		return ErrDeltaInvalid
+	}
+	pageSize := int64(hdr.PageSize)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The page write record of the file does not cover the delta.
+	if err := os.Remove(path + deltaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Check that the delta fits the most recent transaction of the file.
+	buf := make([]byte, pageSize)
+	var base *meta
+	for i := int64(0); i < 2; i++ {
+		if _, err := f.ReadAt(buf, i*pageSize); err != nil {
+			continue
+		}
+		m := (*page)(unsafe.Pointer(&buf[0])).meta()
+		if m.validate() != nil || m.pageSize != uint32(pageSize) {
+			continue
+		}
+		if base == nil || m.txid > base.txid {
+			base = &meta{}
+			m.copy(base)
+		}
+	}
+	if base == nil {
+		return ErrInvalid
+	} else if uint64(base.txid) < hdr.Since || uint64(base.txid) > hdr.Txid {
+		return ErrDeltaMismatch
+	}
+
+	// Write the changed pages.
+	for {
+		var run deltaRun
+		if err := binary.Read(r, binary.LittleEndian, &run); err != nil {
+			return ErrDeltaInvalid
+		}
+		if run.Count == 0 {
+			break
+		} else if run.ID < 2 || run.ID+run.Count > hdr.Pgid {
+			return ErrDeltaInvalid
+		}
+		for i := uint64(0); i < run.Count; i++ {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return ErrDeltaInvalid
+			}
+			if _, err := f.WriteAt(buf, int64(run.ID+i)*pageSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Read and verify the meta page.
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return ErrDeltaInvalid
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	m := p.meta()
+	if p.flags != metaPageFlag || m.checksum == 0 || m.validate() != nil {
+		return ErrDeltaInvalid
+	} else if uint64(m.txid) != hdr.Txid || uint64(m.pgid) != hdr.Pgid || m.pageSize != hdr.PageSize {
+		return ErrDeltaInvalid
+	}
+
+	// Make the pages durable before they become reachable.
+	if err := f.Truncate(int64(hdr.Pgid) * pageSize); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// Write both meta pages, like Tx.WriteTo() does.
+	p.id = 1
+	m.txid -= 1
+	m.checksum = m.sum64()
+	if _, err := f.WriteAt(buf, pageSize); err != nil {
+		return fmt.Errorf("meta 1 write: %s", err)
+	}
+	p.id = 0
+	m.txid += 1
+	m.checksum = m.sum64()
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("meta 0 write: %s", err)
+	}
+	return f.Sync()
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -20,9 +20,29 @@ var (
 	// different version of Bolt.
 	ErrVersionMismatch = errors.New("version mismatch")
 
-	// ErrChecksum is returned when either meta page checksum does not match.
+	// ErrChecksum is returned when either meta page checksum does not match,
+	// or when a page of a database with page checksums is corrupted. Methods,
+	// that can not return an error, return nil values instead, see Tx.Err().
 	ErrChecksum = errors.New("checksum error")
 
+	// ErrDecrypt is returned when a page of an encrypted database fails
+	// authentication, because it was tampered with or the key is wrong.
+	// Like ErrChecksum, the transaction keeps it, see Tx.Err().
+	ErrDecrypt = errors.New("page decryption failed")
+
+	// ErrDecode is returned when a value of a bucket with a codec can not be
+	// decoded. Methods, that can not return an error, return nil values
+	// instead, see Tx.Err().
+	ErrDecode = errors.New("value can not be decoded")
+
+	// ErrCipherMismatch is returned when an encrypted database is opened
+	// without a cipher, or a database in plain text with one.
+	ErrCipherMismatch = errors.New("cipher does not match database")
+
+	// ErrCipherMmap is returned when a cipher is combined with a flag, that
+	// makes the database write pages through the mmap.
+	ErrCipherMmap = errors.New("cipher not supported with writable mmap")
+
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
@@ -38,6 +58,11 @@ var (
 	// that has already been committed or rolled back.
 	ErrTxClosed = errors.New("tx closed")
 
+	// ErrConflict is returned when committing an optimistic transaction
+	// whose read set was changed by a transaction that committed after it
+	// started.
+	ErrConflict = errors.New("tx conflict")
+
 	// ErrDatabaseReadOnly is returned when a mutating transaction is started on a
 	// read-only database.
 	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
@@ -71,6 +96,73 @@ var (
 	// on an existing non-bucket key or when trying to create or delete a
 	// non-bucket key on an existing bucket key.
 	ErrIncompatibleValue = errors.New("incompatible value")
+
+	// ErrCodecNotFound is returned when creating or opening a bucket with a
+	// codec, that is not registered.
+	ErrCodecNotFound = errors.New("codec not found")
+
+	// ErrComparatorNotFound is returned when creating or opening a bucket with
+	// a comparator, that is not registered.
+	ErrComparatorNotFound = errors.New("comparator not found")
+)
+
+// These errors can occur when bulk loading a RadixBucket.
+var (
+	// ErrBucketNotEmpty is returned when bulk loading into a radix tree,
+	// that already holds keys.
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+
+	// ErrKeysUnsorted is returned when the keys of a bulk load are not in
+	// ascending order.
+	ErrKeysUnsorted = errors.New("keys not sorted")
+
+	// ErrDuplicateKey is returned when a key occurs twice in a bulk load.
+	ErrDuplicateKey = errors.New("duplicate key")
+)
+
+// These errors can occur when applying a delta.
+var (
+	// ErrDeltaInvalid is returned when a delta stream is malformed or its
+	// meta page does not pass the checksum.
+	ErrDeltaInvalid = errors.New("invalid delta")
+
+	// ErrDeltaMismatch is returned when a delta does not fit the database
+	// it is applied to, i.e. the database is older than the base of the delta
+	// or newer than the delta itself.
+	ErrDeltaMismatch = errors.New("delta does not match database")
+)
+
+// These errors can occur when working with snapshots.
+var (
+	// ErrSnapshotNameRequired is returned when taking a snapshot with an
+	// empty name.
+	ErrSnapshotNameRequired = errors.New("snapshot name required")
+
+	// ErrSnapshotExists is returned when taking a snapshot with the name of
+	// an existing snapshot.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+
+	// ErrSnapshotNotFound is returned when opening or dropping a snapshot,
+	// that does not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrSnapshotsExist is returned by DB.Compact(), as the snapshots can not
+	// be preserved in the compacted file.
+	ErrSnapshotsExist = errors.New("database has snapshots")
+)
+
+// These errors can occur when working with the write-ahead log.
+var (
+	// ErrWALNotReplayed is returned when opening a database read-only, whose
+	// write-ahead log holds commits, that were not checkpointed.
+	ErrWALNotReplayed = errors.New("write-ahead log not replayed")
+)
+
+// These errors can occur when working with savepoints.
+var (
+	// ErrSavepointReleased is returned when rolling back to or releasing a
+	// savepoint, that was released.
+	ErrSavepointReleased = errors.New("savepoint released")
 )
 
 // These errors can occour when working with Accept() and Visitor.
@@ -78,4 +170,9 @@ var (
 	// ErrInvalidWriteAttempt is returned when a visitor attempted to perform a write-operation
 	// and Accept() is called in read-only mode (writable=false).
 	ErrInvalidWriteAttempt = errors.New("incompatible value")
+
+	// ErrUnsupportedVisitOp is returned when a visitor returns an operation,
+	// that is not supported by the container, such as VisitOpNEW_BUCKET() on a
+	// RadixBucket.
+	ErrUnsupportedVisitOp = errors.New("unsupported visit operation")
 )
@@ -73,7 +73,9 @@ func (UnsafeOp) AcceptExcact(key []byte,c *Cursor,vis Visitor,writable bool) err
 		case vop.set():
 			if !writable { return ErrInvalidWriteAttempt }
 			key = cloneBytes(key)
-			value := vop.getBuf()
+			value, err := b.encodeValue(vop.getBuf())
+			if err != nil { return err }
+			b.recordPut(key, nil, false, vop.getBuf())
 			c.node().put(key, key, value, 0, 0)
 		case vop.bkt():
 			if !writable { return ErrInvalidWriteAttempt }
@@ -81,6 +83,7 @@ func (UnsafeOp) AcceptExcact(key []byte,c *Cursor,vis Visitor,writable bool) err
 			// Insert into node.
 			key = cloneBytes(key)
 			c.node().put(key, key, value, 0, bucketLeafFlag)
+			b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 			if vop.isset(voVISITBUCKET) {
 				vis.VisitBucket(k,b.Bucket(key))
 			}
@@ -98,24 +101,31 @@ func (UnsafeOp) AcceptExcact(key []byte,c *Cursor,vis Visitor,writable bool) err
 	if notValue(flags) { return nil }
 	
 	// Case 3: Record exists
-	vop := vis.VisitFull(k,v)
+	dec, err := b.decodeValue(v)
+	if err != nil { return err }
+	vop := vis.VisitFull(k,dec)
 	switch {
 	case vop.set():
 		if !writable { return ErrInvalidWriteAttempt }
 		key = cloneBytes(key)
-		value := vop.getBuf()
+		value, err := b.encodeValue(vop.getBuf())
+		if err != nil { return err }
+		b.recordPut(key, v, true, vop.getBuf())
 		c.node().put(key, key, value, 0, 0)
 	case vop.del():
 		if !writable { return ErrInvalidWriteAttempt }
+		b.recordDelete(key, v)
 		c.node().del(key)
 	case vop.bkt():
 		if !writable { return ErrInvalidWriteAttempt }
+		b.recordDelete(key, v)
 		// NOTE: We simply replace a key-value-pair with a bucket. So we don't have to delete it.
 		// c.node().del(key)
 		var value = createInlineBucket()
 		// Insert into node.
 		key = cloneBytes(key)
 		c.node().put(key, key, value, 0, bucketLeafFlag)
+		b.tx.recordStructure(changeCreateBucket, b.path, key, nil)
 		if vop.isset(voVISITBUCKET) {
 			vis.VisitBucket(k,b.Bucket(key))
 		}
@@ -138,29 +148,31 @@ func (UnsafeOp) LinearSeek(c *Cursor,ctx context.Context,seek []byte) (key []byt
 	key, value, flags = UnsafeOp{}.linearSeek(c,ctx,seek)
 	if notValue(flags) {
 		value = nil
+	} else {
+		value = c.bucket.value(value)
 	}
 	return
 }
 func (UnsafeOp) linearSeek(c *Cursor,ctx context.Context,seek []byte) (key []byte, value []byte,flags uint32) {
 	if len(c.stack)==0 { c.First() }
 	key, value, flags = c.keyValue()
-	switch bytes.Compare(seek,key) {
-	case -1: goto reverse
-	case 0: return
-	case 1: goto forward
+	switch cmp := c.bucket.compare(seek,key); {
+	case cmp<0: goto reverse
+	case cmp==0: return
+	case cmp>0: goto forward
 	}
 reverse:
 	// XXX: rather than having an internal .prev() method, the
 	//      algorithm is implemented inside the public .Prev() method.
 	key,value = c.Prev()
-	for bytes.Compare(seek,key)<0 {
+	for c.bucket.compare(seek,key)<0 {
 		if ctx.Err()!=nil { return nil,nil,0 }
 		key,value = c.Prev()
 	}
 	return c.next()
 forward:
 	key, value, flags = c.next()
-	for bytes.Compare(seek,key)>0 {
+	for c.bucket.compare(seek,key)>0 {
 		if ctx.Err()!=nil { return nil,nil,0 }
 		key, value, flags = c.next()
 	}
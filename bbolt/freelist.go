@@ -14,22 +14,68 @@ type txPending struct {
 	lastReleaseBegin txid   // beginning txid of last matching releaseRange
 }
 
+// FreelistType is the type of the freelist backend.
+type FreelistType string
+
+const (
+	// FreelistArrayType keeps the free pages in a sorted array. Allocation
+	// scans the array for a contiguous run of pages.
+	FreelistArrayType = FreelistType("array")
+	// FreelistMapType indexes the free pages by extent in hashmaps, which
+	// are bucketed by the size of the extent.
+	FreelistMapType = FreelistType("hashmap")
+)
+
 // freelist represents a list of all pages that are available for allocation.
 // It also tracks pages that have been freed but are still in use by open transactions.
 type freelist struct {
-	ids     []pgid              // all free and available free page ids.
-	allocs  map[pgid]txid       // mapping of txid that allocated a pgid.
-	pending map[txid]*txPending // mapping of soon-to-be free page ids by tx.
-	cache   map[pgid]bool       // fast lookup of all free and pending page ids.
+	freelistType FreelistType
+	ids          []pgid              // all free and available free page ids.
+	allocs       map[pgid]txid       // mapping of txid that allocated a pgid.
+	pending      map[txid]*txPending // mapping of soon-to-be free page ids by tx.
+	cache        map[pgid]bool       // fast lookup of all free and pending page ids.
+	freemaps     map[uint64]pidSet   // key is the size of an extent, value is the set of its starting pgids.
+	forwardMap   map[pgid]uint64     // key is the first pgid of an extent, value is its size.
+	backwardMap  map[pgid]uint64     // key is the last pgid of an extent, value is its size.
+	freeN        int                 // number of free pages in the extents.
+
+	allocate       func(txid txid, n int) pgid // returns the starting page id of n contiguous free pages.
+	free_count     func() int                  // returns count of free pages.
+	mergeSpans     func(ids pgids)             // adds the sorted ids to the free pages.
+	getFreePageIDs func() []pgid               // returns the sorted free page ids.
+	readIDs        func(ids []pgid)            // initializes the free pages from the sorted ids.
+	truncate       func(hwm pgid) pgid         // drops the free pages below the high water mark.
 }
 
-// newFreelist returns an empty, initialized freelist.
-func newFreelist() *freelist {
-	return &freelist{
-		allocs:  make(map[pgid]txid),
-		pending: make(map[txid]*txPending),
-		cache:   make(map[pgid]bool),
+// newFreelist returns an empty, initialized freelist of the given type.
+func newFreelist(freelistType FreelistType) *freelist {
+	f := &freelist{
+		freelistType: freelistType,
+		allocs:       make(map[pgid]txid),
+		pending:      make(map[txid]*txPending),
+		cache:        make(map[pgid]bool),
+		freemaps:     make(map[uint64]pidSet),
+		forwardMap:   make(map[pgid]uint64),
+		backwardMap:  make(map[pgid]uint64),
 	}
+
+	if freelistType == FreelistMapType {
+		f.allocate = f.hashmapAllocate
+		f.free_count = f.hashmapFreeCount
+		f.mergeSpans = f.hashmapMergeSpans
+		f.getFreePageIDs = f.hashmapGetFreePageIDs
+		f.readIDs = f.hashmapReadIDs
+		f.truncate = f.hashmapTruncate
+	} else {
+		f.allocate = f.arrayAllocate
+		f.free_count = f.arrayFreeCount
+		f.mergeSpans = f.arrayMergeSpans
+		f.getFreePageIDs = f.arrayGetFreePageIDs
+		f.readIDs = f.arrayReadIDs
+		f.truncate = f.arrayTruncate
+	}
+
+	return f
 }
 
 // size returns the size of the page after serialization.
@@ -47,8 +93,8 @@ func (f *freelist) count() int {
 	return f.free_count() + f.pending_count()
 }
 
-// free_count returns count of free pages
-func (f *freelist) free_count() int {
+// arrayFreeCount returns count of free pages (array version).
+func (f *freelist) arrayFreeCount() int {
 	return len(f.ids)
 }
 
@@ -69,12 +115,12 @@ func (f *freelist) copyall(dst []pgid) {
 		m = append(m, txp.ids...)
 	}
 	sort.Sort(m)
-	mergepgids(dst, f.ids, m)
+	mergepgids(dst, f.getFreePageIDs(), m)
 }
 
-// allocate returns the starting page id of a contiguous list of pages of a given size.
+// arrayAllocate returns the starting page id of a contiguous list of pages of a given size.
 // If a contiguous block cannot be found then 0 is returned.
-func (f *freelist) allocate(txid txid, n int) pgid {
+func (f *freelist) arrayAllocate(txid txid, n int) pgid {
 	if len(f.ids) == 0 {
 		return 0
 	}
@@ -161,7 +207,7 @@ func (f *freelist) release(txid txid) {
 		}
 	}
 	sort.Sort(m)
-	f.ids = pgids(f.ids).merge(m)
+	f.mergeSpans(m)
 }
 
 // releaseRange moves pending pages allocated within an extent [begin,end] to the free list.
@@ -195,7 +241,7 @@ func (f *freelist) releaseRange(begin, end txid) {
 		}
 	}
 	sort.Sort(m)
-	f.ids = pgids(f.ids).merge(m)
+	f.mergeSpans(m)
 }
 
 // rollback removes the pages from a given pending tx.
@@ -223,7 +269,26 @@ func (f *freelist) rollback(txid txid) {
 	// Remove pages from pending list and mark as free if allocated by txid.
 	delete(f.pending, txid)
 	sort.Sort(m)
-	f.ids = pgids(f.ids).merge(m)
+	f.mergeSpans(m)
+}
+
+// rollbackAllocs returns the pages, that the transaction txid allocated from
+// the free pages, to them. It is called after rollback(), if the freelist can
+// not be reloaded from a freelist page. Pages allocated beyond the high water
+// mark are dropped with the meta page of the transaction.
+func (f *freelist) rollbackAllocs(txid txid, pages map[pgid]*page) {
+	var m pgids
+	for id, p := range pages {
+		if tid, ok := f.allocs[id]; !ok || tid != txid {
+			continue
+		}
+		delete(f.allocs, id)
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			m = append(m, id+i)
+		}
+	}
+	sort.Sort(m)
+	f.mergeSpans(m)
 }
 
 // freed returns whether a given page is in the free list.
@@ -231,6 +296,85 @@ func (f *freelist) freed(pgid pgid) bool {
 	return f.cache[pgid]
 }
 
+// arrayTruncate removes the free pages directly below the high water mark
+// from the freelist and returns the lowered high water mark.
+func (f *freelist) arrayTruncate(hwm pgid) pgid {
+	i := len(f.ids)
+	for i > 0 && f.ids[i-1] == hwm-1 {
+		i--
+		hwm--
+		delete(f.cache, hwm)
+	}
+	f.ids = f.ids[:i]
+	return hwm
+}
+
+// hold moves the free pages at or beyond limit to the pending pages of tid,
+// so they can not be allocated by the transaction. They are released like
+// the pages freed by the transaction, or returned by a rollback.
+func (f *freelist) hold(tid txid, limit pgid) {
+	ids := f.getFreePageIDs()
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= limit })
+	held := make([]pgid, len(ids)-i)
+	copy(held, ids[i:])
+	alloctx := make([]txid, len(held))
+	for i := range alloctx {
+		alloctx[i] = tid
+	}
+	f.pend(tid, held, alloctx)
+}
+
+// pend moves the sorted free page ids to the pending pages of txid, as if
+// they were allocated by the transactions alloctx and freed by txid.
+func (f *freelist) pend(txid txid, ids []pgid, alloctx []txid) {
+	if len(ids) == 0 {
+		return
+	}
+	txp := f.pending[txid]
+	if txp == nil {
+		txp = &txPending{}
+		f.pending[txid] = txp
+	}
+	txp.ids = append(txp.ids, ids...)
+	txp.alloctx = append(txp.alloctx, alloctx...)
+
+	// Keep the remaining free pages.
+	var a []pgid
+	for _, id := range f.getFreePageIDs() {
+		if len(ids) > 0 && ids[0] == id {
+			ids = ids[1:]
+			continue
+		}
+		a = append(a, id)
+	}
+	f.readIDs(a)
+}
+
+// rewind undoes the changes made by txid since a savepoint. The pages freed
+// after the first pendingN pages are restored to their allocating txid, the
+// allocated pages are forgotten and the free pages are reset to ids.
+func (f *freelist) rewind(txid txid, ids []pgid, pendingN int, allocated []*page) {
+	if txp := f.pending[txid]; txp != nil {
+		for i := pendingN; i < len(txp.ids); i++ {
+			if tx := txp.alloctx[i]; tx != 0 {
+				f.allocs[txp.ids[i]] = tx
+			}
+		}
+		if pendingN == 0 {
+			delete(f.pending, txid)
+		} else {
+			txp.ids = txp.ids[:pendingN]
+			txp.alloctx = txp.alloctx[:pendingN]
+		}
+	}
+	for _, p := range allocated {
+		for id := p.id; id <= p.id+pgid(p.overflow); id++ {
+			delete(f.allocs, id)
+		}
+	}
+	f.readIDs(append([]pgid(nil), ids...))
+}
+
 // read initializes the freelist from a freelist page.
 func (f *freelist) read(p *page) {
 	if (p.flags & freelistPageFlag) == 0 {
@@ -246,26 +390,35 @@ func (f *freelist) read(p *page) {
 
 	// Copy the list of page ids from the freelist.
 	if count == 0 {
-		f.ids = nil
+		f.readIDs(nil)
 	} else {
 		ids := ((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx : idx+count]
-		f.ids = make([]pgid, len(ids))
-		copy(f.ids, ids)
+		idsCopy := make([]pgid, len(ids))
+		copy(idsCopy, ids)
 
 		// Make sure they're sorted.
-		sort.Sort(pgids(f.ids))
-	}
+		sort.Sort(pgids(idsCopy))
 
-	// Rebuild the page cache.
-	f.reindex()
+		f.readIDs(idsCopy)
+	}
 }
 
-// read initializes the freelist from a given list of ids.
-func (f *freelist) readIDs(ids []pgid) {
+// arrayReadIDs initializes the freelist from a given list of ids (array version).
+func (f *freelist) arrayReadIDs(ids []pgid) {
 	f.ids = ids
 	f.reindex()
 }
 
+// arrayGetFreePageIDs returns the free page ids (array version).
+func (f *freelist) arrayGetFreePageIDs() []pgid {
+	return f.ids
+}
+
+// arrayMergeSpans merges the sorted ids into the free page ids (array version).
+func (f *freelist) arrayMergeSpans(ids pgids) {
+	f.ids = pgids(f.ids).merge(ids)
+}
+
 // write writes the page ids onto a freelist page. All free and pending ids are
 // saved to disk since in the event of a program crash, all pending ids will
 // become free.
@@ -307,22 +460,22 @@ func (f *freelist) reload(p *page) {
 	// Check each page in the freelist and build a new available freelist
 	// with any pages not in the pending lists.
 	var a []pgid
-	for _, id := range f.ids {
+	for _, id := range f.getFreePageIDs() {
 		if !pcache[id] {
 			a = append(a, id)
 		}
 	}
-	f.ids = a
 
 	// Once the available list is rebuilt then rebuild the free cache so that
 	// it includes the available and pending free pages.
-	f.reindex()
+	f.readIDs(a)
 }
 
 // reindex rebuilds the free cache based on available and pending free lists.
 func (f *freelist) reindex() {
-	f.cache = make(map[pgid]bool, len(f.ids))
-	for _, id := range f.ids {
+	ids := f.getFreePageIDs()
+	f.cache = make(map[pgid]bool, len(ids))
+	for _, id := range ids {
 		f.cache[id] = true
 	}
 	for _, txp := range f.pending {
@@ -0,0 +1,184 @@
+package bbolt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// pidSet holds the set of starting pgids which have the same extent size.
+type pidSet map[pgid]struct{}
+
+// hashmapFreeCount returns count of free pages (hashmap version).
+func (f *freelist) hashmapFreeCount() int {
+	return f.freeN
+}
+
+// hashmapAllocate serves the same purpose as arrayAllocate, but uses the
+// extent index. An extent of exactly n pages is preferred, otherwise the
+// first n pages of a larger extent are allocated.
+func (f *freelist) hashmapAllocate(txid txid, n int) pgid {
+	if n == 0 {
+		return 0
+	}
+
+	// If there is an exact size match, take the short path.
+	if bm, ok := f.freemaps[uint64(n)]; ok {
+		for pid := range bm {
+			f.delSpan(pid, uint64(n))
+			f.allocated(txid, pid, n)
+			return pid
+		}
+	}
+
+	// Look for the smallest larger extent.
+	var best uint64
+	for size := range f.freemaps {
+		if size > uint64(n) && (best == 0 || size < best) {
+			best = size
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+	for pid := range f.freemaps[best] {
+		f.delSpan(pid, best)
+		f.addSpan(pid+pgid(n), best-uint64(n))
+		f.allocated(txid, pid, n)
+		return pid
+	}
+	return 0
+}
+
+// allocated records the allocation of n pages starting at pid.
+func (f *freelist) allocated(txid txid, pid pgid, n int) {
+	if pid <= 1 {
+		panic(fmt.Sprintf("invalid page allocation: %d", pid))
+	}
+	for i := pgid(0); i < pgid(n); i++ {
+		delete(f.cache, pid+i)
+	}
+	f.allocs[pid] = txid
+}
+
+// hashmapReadIDs initializes the freelist from a given list of sorted ids
+// (hashmap version).
+func (f *freelist) hashmapReadIDs(ids []pgid) {
+	f.init(ids)
+	f.reindex()
+}
+
+// hashmapGetFreePageIDs returns the sorted free page ids (hashmap version).
+func (f *freelist) hashmapGetFreePageIDs() []pgid {
+	if f.freeN == 0 {
+		return nil
+	}
+
+	m := make([]pgid, 0, f.freeN)
+	for start, size := range f.forwardMap {
+		for i := 0; i < int(size); i++ {
+			m = append(m, start+pgid(i))
+		}
+	}
+	sort.Sort(pgids(m))
+	return m
+}
+
+// hashmapMergeSpans adds the ids to the extents, merging them with the
+// adjacent extents (hashmap version).
+func (f *freelist) hashmapMergeSpans(ids pgids) {
+	for _, id := range ids {
+		f.mergeWithExistingSpan(id)
+	}
+}
+
+// hashmapTruncate removes the extent directly below the high water mark from
+// the freelist and returns the lowered high water mark (hashmap version).
+func (f *freelist) hashmapTruncate(hwm pgid) pgid {
+	size, ok := f.backwardMap[hwm-1]
+	if !ok {
+		return hwm
+	}
+	f.delSpan(hwm-pgid(size), size)
+	for i := uint64(0); i < size; i++ {
+		hwm--
+		delete(f.cache, hwm)
+	}
+	return hwm
+}
+
+// mergeWithExistingSpan merges pid with the extents ending directly before
+// and starting directly after it.
+func (f *freelist) mergeWithExistingSpan(pid pgid) {
+	prev := pid - 1
+	next := pid + 1
+
+	preSize, mergeWithPrev := f.backwardMap[prev]
+	nextSize, mergeWithNext := f.forwardMap[next]
+	newStart := pid
+	var newSize uint64 = 1
+
+	if mergeWithPrev {
+		start := prev + 1 - pgid(preSize)
+		f.delSpan(start, preSize)
+
+		newStart -= pgid(preSize)
+		newSize += preSize
+	}
+
+	if mergeWithNext {
+		f.delSpan(next, nextSize)
+		newSize += nextSize
+	}
+
+	f.addSpan(newStart, newSize)
+}
+
+func (f *freelist) addSpan(start pgid, size uint64) {
+	if size == 0 {
+		return
+	}
+	f.backwardMap[start-1+pgid(size)] = size
+	f.forwardMap[start] = size
+	if _, ok := f.freemaps[size]; !ok {
+		f.freemaps[size] = make(pidSet)
+	}
+	f.freemaps[size][start] = struct{}{}
+	f.freeN += int(size)
+}
+
+func (f *freelist) delSpan(start pgid, size uint64) {
+	delete(f.forwardMap, start)
+	delete(f.backwardMap, start+pgid(size-1))
+	delete(f.freemaps[size], start)
+	if len(f.freemaps[size]) == 0 {
+		delete(f.freemaps, size)
+	}
+	f.freeN -= int(size)
+}
+
+// init builds the extents from the sorted pgids.
+func (f *freelist) init(pgids []pgid) {
+	f.freemaps = make(map[uint64]pidSet)
+	f.forwardMap = make(map[pgid]uint64)
+	f.backwardMap = make(map[pgid]uint64)
+	f.freeN = 0
+
+	if len(pgids) == 0 {
+		return
+	}
+
+	size := uint64(1)
+	start := pgids[0]
+	for i := 1; i < len(pgids); i++ {
+		if pgids[i] == pgids[i-1]+1 {
+			// Continuous page.
+			size++
+		} else {
+			f.addSpan(start, size)
+
+			size = 1
+			start = pgids[i]
+		}
+	}
+	f.addSpan(start, size)
+}
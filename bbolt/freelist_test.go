@@ -2,15 +2,30 @@ package bbolt
 
 import (
 	"math/rand"
+	"os"
 	"reflect"
 	"sort"
 	"testing"
 	"unsafe"
 )
 
+// TestFreelistType is the environment variable selecting the freelist type
+// used by the tests.
+const TestFreelistType = "TEST_FREELIST_TYPE"
+
+// newTestFreelist returns an empty freelist of the type selected by the
+// TEST_FREELIST_TYPE environment variable.
+func newTestFreelist() *freelist {
+	freelistType := FreelistArrayType
+	if env := os.Getenv(TestFreelistType); env == string(FreelistMapType) {
+		freelistType = FreelistMapType
+	}
+	return newFreelist(freelistType)
+}
+
 // Ensure that a page is added to a transaction's freelist.
 func TestFreelist_free(t *testing.T) {
-	f := newFreelist()
+	f := newTestFreelist()
 	f.free(100, &page{id: 12})
 	if !reflect.DeepEqual([]pgid{12}, f.pending[100].ids) {
 		t.Fatalf("exp=%v; got=%v", []pgid{12}, f.pending[100])
@@ -19,7 +34,7 @@ func TestFreelist_free(t *testing.T) {
 
 // Ensure that a page and its overflow is added to a transaction's freelist.
 func TestFreelist_free_overflow(t *testing.T) {
-	f := newFreelist()
+	f := newTestFreelist()
 	f.free(100, &page{id: 12, overflow: 3})
 	if exp := []pgid{12, 13, 14, 15}; !reflect.DeepEqual(exp, f.pending[100].ids) {
 		t.Fatalf("exp=%v; got=%v", exp, f.pending[100])
@@ -28,19 +43,19 @@ func TestFreelist_free_overflow(t *testing.T) {
 
 // Ensure that a transaction's free pages can be released.
 func TestFreelist_release(t *testing.T) {
-	f := newFreelist()
+	f := newTestFreelist()
 	f.free(100, &page{id: 12, overflow: 1})
 	f.free(100, &page{id: 9})
 	f.free(102, &page{id: 39})
 	f.release(100)
 	f.release(101)
-	if exp := []pgid{9, 12, 13}; !reflect.DeepEqual(exp, f.ids) {
-		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	if exp := []pgid{9, 12, 13}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
 	}
 
 	f.release(102)
-	if exp := []pgid{9, 12, 13, 39}; !reflect.DeepEqual(exp, f.ids) {
-		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	if exp := []pgid{9, 12, 13, 39}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
 	}
 }
 
@@ -147,13 +162,14 @@ func TestFreelist_releaseRange(t *testing.T) {
 	}
 
 	for _, c := range releaseRangeTests {
-		f := newFreelist()
-
+		f := newTestFreelist()
+		var ids []pgid
 		for _, p := range c.pagesIn {
 			for i := uint64(0); i < uint64(p.n); i++ {
-				f.ids = append(f.ids, pgid(uint64(p.id)+i))
+				ids = append(ids, pgid(uint64(p.id)+i))
 			}
 		}
+		f.readIDs(ids)
 		for _, p := range c.pagesIn {
 			f.allocate(p.allocTxn, p.n)
 		}
@@ -166,16 +182,16 @@ func TestFreelist_releaseRange(t *testing.T) {
 			f.releaseRange(r.begin, r.end)
 		}
 
-		if exp := c.wantFree; !reflect.DeepEqual(exp, f.ids) {
-			t.Errorf("exp=%v; got=%v for %s", exp, f.ids, c.title)
+		if exp := c.wantFree; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+			t.Errorf("exp=%v; got=%v for %s", exp, f.getFreePageIDs(), c.title)
 		}
 	}
 }
 
 // Ensure that a freelist can find contiguous blocks of pages.
 func TestFreelist_allocate(t *testing.T) {
-	f := newFreelist()
-	f.ids = []pgid{3, 4, 5, 6, 7, 9, 12, 13, 18}
+	f := newFreelist(FreelistArrayType)
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
 	if id := int(f.allocate(1, 3)); id != 3 {
 		t.Fatalf("exp=3; got=%v", id)
 	}
@@ -215,6 +231,147 @@ func TestFreelist_allocate(t *testing.T) {
 	}
 }
 
+// Ensure that the hashmap freelist prefers extents of the exact size.
+func TestFreelistHashmap_allocate(t *testing.T) {
+	f := newFreelist(FreelistMapType)
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
+	if id := int(f.allocate(1, 2)); id != 12 {
+		t.Fatalf("exp=12; got=%v", id)
+	}
+	if id := int(f.allocate(1, 3)); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if id := int(f.allocate(1, 3)); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if id := int(f.allocate(1, 2)); id != 6 {
+		t.Fatalf("exp=6; got=%v", id)
+	}
+	if id := int(f.allocate(1, 0)); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{9, 18}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
+	}
+	if n := f.free_count(); n != 2 {
+		t.Fatalf("exp=2; got=%v", n)
+	}
+
+	f.allocate(1, 1)
+	f.allocate(1, 1)
+	if id := int(f.allocate(1, 1)); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if ids := f.getFreePageIDs(); len(ids) != 0 {
+		t.Fatalf("exp=[]; got=%v", ids)
+	}
+	for _, id := range []pgid{3, 6, 9, 12, 18} {
+		if f.allocs[id] != 1 {
+			t.Fatalf("page %d not allocated", id)
+		}
+	}
+}
+
+// Ensure that the hashmap freelist merges adjacent extents.
+func TestFreelistHashmap_mergeWithExistingSpan(t *testing.T) {
+	f := newFreelist(FreelistMapType)
+	f.readIDs([]pgid{3, 4, 7, 8, 12})
+	f.mergeSpans(pgids{5, 6, 10, 13})
+
+	if exp := []pgid{3, 4, 5, 6, 7, 8, 10, 12, 13}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
+	}
+	if exp := map[pgid]uint64{3: 6, 10: 1, 12: 2}; !reflect.DeepEqual(exp, f.forwardMap) {
+		t.Fatalf("forward: exp=%v; got=%v", exp, f.forwardMap)
+	}
+	if exp := map[pgid]uint64{8: 6, 10: 1, 13: 2}; !reflect.DeepEqual(exp, f.backwardMap) {
+		t.Fatalf("backward: exp=%v; got=%v", exp, f.backwardMap)
+	}
+	exp := map[uint64]pidSet{6: {3: {}}, 1: {10: {}}, 2: {12: {}}}
+	if !reflect.DeepEqual(exp, f.freemaps) {
+		t.Fatalf("freemaps: exp=%v; got=%v", exp, f.freemaps)
+	}
+}
+
+// Ensure that the free pages below the high water mark are truncated.
+func TestFreelist_truncate(t *testing.T) {
+	f := newTestFreelist()
+	f.readIDs([]pgid{3, 4, 7, 8, 9})
+	if hwm := f.truncate(12); hwm != 12 {
+		t.Fatalf("exp=12; got=%v", hwm)
+	}
+	if hwm := f.truncate(10); hwm != 7 {
+		t.Fatalf("exp=7; got=%v", hwm)
+	}
+	if exp := []pgid{3, 4}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
+	}
+	if f.freed(8) {
+		t.Fatal("truncated page 8 still cached")
+	}
+}
+
+// Ensure that the pages allocated by a rolled back transaction are free again.
+func TestFreelist_rollbackAllocs(t *testing.T) {
+	f := newTestFreelist()
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9})
+	f.free(99, &page{id: 12})
+
+	// Pages allocated and freed by the transaction are returned by rollback.
+	pages := make(map[pgid]*page)
+	var p *page
+	for _, n := range []int{2, 1, 1} {
+		p = &page{id: f.allocate(100, n), overflow: uint32(n - 1)}
+		pages[p.id] = p
+	}
+	f.free(100, p)
+	f.rollback(100)
+	f.rollbackAllocs(100, pages)
+
+	if exp := []pgid{3, 4, 5, 6, 7, 9}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
+	}
+	if len(f.allocs) != 0 {
+		t.Fatalf("unexpected allocs: %v", f.allocs)
+	}
+	if exp := []pgid{12}; !reflect.DeepEqual(exp, f.pending[99].ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[99])
+	}
+}
+
+// Ensure that only free pages are allocated, and each of them only once.
+func TestFreelist_allocateRandom(t *testing.T) {
+	rand.Seed(42)
+	f := newTestFreelist()
+	f.readIDs(fragmentedPgids(10000))
+	free := make(map[pgid]bool)
+	for _, id := range f.getFreePageIDs() {
+		free[id] = true
+	}
+
+	for i := 0; i < 2000; i++ {
+		n := 1 + rand.Intn(8)
+		id := f.allocate(1, n)
+		if id == 0 {
+			continue
+		}
+		for j := pgid(0); j < pgid(n); j++ {
+			if !free[id+j] {
+				t.Fatalf("page %d allocated twice", id+j)
+			}
+			delete(free, id+j)
+		}
+	}
+	if len(free) != f.free_count() {
+		t.Fatalf("exp=%v; got=%v", len(free), f.free_count())
+	}
+	for _, id := range f.getFreePageIDs() {
+		if !free[id] {
+			t.Fatalf("page %d allocated but still free", id)
+		}
+	}
+}
+
 // Ensure that a freelist can deserialize from a freelist page.
 func TestFreelist_read(t *testing.T) {
 	// Create a page.
@@ -229,12 +386,12 @@ func TestFreelist_read(t *testing.T) {
 	ids[1] = 50
 
 	// Deserialize page into a freelist.
-	f := newFreelist()
+	f := newTestFreelist()
 	f.read(page)
 
 	// Ensure that there are two page ids in the freelist.
-	if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.ids) {
-		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.getFreePageIDs())
 	}
 }
 
@@ -242,7 +399,8 @@ func TestFreelist_read(t *testing.T) {
 func TestFreelist_write(t *testing.T) {
 	// Create a freelist and write it to a page.
 	var buf [4096]byte
-	f := &freelist{ids: []pgid{12, 39}, pending: make(map[txid]*txPending)}
+	f := newTestFreelist()
+	f.readIDs([]pgid{12, 39})
 	f.pending[100] = &txPending{ids: []pgid{28, 11}}
 	f.pending[101] = &txPending{ids: []pgid{3}}
 	p := (*page)(unsafe.Pointer(&buf[0]))
@@ -251,13 +409,13 @@ func TestFreelist_write(t *testing.T) {
 	}
 
 	// Read the page back out.
-	f2 := newFreelist()
+	f2 := newTestFreelist()
 	f2.read(p)
 
 	// Ensure that the freelist is correct.
 	// All pages should be present and in reverse order.
-	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.ids) {
-		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
+	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.getFreePageIDs()) {
+		t.Fatalf("exp=%v; got=%v", exp, f2.getFreePageIDs())
 	}
 }
 
@@ -271,12 +429,75 @@ func benchmark_FreelistRelease(b *testing.B, size int) {
 	pending := randomPgids(len(ids) / 400)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
+		b.StopTimer()
 		txp := &txPending{ids: pending}
-		f := &freelist{ids: ids, pending: map[txid]*txPending{1: txp}}
+		f := newTestFreelist()
+		f.readIDs(ids)
+		f.pending = map[txid]*txPending{1: txp}
+		b.StartTimer()
 		f.release(1)
 	}
 }
 
+func Benchmark_FreelistAllocateArray10K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistArrayType, 10000)
+}
+func Benchmark_FreelistAllocateArray100K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistArrayType, 100000)
+}
+func Benchmark_FreelistAllocateArray1000K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistArrayType, 1000000)
+}
+func Benchmark_FreelistAllocateHashmap10K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistMapType, 10000)
+}
+func Benchmark_FreelistAllocateHashmap100K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistMapType, 100000)
+}
+func Benchmark_FreelistAllocateHashmap1000K(b *testing.B) {
+	benchmark_FreelistAllocate(b, FreelistMapType, 1000000)
+}
+
+// benchmark_FreelistAllocate measures the allocation of 1 to 8 pages from a
+// fragmented freelist of the given size. The freelist is refilled, whenever
+// it runs out of large enough extents.
+func benchmark_FreelistAllocate(b *testing.B, typ FreelistType, size int) {
+	ids := fragmentedPgids(size)
+	f := newFreelist(typ)
+	f.readIDs(append([]pgid(nil), ids...))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 1 + i%8
+		if f.allocate(1, n) == 0 {
+			b.StopTimer()
+			f = newFreelist(typ)
+			f.readIDs(append([]pgid(nil), ids...))
+			b.StartTimer()
+			f.allocate(1, n)
+		}
+	}
+}
+
+// fragmentedPgids returns n sorted page ids in extents of mostly 1 to 4 pages,
+// with the occasional extent of 16 pages.
+func fragmentedPgids(n int) []pgid {
+	rand.Seed(42)
+	ids := make([]pgid, 0, n)
+	id := pgid(2)
+	for len(ids) < n {
+		l := 1 + rand.Intn(4)
+		if rand.Intn(32) == 0 {
+			l = 16
+		}
+		for j := 0; j < l && len(ids) < n; j++ {
+			ids = append(ids, id)
+			id++
+		}
+		id++
+	}
+	return ids
+}
+
 func randomPgids(n int) []pgid {
 	rand.Seed(42)
 	pgids := make(pgids, n)
@@ -0,0 +1,299 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// OptimisticTx is a read-write transaction that does not hold the writer lock
+// while it runs. Every read is served by a short read-only transaction and
+// recorded in a read set, writes are buffered in a write set. Commit() takes
+// the writer lock, validates the read set against the current state of the
+// database and applies the write set, so any number of optimistic transactions
+// can run concurrently and only their commits are serialized.
+//
+// If a transaction that committed after this one started changed a key or a
+// bucket in the read set, Commit() returns ErrConflict and nothing is written.
+// The caller is expected to retry the transaction.
+//
+// Each read runs in its own DB.View(), so the reads are not consistent with a
+// single snapshot: two reads may observe different versions of the database
+// while the transaction runs. Since the reads are validated at commit time, a
+// transaction only commits if all of its reads match the version it is
+// committed on.
+//
+// Buckets cannot be created or deleted by an optimistic transaction, use
+// DB.Update() for that.
+type OptimisticTx struct {
+	db     *DB
+	base   txid // last committed transaction when this one started
+	reads  map[string]*optimisticRead
+	writes map[string]*optimisticWrite
+	order  []*optimisticWrite // writes in the order they were made
+}
+
+// optimisticRead is an entry of the read set. A nil key denotes the lookup
+// of the bucket itself.
+type optimisticRead struct {
+	path  [][]byte
+	key   []byte
+	value []byte
+	found bool
+}
+
+// optimisticWrite is an entry of the write set. A nil value denotes a delete.
+type optimisticWrite struct {
+	path  [][]byte
+	key   []byte
+	value []byte
+}
+
+// OptimisticBucket is a bucket as seen by an OptimisticTx.
+type OptimisticBucket struct {
+	otx  *OptimisticTx
+	path [][]byte
+}
+
+// BeginOptimistic starts a new optimistic transaction.
+//
+// Unlike other transactions, an optimistic transaction does not keep the
+// database pinned while it is open, so it may be used from the same goroutine
+// as other transactions. It must still be committed or rolled back.
+func (db *DB) BeginOptimistic() (*OptimisticTx, error) {
+	if db.readOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+	tx, err := db.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	base := tx.meta.txid
+	if err := tx.Rollback(); err != nil {
+		return nil, err
+	}
+	return &OptimisticTx{
+		db:     db,
+		base:   base,
+		reads:  make(map[string]*optimisticRead),
+		writes: make(map[string]*optimisticWrite),
+	}, nil
+}
+
+// DB returns a reference to the database that created the transaction.
+func (o *OptimisticTx) DB() *DB {
+	return o.db
+}
+
+// Bucket retrieves a top-level bucket by name.
+// Returns nil if the bucket does not exist.
+func (o *OptimisticTx) Bucket(name []byte) *OptimisticBucket {
+	return o.open(nil, name)
+}
+
+// Bucket retrieves a nested bucket by name.
+// Returns nil if the bucket does not exist.
+func (b *OptimisticBucket) Bucket(name []byte) *OptimisticBucket {
+	return b.otx.open(b.path, name)
+}
+
+// open looks up the bucket name below parent and records the lookup.
+func (o *OptimisticTx) open(parent [][]byte, name []byte) *OptimisticBucket {
+	if o.db == nil {
+		return nil
+	}
+	path := make([][]byte, len(parent)+1)
+	copy(path, parent)
+	path[len(parent)] = cloneBytes(name)
+
+	id := optimisticKey(path, nil)
+	r, ok := o.reads[id]
+	if !ok {
+		r = &optimisticRead{path: path}
+		if err := o.db.View(func(tx *Tx) error {
+			r.found = resolveBucket(tx, path) != nil
+			return nil
+		}); err != nil {
+			return nil
+		}
+		o.reads[id] = r
+	}
+	if !r.found {
+		return nil
+	}
+	return &OptimisticBucket{otx: o, path: path}
+}
+
+// Get retrieves the value for a key in the bucket.
+// Returns a nil value if the key does not exist or if the key is a nested bucket.
+// Writes made earlier in the same transaction are visible. The returned value
+// is valid until the transaction is closed. The key is read in its own
+// DB.View(), see OptimisticTx.
+func (b *OptimisticBucket) Get(key []byte) []byte {
+	o := b.otx
+	if o.db == nil || len(key) == 0 {
+		return nil
+	}
+	id := optimisticKey(b.path, key)
+	if w, ok := o.writes[id]; ok {
+		return w.value
+	}
+	if r, ok := o.reads[id]; ok {
+		return r.value
+	}
+	r := &optimisticRead{path: b.path, key: cloneBytes(key)}
+	if err := o.db.View(func(tx *Tx) error {
+		if bk := resolveBucket(tx, b.path); bk != nil {
+			if v := bk.Get(key); v != nil {
+				r.value, r.found = cloneBytes(v), true
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil
+	}
+	o.reads[id] = r
+	return r.value
+}
+
+// Put sets the value for a key in the bucket. The write takes effect when the
+// transaction commits.
+// Returns an error if the transaction is closed, the key is blank, the key
+// is too large or the value is too large.
+func (b *OptimisticBucket) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if int64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return b.write(key, cloneBytes(value))
+}
+
+// Delete removes a key from the bucket. The delete takes effect when the
+// transaction commits. If the key does not exist then nothing is done.
+// Returns an error if the key is blank or the transaction is closed.
+func (b *OptimisticBucket) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	return b.write(key, nil)
+}
+
+func (b *OptimisticBucket) write(key, value []byte) error {
+	o := b.otx
+	if o.db == nil {
+		return ErrTxClosed
+	}
+	id := optimisticKey(b.path, key)
+	if w, ok := o.writes[id]; ok {
+		w.value = value
+		return nil
+	}
+	w := &optimisticWrite{path: b.path, key: cloneBytes(key), value: value}
+	o.writes[id] = w
+	o.order = append(o.order, w)
+	return nil
+}
+
+// Rollback closes the transaction and discards its write set.
+func (o *OptimisticTx) Rollback() error {
+	if o.db == nil {
+		return ErrTxClosed
+	}
+	o.close()
+	return nil
+}
+
+// Commit validates the read set and writes the write set to disk.
+// Returns ErrConflict if a transaction that committed since this one started
+// changed a key or a bucket this transaction has read. In any case the
+// transaction is closed afterwards.
+func (o *OptimisticTx) Commit() error {
+	if o.db == nil {
+		return ErrTxClosed
+	}
+	db, base, reads, order := o.db, o.base, o.reads, o.order
+	o.close()
+	if len(order) == 0 {
+		return nil
+	}
+
+	return db.Update(func(tx *Tx) error {
+		// Validation can be skipped if nothing has been committed since.
+		if tx.meta.txid != base+1 {
+			for _, r := range reads {
+				if !r.valid(tx) {
+					return ErrConflict
+				}
+			}
+		}
+		for _, w := range order {
+			b := resolveBucket(tx, w.path)
+			if b == nil {
+				return ErrBucketNotFound
+			}
+			var err error
+			if w.value == nil {
+				err = b.Delete(w.key)
+			} else {
+				err = b.Put(w.key, w.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (o *OptimisticTx) close() {
+	o.db = nil
+	o.reads = nil
+	o.writes = nil
+	o.order = nil
+}
+
+// valid reports whether the read still yields the same result in tx.
+func (r *optimisticRead) valid(tx *Tx) bool {
+	b := resolveBucket(tx, r.path)
+	if r.key == nil {
+		return (b != nil) == r.found
+	}
+	if b == nil {
+		return false
+	}
+	v := b.Get(r.key)
+	return (v != nil) == r.found && bytes.Equal(v, r.value)
+}
+
+// resolveBucket looks up a bucket by its path from the root.
+func resolveBucket(tx *Tx, path [][]byte) *Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// optimisticKey encodes a bucket path and a key into a map key.
+// The key is omitted to denote the bucket itself.
+func optimisticKey(path [][]byte, key []byte) string {
+	var lb [binary.MaxVarintLen64]byte
+	buf := append([]byte(nil), lb[:binary.PutUvarint(lb[:], uint64(len(path)))]...)
+	for _, name := range path {
+		buf = append(buf, lb[:binary.PutUvarint(lb[:], uint64(len(name)))]...)
+		buf = append(buf, name...)
+	}
+	if key != nil {
+		buf = append(buf, 1)
+		buf = append(buf, key...)
+	}
+	return string(buf)
+}
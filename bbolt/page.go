@@ -21,6 +21,7 @@ const (
 	freelistPageFlag = 0x10
 	
 	radixPageFlag    = 0x20
+	snapshotPageFlag = 0x40
 )
 
 const (
@@ -58,6 +59,8 @@ func (p *page) typ() string {
 		return "meta"
 	} else if (p.flags & freelistPageFlag) != 0 {
 		return "freelist"
+	} else if (p.flags & snapshotPageFlag) != 0 {
+		return "snapshot"
 	}
 	return fmt.Sprintf("unknown<%02x>", p.flags)
 }
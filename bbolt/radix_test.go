@@ -0,0 +1,1519 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	bolt "github.com/maxymania/go-unstable/bbolt"
+	"github.com/maxymania/go-unstable/radix"
+)
+
+// Ensure that a radix tree reports statistics about its nodes and pages.
+func TestRadixBucket_Stats(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	big := bytes.Repeat([]byte("*"), 3*os.Getpagesize())
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := r.Put([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Dirty nodes are reported as heap nodes.
+		if stats := r.Stats(); stats.KeyN != 1000 {
+			t.Fatalf("unexpected KeyN: %d", stats.KeyN)
+		} else if stats.HeapNodeN != stats.NodeN {
+			t.Fatalf("unexpected HeapNodeN: %d != %d", stats.HeapNodeN, stats.NodeN)
+		}
+
+		// An oversized value within a branch node gets pushed to a seperate page.
+		return r.Put([]byte("0"), big)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		stats := tx.RadixBucket([]byte("radix")).Stats()
+		if stats.TreeN != 1 {
+			t.Fatalf("unexpected TreeN: %d", stats.TreeN)
+		} else if stats.KeyN != 1001 {
+			t.Fatalf("unexpected KeyN: %d", stats.KeyN)
+		} else if stats.HeapNodeN != 0 {
+			t.Fatalf("unexpected HeapNodeN: %d", stats.HeapNodeN)
+		} else if stats.NodeN != stats.PageNodeN+stats.InlineNodeN {
+			t.Fatalf("unexpected NodeN: %d != %d+%d", stats.NodeN, stats.PageNodeN, stats.InlineNodeN)
+		} else if stats.PageNodeN == 0 || stats.InlineNodeN == 0 {
+			t.Fatalf("unexpected node placement: %d page-rooted, %d inlined", stats.PageNodeN, stats.InlineNodeN)
+		} else if stats.ExternalLeafPageN != 1 {
+			t.Fatalf("unexpected ExternalLeafPageN: %d", stats.ExternalLeafPageN)
+		} else if stats.PageN != stats.PageNodeN+stats.ExternalLeafPageN {
+			t.Fatalf("unexpected PageN: %d", stats.PageN)
+		} else if stats.OverflowN < 3 {
+			t.Fatalf("unexpected OverflowN: %d", stats.OverflowN)
+		} else if stats.Depth != 5 {
+			// root -> "0" -> "0".."9" -> "0".."9" -> "0".."9"
+			t.Fatalf("unexpected Depth: %d", stats.Depth)
+		} else if stats.LeafBytes != 1000*5+len(big) {
+			t.Fatalf("unexpected LeafBytes: %d", stats.LeafBytes)
+		} else if stats.EdgeN != stats.NodeN-1 {
+			t.Fatalf("unexpected EdgeN: %d", stats.EdgeN)
+		} else if f := stats.FillRatio(); f <= 0 || f > 1 {
+			t.Fatalf("unexpected FillRatio: %f", f)
+		} else if f := stats.AvgFanout(); f < 1 {
+			t.Fatalf("unexpected AvgFanout: %f", f)
+		}
+		if stats.Alloc != (stats.PageN+stats.OverflowN)*db.Info().PageSize {
+			t.Fatalf("unexpected Alloc: %d", stats.Alloc)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that bucket statistics include nested radix trees.
+func TestBucket_Stats_Radix(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b"} {
+			r, err := b.CreateRadixBucket([]byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := r.Put([]byte(fmt.Sprintf("%s%03d", name, i)), []byte("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		stats := tx.Bucket([]byte("widgets")).Stats()
+		if stats.Radix.TreeN != 2 {
+			t.Fatalf("unexpected Radix.TreeN: %d", stats.Radix.TreeN)
+		} else if stats.Radix.KeyN != 200 {
+			t.Fatalf("unexpected Radix.KeyN: %d", stats.Radix.KeyN)
+		} else if stats.Radix.PageN == 0 || stats.Radix.Alloc == 0 {
+			t.Fatalf("unexpected Radix.PageN: %d", stats.Radix.PageN)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// radixTestKeys returns a set of keys, sharing many prefixes.
+func radixTestKeys(n int, seed int64) [][]byte {
+	rand := rand.New(rand.NewSource(seed))
+	var keys [][]byte
+	seen := make(map[string]bool)
+	for len(keys) < n {
+		k := make([]byte, 1+rand.Intn(6))
+		for i := range k {
+			k[i] = "abcxyz"[rand.Intn(6)]
+		}
+		if !seen[string(k)] {
+			seen[string(k)] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Ensure that a radix iterator can be positioned at an arbitrary key.
+func TestRadixIterator_Seek(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	keys := radixTestKeys(500, 1)
+	var sorted [][]byte
+	sorted = append(sorted, keys...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	check := func(tx *bolt.Tx) {
+		it := tx.RadixBucket([]byte("radix")).Iterator()
+		probes := radixTestKeys(300, 2)
+		probes = append(probes, []byte("a"), []byte("zzzzzzz"), []byte("0"), []byte("{"))
+		for _, probe := range probes {
+			ge := sort.Search(len(sorted), func(i int) bool { return bytes.Compare(sorted[i], probe) >= 0 })
+
+			k, v, ok := it.Seek(probe)
+			if ge == len(sorted) {
+				if ok {
+					t.Fatalf("Seek(%s): unexpected key %s", probe, k)
+				}
+			} else if !ok || !bytes.Equal(k, sorted[ge]) || !bytes.Equal(v, sorted[ge]) {
+				t.Fatalf("Seek(%s): got %s, want %s", probe, k, sorted[ge])
+			}
+			for i := ge + 1; i < len(sorted) && i < ge+5; i++ {
+				if k, _, ok := it.Next(); !ok || !bytes.Equal(k, sorted[i]) {
+					t.Fatalf("Seek(%s)+Next: got %s, want %s", probe, k, sorted[i])
+				}
+			}
+
+			k, _, ok = it.SeekLT(probe)
+			if ge == 0 {
+				if ok {
+					t.Fatalf("SeekLT(%s): unexpected key %s", probe, k)
+				}
+			} else if !ok || !bytes.Equal(k, sorted[ge-1]) {
+				t.Fatalf("SeekLT(%s): got %s, want %s", probe, k, sorted[ge-1])
+			}
+			for i := ge - 2; i >= 0 && i > ge-6; i-- {
+				if k, _, ok := it.Prev(); !ok || !bytes.Equal(k, sorted[i]) {
+					t.Fatalf("SeekLT(%s)+Prev: got %s, want %s", probe, k, sorted[i])
+				}
+			}
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Seek on heap nodes.
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seek on persisted nodes.
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that seeking on a prefix-scan stays within the prefix.
+func TestRadixIterator_Seek_PrefixScan(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"aa", "ba", "bb", "bc", "bcd", "ca"} {
+			if err := r.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		it := r.PrefixScan([]byte("b"))
+		if k, _, ok := it.Seek([]byte("a")); !ok || string(k) != "ba" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.Seek([]byte("bbb")); !ok || string(k) != "bc" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.Next(); !ok || string(k) != "bcd" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.Seek([]byte("c")); ok {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.SeekLT([]byte("c")); !ok || string(k) != "bcd" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.SeekLT([]byte("bb")); !ok || string(k) != "ba" {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		if k, _, ok := it.SeekLT([]byte("b")); ok {
+			t.Fatalf("unexpected key: %s", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// radixIteratorModel mirrors the position of a RadixIterator on a sorted slice.
+// The position is an index into keys, where -1 is before the first and
+// len(keys) is after the last key. After LongestCommonPrefix, the iterator is
+// around the range keys[lo:hi].
+type radixIteratorModel struct {
+	keys   [][]byte
+	desc   bool // keys are sorted in descending order
+	pos    int
+	around bool
+	lo, hi int
+}
+
+func (m *radixIteratorModel) at() ([]byte, bool) {
+	if m.pos < 0 || m.pos >= len(m.keys) {
+		return nil, false
+	}
+	return m.keys[m.pos], true
+}
+
+func (m *radixIteratorModel) next() ([]byte, bool) {
+	if m.around {
+		m.around, m.pos = false, m.lo
+	} else if m.pos < len(m.keys) {
+		m.pos++
+	}
+	return m.at()
+}
+
+func (m *radixIteratorModel) prev() ([]byte, bool) {
+	if m.around {
+		m.around, m.pos = false, m.hi-1
+	} else if m.pos >= 0 {
+		m.pos--
+	}
+	return m.at()
+}
+
+func (m *radixIteratorModel) search(key []byte) int {
+	if m.desc {
+		return sort.Search(len(m.keys), func(i int) bool { return bytes.Compare(m.keys[i], key) <= 0 })
+	}
+	return sort.Search(len(m.keys), func(i int) bool { return bytes.Compare(m.keys[i], key) >= 0 })
+}
+
+func (m *radixIteratorModel) longestCommonPrefix(key []byte) []byte {
+	for l := len(key); l >= 0; l-- {
+		lo := m.search(key[:l])
+		hi := lo
+		for hi < len(m.keys) && bytes.HasPrefix(m.keys[hi], key[:l]) {
+			hi++
+		}
+		if lo < hi || l == 0 {
+			m.around, m.lo, m.hi = true, lo, hi
+			return key[:l]
+		}
+	}
+	panic("unreachable")
+}
+
+// testRadixIterator performs random operations on the iterator and compares
+// each result with the model.
+// LongestCommonPrefix is only tested if lcp is set, as it ignores the bounds of a range.
+func testRadixIterator(t *testing.T, it *bolt.RadixIterator, m *radixIteratorModel, lcp bool, seed int64) {
+	rand := rand.New(rand.NewSource(seed))
+	keys := m.keys
+	m.pos = -1
+	probes := radixTestKeys(50, seed)
+	var ops []string
+	for i := 0; i < 2000; i++ {
+		var k, v, want []byte
+		var ok, wantOK bool
+		probe := probes[rand.Intn(len(probes))]
+		switch op := rand.Intn(10); op {
+		case 0:
+			it.Reset()
+			m.pos, m.around = -1, false
+			ops = append(ops, "Reset")
+			continue
+		case 1:
+			it.Last()
+			m.pos, m.around = len(keys), false
+			ops = append(ops, "Last")
+			continue
+		case 2:
+			ops = append(ops, fmt.Sprintf("Seek(%s)", probe))
+			k, v, ok = it.Seek(probe)
+			m.pos, m.around = m.search(probe), false
+			want, wantOK = m.at()
+		case 3:
+			ops = append(ops, fmt.Sprintf("SeekLT(%s)", probe))
+			k, v, ok = it.SeekLT(probe)
+			m.pos, m.around = m.search(probe)-1, false
+			want, wantOK = m.at()
+		case 4:
+			if !lcp {
+				continue
+			}
+			ops = append(ops, fmt.Sprintf("LongestCommonPrefix(%s)", probe))
+			match, rest := it.LongestCommonPrefix(probe)
+			if want := m.longestCommonPrefix(probe); !bytes.Equal(match, want) || !bytes.Equal(rest, probe[len(want):]) {
+				t.Fatalf("%v: got match=%q rest=%q, want match=%q", ops, match, rest, want)
+			}
+			continue
+		case 5, 6, 7:
+			ops = append(ops, "Next")
+			k, v, ok = it.Next()
+			want, wantOK = m.next()
+		default:
+			ops = append(ops, "Prev")
+			k, v, ok = it.Prev()
+			want, wantOK = m.prev()
+		}
+		if ok != wantOK || !bytes.Equal(k, want) || (ok && !bytes.Equal(v, want)) {
+			t.Fatalf("%v: got %q,%v, want %q,%v", ops, k, ok, want, wantOK)
+		}
+		if len(ops) > 20 {
+			ops = ops[1:]
+		}
+	}
+}
+
+// Ensure that a radix iterator agrees with an in-memory radix tree under
+// arbitrary interleavings of Next, Prev, Seek and LongestCommonPrefix.
+func TestRadixIterator_Quick(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	oracle := radix.New()
+	keys := radixTestKeys(600, 3)
+	for i, k := range keys {
+		oracle.Insert(k, k)
+		if i%5 == 0 {
+			oracle.Delete(keys[i/2])
+		}
+	}
+
+	check := func(tx *bolt.Tx) {
+		r := tx.RadixBucket([]byte("radix"))
+		for i, prefix := range []string{"", "a", "ab", "xyz", "abcx", "q", "zzzzzzzz"} {
+			var scoped [][]byte
+			oracle.WalkPrefix([]byte(prefix), func(k []byte, _ interface{}) bool {
+				scoped = append(scoped, k)
+				return false
+			})
+			it := r.Iterator()
+			if prefix != "" {
+				it = r.PrefixScan([]byte(prefix))
+			}
+			testRadixIterator(t, it, &radixIteratorModel{keys: scoped}, true, int64(i))
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, k := range keys {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+			if i%5 == 0 {
+				if err := r.Delete(keys[i/2]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if n := oracle.Len(); n == 0 || n == len(keys) {
+			t.Fatalf("unexpected oracle size: %d", n)
+		}
+		// Iterate over heap nodes.
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Iterate over persisted nodes.
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that an iterator over an empty radix tree yields nothing.
+func TestRadixIterator_Empty(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range []*bolt.RadixIterator{r.Iterator(), r.PrefixScan([]byte("a"))} {
+			if k, _, ok := it.Next(); ok {
+				t.Fatalf("unexpected key: %s", k)
+			} else if k, _, ok := it.Prev(); ok {
+				t.Fatalf("unexpected key: %s", k)
+			} else if k, _, ok := it.Seek([]byte("a")); ok {
+				t.Fatalf("unexpected key: %s", k)
+			} else if k, _, ok := it.SeekLT([]byte("a")); ok {
+				t.Fatalf("unexpected key: %s", k)
+			} else if match, _ := it.LongestCommonPrefix([]byte("a")); len(match) != 0 {
+				t.Fatalf("unexpected match: %s", match)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a range-scan only yields the keys within its bounds.
+func TestRadixBucket_Range(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	keys := radixTestKeys(600, 4)
+	var sorted [][]byte
+	sorted = append(sorted, keys...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	ranges := [][2]string{
+		{"", ""}, {"a", ""}, {"", "b"}, {"ab", "ac"}, {"abc", "abcz"}, {"b", "yy"},
+		{"x", "x"}, {"q", "r"}, {"ac", "ab"}, {"yy", "b"}, {"z", "a"},
+	}
+	check := func(tx *bolt.Tx) {
+		r := tx.RadixBucket([]byte("radix"))
+		for i, rng := range ranges {
+			var start, end []byte
+			if rng[0] != "" {
+				start = []byte(rng[0])
+			}
+			if rng[1] != "" {
+				end = []byte(rng[1])
+			}
+			m := &radixIteratorModel{}
+			if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+				m.desc = true
+				for j := len(sorted) - 1; j >= 0; j-- {
+					if bytes.Compare(sorted[j], start) <= 0 && bytes.Compare(sorted[j], end) > 0 {
+						m.keys = append(m.keys, sorted[j])
+					}
+				}
+			} else {
+				for _, k := range sorted {
+					if (start == nil || bytes.Compare(k, start) >= 0) && (end == nil || bytes.Compare(k, end) < 0) {
+						m.keys = append(m.keys, k)
+					}
+				}
+			}
+
+			// A plain forward scan.
+			it := r.Range(start, end)
+			for j, want := range m.keys {
+				if k, _, ok := it.Next(); !ok || !bytes.Equal(k, want) {
+					t.Fatalf("Range(%q,%q)[%d]: got %q, want %q", start, end, j, k, want)
+				}
+			}
+			if k, _, ok := it.Next(); ok {
+				t.Fatalf("Range(%q,%q): unexpected key %q", start, end, k)
+			}
+
+			testRadixIterator(t, r.Range(start, end), m, false, int64(i))
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// radixTestVisitor records its calls and returns a fixed operation.
+type radixTestVisitor struct {
+	bolt.VisitorDefault
+	op    bolt.VisitOp
+	value []byte
+	full  bool
+	empty bool
+}
+
+func (v *radixTestVisitor) VisitFull(key, value []byte) bolt.VisitOp {
+	v.full, v.value = true, append([]byte(nil), value...)
+	return v.op
+}
+
+func (v *radixTestVisitor) VisitEmpty(key []byte) bolt.VisitOp {
+	v.empty = true
+	return v.op
+}
+
+// Ensure that a visitor can read, replace and delete radix tree records.
+func TestRadixBucket_Accept(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"foo", "foobar", "fox"} {
+			if err := r.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Visit an existing record.
+		v := &radixTestVisitor{}
+		if err := r.Accept([]byte("foo"), v, false); err != nil {
+			t.Fatal(err)
+		} else if !v.full || string(v.value) != "foo" {
+			t.Fatalf("unexpected visit: %v %q", v.full, v.value)
+		}
+
+		// Visit missing records, including one within a prefix.
+		for _, k := range []string{"fo", "foob", "zzz"} {
+			v := &radixTestVisitor{op: bolt.VisitOpSET_COPY([]byte("new-" + k))}
+			if err := r.Accept([]byte(k), v, true); err != nil {
+				t.Fatal(err)
+			} else if !v.empty {
+				t.Fatalf("%s: expected empty visit", k)
+			} else if got := r.Get([]byte(k)); string(got) != "new-"+k {
+				t.Fatalf("%s: unexpected value: %q", k, got)
+			}
+		}
+
+		// Replace and delete existing records.
+		if err := r.Accept([]byte("foobar"), &radixTestVisitor{op: bolt.VisitOpSET([]byte("xyz"))}, true); err != nil {
+			t.Fatal(err)
+		} else if got := r.Get([]byte("foobar")); string(got) != "xyz" {
+			t.Fatalf("unexpected value: %q", got)
+		}
+		if err := r.Accept([]byte("foo"), &radixTestVisitor{op: bolt.VisitOpDELETE()}, true); err != nil {
+			t.Fatal(err)
+		} else if got := r.Get([]byte("foo")); got != nil {
+			t.Fatalf("unexpected value: %q", got)
+		} else if got := r.Get([]byte("foobar")); string(got) != "xyz" {
+			t.Fatalf("unexpected value: %q", got)
+		}
+
+		// Deleting a missing record is a no-op.
+		if err := r.Accept([]byte("nope"), &radixTestVisitor{op: bolt.VisitOpDELETE()}, true); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write operations are rejected in read-only mode.
+		if err := r.Accept([]byte("fox"), &radixTestVisitor{op: bolt.VisitOpDELETE()}, false); err != bolt.ErrInvalidWriteAttempt {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := r.Get([]byte("fox")); string(got) != "fox" {
+			t.Fatalf("unexpected value: %q", got)
+		}
+
+		// Bucket creation is not supported.
+		if err := r.Accept([]byte("bkt"), &radixTestVisitor{op: bolt.VisitOpNEW_BUCKET()}, true); err != bolt.ErrUnsupportedVisitOp {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := r.Get([]byte("bkt")); got != nil {
+			t.Fatalf("unexpected value: %q", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var keys []string
+		it := tx.RadixBucket([]byte("radix")).Iterator()
+		for k, _, ok := it.Next(); ok; k, _, ok = it.Next() {
+			keys = append(keys, string(k))
+		}
+		if fmt.Sprint(keys) != "[fo foob foobar fox zzz]" {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		if err := tx.RadixBucket([]byte("radix")).Accept([]byte("fox"), &radixTestVisitor{}, true); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that buckets and radix trees can be nested inside a radix tree.
+func TestRadixBucket_Nested(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Put([]byte("tenant"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A small (inline) and a large bucket.
+		small, err := r.CreateBucket([]byte("tenant-a"))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := small.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		large, err := r.CreateBucket([]byte("tenant-b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := large.Put([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A radix tree, that holds a bucket itself.
+		sub, err := r.CreateRadixBucket([]byte("tenant-c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range radixTestKeys(200, 5) {
+			if err := sub.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b, err := sub.CreateBucket([]byte("deep")); err != nil {
+			t.Fatal(err)
+		} else if err := b.Put([]byte("foo"), []byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nested buckets are not values.
+		if _, err := r.CreateBucket([]byte("tenant-a")); err != bolt.ErrBucketExists {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := r.CreateBucket([]byte("tenant")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := r.CreateRadixBucket([]byte("tenant-a")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.Put([]byte("tenant-a"), []byte("x")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.Delete([]byte("tenant-a")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.DeleteBucket([]byte("tenant")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.DeleteBucket([]byte("tenant-x")); err != bolt.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		} else if v := r.Get([]byte("tenant-a")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if b, err := r.CreateBucketIfNotExists([]byte("tenant-a")); err != nil || b != small {
+			t.Fatalf("unexpected bucket: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		if v := r.Bucket([]byte("tenant-a")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := r.Bucket([]byte("tenant-b")).Get([]byte("0999")); string(v) != "value" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := r.RadixBucket([]byte("tenant-c")).Bucket([]byte("deep")).Get([]byte("foo")); string(v) != "baz" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if r.Bucket([]byte("tenant-c")) != nil || r.RadixBucket([]byte("tenant-a")) != nil || r.Bucket([]byte("tenant")) != nil {
+			t.Fatal("unexpected nested bucket")
+		}
+
+		var keys []string
+		it := r.Iterator()
+		for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+			keys = append(keys, fmt.Sprintf("%s=%s", k, v))
+		}
+		if fmt.Sprint(keys) != "[tenant=value tenant-a= tenant-b= tenant-c=]" {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the nested buckets in a later transaction.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		if err := r.Bucket([]byte("tenant-a")).Put([]byte("foo"), []byte("qux")); err != nil {
+			t.Fatal(err)
+		} else if err := r.RadixBucket([]byte("tenant-c")).Bucket([]byte("deep")).Put([]byte("foo"), []byte("quux")); err != nil {
+			t.Fatal(err)
+		} else if err := r.DeleteBucket([]byte("tenant-b")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		if v := r.Bucket([]byte("tenant-a")).Get([]byte("foo")); string(v) != "qux" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := r.RadixBucket([]byte("tenant-c")).Bucket([]byte("deep")).Get([]byte("foo")); string(v) != "quux" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if r.Bucket([]byte("tenant-b")) != nil {
+			t.Fatal("expected bucket to be deleted")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the radix tree releases all nested pages.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.RadixBucket([]byte("radix")).DeleteRadixBucket([]byte("tenant-c")); err != nil {
+			t.Fatal(err)
+		}
+		return tx.DeleteRadixBucket([]byte("radix"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that deleting a bucket releases the buckets nested in it's radix trees.
+func TestRadixBucket_Nested_DeleteParent(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := b.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := r.CreateRadixBucket([]byte("sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bkt, err := sub.CreateBucket([]byte("bkt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := bkt.Put([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that a radix tree can set, increment and persist it's sequence.
+func TestRadixBucket_Sequence(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := r.Sequence(); v != 0 {
+			t.Fatalf("unexpected sequence: %d", v)
+		} else if err := r.SetSequence(1000); err != nil {
+			t.Fatal(err)
+		} else if v, err := r.NextSequence(); err != nil || v != 1001 {
+			t.Fatalf("unexpected sequence: %d (%v)", v, err)
+		}
+
+		// Nested radix trees have their own sequence.
+		sub, err := r.CreateRadixBucket([]byte("sub"))
+		if err != nil {
+			t.Fatal(err)
+		} else if v, err := sub.NextSequence(); err != nil || v != 1 {
+			t.Fatalf("unexpected sequence: %d (%v)", v, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only change the sequence of the nested radix tree.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.RadixBucket([]byte("radix")).RadixBucket([]byte("sub")).NextSequence()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		if v := r.Sequence(); v != 1001 {
+			t.Fatalf("unexpected sequence: %d", v)
+		} else if v := r.RadixBucket([]byte("sub")).Sequence(); v != 2 {
+			t.Fatalf("unexpected sequence: %d", v)
+		} else if _, err := r.NextSequence(); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.SetSequence(0); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that a radix tree counts, ranks and selects keys.
+func TestRadixBucket_Count(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	keys := radixTestKeys(800, 5)
+	oracle := make(map[string]bool)
+
+	check := func(tx *bolt.Tx) {
+		r := tx.RadixBucket([]byte("radix"))
+		var sorted []string
+		for k := range oracle {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		if n := r.Len(); n != len(sorted) {
+			t.Fatalf("unexpected length: %d != %d", n, len(sorted))
+		}
+		for _, prefix := range []string{"", "a", "ab", "xyz", "abcx", "n", "nested", "nestedx", "q"} {
+			exp := 0
+			for _, k := range sorted {
+				if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+					exp++
+				}
+			}
+			if n := r.CountPrefix([]byte(prefix)); n != exp {
+				t.Fatalf("unexpected count of prefix %q: %d != %d", prefix, n, exp)
+			}
+		}
+		for i, k := range sorted {
+			key, value := r.KeyAt(i)
+			if string(key) != k {
+				t.Fatalf("unexpected key at %d: %q != %q", i, key, k)
+			} else if k == "nested" && value != nil {
+				t.Fatalf("unexpected value for nested bucket: %q", value)
+			} else if k != "nested" && string(value) != k {
+				t.Fatalf("unexpected value at %d: %q", i, value)
+			}
+			if n := r.Rank([]byte(k)); n != i {
+				t.Fatalf("unexpected rank of %q: %d != %d", k, n, i)
+			}
+		}
+		if key, _ := r.KeyAt(-1); key != nil {
+			t.Fatalf("unexpected key: %q", key)
+		} else if key, _ := r.KeyAt(len(sorted)); key != nil {
+			t.Fatalf("unexpected key: %q", key)
+		}
+		for _, k := range radixTestKeys(200, 6) {
+			exp := sort.SearchStrings(sorted, string(k))
+			if n := r.Rank(k); n != exp {
+				t.Fatalf("unexpected rank of %q: %d != %d", k, n, exp)
+			}
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(tx)
+		for i, k := range keys[:500] {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+			oracle[string(k)] = true
+			if i%3 == 0 {
+				if err := r.Delete(keys[i/2]); err != nil {
+					t.Fatal(err)
+				}
+				delete(oracle, string(keys[i/2]))
+			}
+		}
+		if _, err := r.CreateBucket([]byte("nested")); err != nil {
+			t.Fatal(err)
+		}
+		oracle["nested"] = true
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	// Modify the persisted tree.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		check(tx)
+		r := tx.RadixBucket([]byte("radix"))
+		for i, k := range keys[500:] {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+			oracle[string(k)] = true
+			if err := r.Delete(keys[i]); err != nil {
+				t.Fatal(err)
+			}
+			delete(oracle, string(keys[i]))
+		}
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a compacted radix tree keeps all of its keys, for every packing strategy.
+func TestRadixBucket_Compact(t *testing.T) {
+	for _, packing := range []bolt.RadixPacking{bolt.RadixPackGreedy, bolt.RadixPackSubtree, bolt.RadixPackBreadthFirst} {
+		t.Run(fmt.Sprint(packing), func(t *testing.T) {
+			db := MustOpenWithOption(&bolt.Options{RadixPacking: packing})
+			defer db.MustClose()
+
+			keys := radixTestKeys(2000, 7)
+			var sorted []string
+			for _, k := range keys {
+				sorted = append(sorted, string(k))
+			}
+			sort.Strings(sorted)
+
+			check := func(tx *bolt.Tx) {
+				r := tx.RadixBucket([]byte("radix"))
+				it := r.Iterator()
+				for i, k := range sorted {
+					key, value, ok := it.Next()
+					if !ok || string(key) != k || string(value) != k {
+						t.Fatalf("unexpected pair at %d: %q=%q (%v), expected %q", i, key, value, ok, k)
+					}
+				}
+				if _, _, ok := it.Next(); ok {
+					t.Fatal("unexpected pair after the last key")
+				} else if n := r.Len(); n != len(sorted) {
+					t.Fatalf("unexpected length: %d", n)
+				}
+			}
+
+			// Insert in many small transactions, in order to spread the tree.
+			for i := 0; i < len(keys); i += 100 {
+				if err := db.Update(func(tx *bolt.Tx) error {
+					r, err := tx.CreateRadixBucketIfNotExists([]byte("radix"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, k := range keys[i : i+100] {
+						if err := r.Put(k, k); err != nil {
+							t.Fatal(err)
+						}
+					}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.MustCheck()
+
+			if err := db.View(func(tx *bolt.Tx) error {
+				check(tx)
+				if err := tx.RadixBucket([]byte("radix")).Compact(); err != bolt.ErrTxNotWritable {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				r := tx.RadixBucket([]byte("radix"))
+				if err := r.Compact(); err != nil {
+					t.Fatal(err)
+				} else if stats := r.Stats(); stats.HeapNodeN != stats.NodeN {
+					t.Fatalf("unexpected HeapNodeN: %d != %d", stats.HeapNodeN, stats.NodeN)
+				}
+				check(tx)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			db.MustCheck()
+
+			if err := db.View(func(tx *bolt.Tx) error {
+				check(tx)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// radixLevenshtein computes the edit distance between a and b.
+func radixLevenshtein(a, b []byte) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := range a {
+		prev := row[0]
+		row[0] = i + 1
+		for j := range b {
+			cur := row[j+1]
+			cost := 1
+			if a[i] == b[j] {
+				cost = 0
+			}
+			row[j+1] = prev + cost
+			if row[j]+1 < row[j+1] {
+				row[j+1] = row[j] + 1
+			}
+			if cur+1 < row[j+1] {
+				row[j+1] = cur + 1
+			}
+			prev = cur
+		}
+	}
+	return row[len(b)]
+}
+
+// radixWildcardMatch reports whether key matches the pattern.
+func radixWildcardMatch(pattern, key []byte) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case '*':
+		return radixWildcardMatch(pattern[1:], key) || (len(key) != 0 && radixWildcardMatch(pattern, key[1:]))
+	case '?':
+		return len(key) != 0 && radixWildcardMatch(pattern[1:], key[1:])
+	}
+	return len(key) != 0 && key[0] == pattern[0] && radixWildcardMatch(pattern[1:], key[1:])
+}
+
+func testRadixMatchIterator(t *testing.T, it *bolt.RadixMatchIterator, sorted []string, match func(k []byte) bool) {
+	var exp []string
+	for _, k := range sorted {
+		if match([]byte(k)) {
+			exp = append(exp, k)
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		for _, k := range exp {
+			key, value, ok := it.Next()
+			if !ok || string(key) != k {
+				t.Fatalf("unexpected key: %q (%v), expected %q", key, ok, k)
+			} else if k == "nested" && value != nil {
+				t.Fatalf("unexpected value for nested bucket: %q", value)
+			} else if k != "nested" && string(value) != k {
+				t.Fatalf("unexpected value for %q: %q", k, value)
+			}
+		}
+		if key, _, ok := it.Next(); ok {
+			t.Fatalf("unexpected key: %q", key)
+		}
+		it.Reset()
+	}
+}
+
+// Ensure that fuzzy and wildcard searches yield the same keys as a scan.
+func TestRadixBucket_FuzzySearch_Match(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	keys := radixTestKeys(1000, 8)
+	sorted := []string{"nested"}
+	for _, k := range keys {
+		sorted = append(sorted, string(k))
+	}
+	sort.Strings(sorted)
+
+	check := func(tx *bolt.Tx) {
+		r := tx.RadixBucket([]byte("radix"))
+		for _, q := range []string{"", "a", "abc", "xyzzy", "nest", "nested", "cabbax", "q"} {
+			for edits := -1; edits <= 3; edits++ {
+				testRadixMatchIterator(t, r.FuzzySearch([]byte(q), edits), sorted, func(k []byte) bool {
+					return edits >= 0 && radixLevenshtein([]byte(q), k) <= edits
+				})
+			}
+		}
+		for _, p := range []string{"", "*", "a", "a*", "*a", "?", "??", "a?c*", "*x*y*", "**b?", "n*d", "nested", "x*z?", "q*"} {
+			testRadixMatchIterator(t, r.Match([]byte(p)), sorted, func(k []byte) bool {
+				return radixWildcardMatch([]byte(p), k)
+			})
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := r.CreateBucket([]byte("nested")); err != nil {
+			t.Fatal(err)
+		}
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// radixSliceIter returns an iterator over sorted keys, reusing its buffers.
+func radixSliceIter(keys []string, value func(k string) []byte) func() ([]byte, []byte, bool) {
+	var kbuf, vbuf []byte
+	return func() ([]byte, []byte, bool) {
+		if len(keys) == 0 {
+			return nil, nil, false
+		}
+		kbuf = append(kbuf[:0], keys[0]...)
+		vbuf = append(vbuf[:0], value(keys[0])...)
+		keys = keys[1:]
+		return kbuf, vbuf, true
+	}
+}
+
+// Ensure that a radix tree can be bulk loaded from sorted input.
+func TestRadixBucket_BulkLoad(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	big := bytes.Repeat([]byte("*"), 2*os.Getpagesize())
+	value := func(k string) []byte {
+		if len(k) == 2 && k[0] == 'c' {
+			return big
+		}
+		return []byte(k)
+	}
+	var sorted []string
+	for _, k := range radixTestKeys(5000, 9) {
+		sorted = append(sorted, string(k))
+	}
+	sort.Strings(sorted)
+
+	check := func(tx *bolt.Tx) {
+		r := tx.RadixBucket([]byte("radix"))
+		it := r.Iterator()
+		for _, k := range sorted {
+			key, v, ok := it.Next()
+			if !ok || string(key) != k || !bytes.Equal(v, value(k)) {
+				t.Fatalf("unexpected pair: %q (%v), expected %q", key, ok, k)
+			}
+		}
+		if key, v, ok := it.Next(); !ok || string(key) != "~" || string(v) != "put" {
+			t.Fatalf("unexpected pair: %q=%q (%v)", key, v, ok)
+		} else if _, _, ok := it.Next(); ok {
+			t.Fatal("unexpected pair after the last key")
+		} else if n := r.Len(); n != len(sorted)+1 {
+			t.Fatalf("unexpected length: %d", n)
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.BulkLoad(radixSliceIter(sorted, value)); err != nil {
+			t.Fatal(err)
+		}
+		// Most of the tree has been written already.
+		if stats := r.Stats(); stats.PageNodeN == 0 || stats.HeapNodeN*10 > stats.NodeN {
+			t.Fatalf("unexpected node placement: %d heap nodes, %d page-rooted, %d nodes", stats.HeapNodeN, stats.PageNodeN, stats.NodeN)
+		}
+		if err := r.Put([]byte("~"), []byte("put")); err != nil {
+			t.Fatal(err)
+		}
+		check(tx)
+		if err := r.BulkLoad(radixSliceIter([]string{"~~"}, value)); err != bolt.ErrBucketNotEmpty {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		if err := tx.RadixBucket([]byte("radix")).BulkLoad(radixSliceIter(nil, value)); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		keys []string
+		err  error
+	}{
+		{[]string{"a", "b", "ab"}, bolt.ErrKeysUnsorted},
+		{[]string{"ab", "a"}, bolt.ErrKeysUnsorted},
+		{[]string{"a", "ab", "ab"}, bolt.ErrDuplicateKey},
+		{[]string{"a", ""}, bolt.ErrKeyRequired},
+	} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			r, err := tx.CreateRadixBucket([]byte(fmt.Sprint(test.keys)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.BulkLoad(radixSliceIter(test.keys, value)); err != test.err {
+				t.Fatalf("unexpected error for %q: %v", test.keys, err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MustCheck()
+}
+
+// Ensure that buckets and radix trees can be converted into each other.
+func TestBucket_ConvertToRadix(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	keys := radixTestKeys(3000, 10)
+	check := func(tx *bolt.Tx, radix bool) {
+		n := 0
+		get := tx.Bucket([]byte("parent")).Get
+		if radix {
+			r := tx.Bucket([]byte("parent")).RadixBucket([]byte("child"))
+			if r == nil {
+				t.Fatal("expected radix tree")
+			} else if v := r.Sequence(); v != 42 {
+				t.Fatalf("unexpected sequence: %d", v)
+			}
+			get = r.Get
+			it := r.Iterator()
+			for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+				n++
+			}
+		} else {
+			b := tx.Bucket([]byte("parent")).Bucket([]byte("child"))
+			if b == nil {
+				t.Fatal("expected bucket")
+			} else if v := b.Sequence(); v != 42 {
+				t.Fatalf("unexpected sequence: %d", v)
+			}
+			get = b.Get
+			if err := b.ForEach(func(k, v []byte) error { n++; return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n != len(keys) {
+			t.Fatalf("unexpected number of keys: %d", n)
+		}
+		for _, k := range keys {
+			if v := get(k); !bytes.Equal(v, k) {
+				t.Fatalf("unexpected value for %q: %q", k, v)
+			}
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		parent, err := tx.CreateBucket([]byte("parent"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parent.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := b.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b.SetSequence(42)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Convert in the same transaction, the data was written in.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		parent := tx.Bucket([]byte("parent"))
+		if _, err := parent.ConvertToRadix([]byte("child")); err != nil {
+			t.Fatal(err)
+		}
+		check(tx, true)
+		if _, err := parent.ConvertToRadix([]byte("child")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx, true)
+		if _, err := tx.Bucket([]byte("parent")).ConvertToBucket([]byte("child")); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		parent := tx.Bucket([]byte("parent"))
+		if _, err := parent.ConvertToBucket([]byte("child")); err != nil {
+			t.Fatal(err)
+		}
+		check(tx, false)
+		if _, err := parent.ConvertToBucket([]byte("child")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := parent.ConvertToBucket([]byte("missing")); err != bolt.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx, false)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Back and forth within a single transaction.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		parent := tx.Bucket([]byte("parent"))
+		if _, err := parent.ConvertToRadix([]byte("child")); err != nil {
+			t.Fatal(err)
+		} else if _, err := parent.ConvertToBucket([]byte("child")); err != nil {
+			t.Fatal(err)
+		}
+		check(tx, false)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that nested buckets and empty values prevent a conversion.
+func TestBucket_ConvertToRadix_Incompatible(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("bucket"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		} else if _, err := b.CreateRadixBucket([]byte("rad")); err != nil {
+			t.Fatal(err)
+		} else if err := b.Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.ConvertToRadix([]byte("bucket"))
+		if err, ok := err.(*bolt.NestedBucketError); !ok {
+			t.Fatalf("unexpected error: %v", err)
+		} else if fmt.Sprintf("%q", err.Keys) != `["rad" "sub"]` {
+			t.Fatalf("unexpected keys: %q", err.Keys)
+		}
+
+		e, err := tx.CreateBucket([]byte("empty"))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := e.Put([]byte("key"), nil); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.ConvertToRadix([]byte("empty")); err != bolt.ErrValueRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := r.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.ConvertToBucket([]byte("radix"))
+		if err, ok := err.(*bolt.NestedBucketError); !ok || len(err.Keys) != 1 || string(err.Keys[0]) != "sub" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	// Nothing has been modified.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("bucket")).Get([]byte("key")); string(v) != "value" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if tx.RadixBucket([]byte("radix")).Bucket([]byte("sub")) == nil {
+			t.Fatal("expected nested bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
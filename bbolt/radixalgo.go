@@ -60,35 +60,107 @@ func (r *radixAccess) mergeChildNode(parent *radixNode) {
 	*parent = *m
 }
 
+// dereference removes all references to the old mmap.
+func (r *radixAccess) dereference() {
+	if r.head!=nil { r.head.dereference() }
+}
+
 /*
 SECTION: Radix Trie insertion, deletion and lookup
 */
 
-func (r *radixAccess) insert(key,value []byte) {
+func (r *radixAccess) setLeaf(m *radixNode,value []byte,flags uint8) {
+	if m.leafEx_v!=0 && !m.leafEx_v.inlined() {
+		r.tx.db.freelist.free(r.tx.meta.txid,r.tx.page(pgid(m.leafEx_v.offset())))
+	}
+	m.leafEx_v = 0
+	m.leafEx_p = nil
+	m.leafIn = value
+	m.leafFlags = flags
+}
+/*
+Removes the leaf of m, where m is a child of parent.
+*/
+func (r *radixAccess) delLeaf(parent,m *radixNode) {
+	r.setLeaf(m,nil,0)
+	switch m.n_edges {
+	case 0:
+		parent.del(m.prefix[0])
+		// The root node must never carry a prefix, so it is never merged.
+		if parent!=r.head && !parent.hasLeaf() && parent.n_edges==1 {
+			r.mergeChildNode(parent)
+		}
+	case 1:
+		r.mergeChildNode(m)
+	}
+}
+
+/*
+Locates the record for key and lets f decide, what to do with it.
+f is called with the current value and it's flags or with nil, if there is no such record.
+Only VisitOpSET(_COPY) and VisitOpDELETE are applied, every other operation is ignored.
+
+A record is written with the given flags. Existing records may only be replaced or
+deleted, if their flags are equal to the given flags, otherwise ErrIncompatibleValue
+is returned.
+
+The counts of all nodes along the path are invalidated, if the tree is modified.
+*/
+func (r *radixAccess) insert(key []byte,flags uint8,f func(old []byte,flags uint8) VisitOp) error {
 	r.decodeRoot()
+	var up *radixNode
 	parent := r.head
+	path := []*radixNode{parent}
+	dirty := false
+	defer func() {
+		if !dirty { return }
+		for _,n := range path { n.flags &^= radixf_counted }
+	}()
 	for {
 		if len(key)==0 {
-			if parent.leafEx_v!=0 && !parent.leafEx_v.inlined() {
-				r.tx.db.freelist.free(r.tx.meta.txid,r.tx.page(pgid(parent.leafEx_v.offset())))
+			// Key exthausted: parent is the node of the key.
+			var old []byte
+			if parent.hasLeaf() { old = radixAddr{t:r.tx,p:parent}.leaf() }
+			op := f(old,parent.leafFlags)
+			if old!=nil && parent.leafFlags!=flags && (op.set() || op.del()) {
+				return ErrIncompatibleValue
+			}
+			switch {
+			case op.set():
+				if len(op.buf)==0 { return ErrValueRequired }
+				r.setLeaf(parent,op.getBuf(),flags)
+				dirty = true
+			case op.del():
+				if old!=nil && up!=nil { r.delLeaf(up,parent); dirty = true }
 			}
-			parent.leafIn = value
+			return nil
 		}
 		i,ok := radixBinSearch(&parent.edges_k,int(parent.n_edges),key[0])
 		if !ok {
+			op := f(nil,0)
+			if !op.set() { return nil }
+			if len(op.buf)==0 { return ErrValueRequired }
+			dirty = true
 			i,_ = parent.insert(key[0])
 			parent.edges_v[i] = 0
 			parent.edges_p[i] = &radixNode{
 				prefix: cloneBytes(key),
-				leafIn: value,
+				leafIn: op.getBuf(),
+				leafFlags: flags,
 			}
 			
-			return
+			return nil
 		}
 		r.decodeChild2(parent.edges_v[i],&parent.edges_p[i])
 		m := parent.edges_p[i]
 		l := radixLongestPrefix(m.prefix,key)
 		if l<len(m.prefix) {
+			// The key diverges from (or ends within) the prefix.
+			op := f(nil,0)
+			if !op.set() { return nil }
+			if len(op.buf)==0 { return ErrValueRequired }
+			value := op.getBuf()
+			dirty = true
 			n := new(radixNode)
 			*n = *m
 			*m = radixNode{}
@@ -102,60 +174,28 @@ func (r *radixAccess) insert(key,value []byte) {
 				o := &radixNode{
 					prefix: cloneBytes(key[l:]),
 					leafIn: value,
+					leafFlags: flags,
 				}
 				i,_ := m.insert(key[l])
 				m.edges_p[i] = o
 				m.edges_v[i] = 0
 			} else {
 				m.leafIn = value
+				m.leafFlags = flags
 			}
-			return
+			return nil
 		}
 		key = key[l:]
+		up = parent
 		parent = m
+		path = append(path,m)
 	}
 }
-func (r *radixAccess) del(key []byte) {
-	r.decodeRoot()
-	parent := r.head
-	for {
-		// Key exthausted
-		if len(key)==0 {
-			panic("should not get here!")
-		}
-		i,ok := radixBinSearch(&parent.edges_k,int(parent.n_edges),key[0])
-		if !ok {
-			// Nothing to delete.
-			return
-		}
-		r.decodeChild2(parent.edges_v[i],&parent.edges_p[i])
-		m := parent.edges_p[i]
-		l := radixLongestPrefix(m.prefix,key)
-		if l==len(key) {
-			if l==len(m.prefix) {
-				// key == m.prefix
-				// That means, we found it.
-				if m.leafEx_v!=0 && !m.leafEx_v.inlined() {
-					r.tx.db.freelist.free(r.tx.meta.txid,r.tx.page(pgid(m.leafEx_v.offset())))
-					m.leafEx_v = 0
-				}
-				m.leafIn = nil
-				m.leafEx_p = nil
-				switch m.n_edges {
-				case 0:
-					parent.del(key[0])
-					if (!parent.hasLeaf()) && (len(parent.edges_k)==1) {
-						r.mergeChildNode(parent)
-					}
-				case 1:
-					r.mergeChildNode(m)
-				}
-				return
-			}
-		}
-		key = key[l:]
-		parent = m
-	}
+func (r *radixAccess) put(key,value []byte,flags uint8) error {
+	return r.insert(key,flags,func(old []byte,_ uint8) VisitOp { return VisitOpSET(value) })
+}
+func (r *radixAccess) del(key []byte,flags uint8) error {
+	return r.insert(key,flags,func(old []byte,_ uint8) VisitOp { return VisitOpDELETE() })
 }
 
 func (r *radixAccess) get(key []byte) (result radixAddr) {
@@ -193,7 +233,7 @@ func (r *radixAccess) getLongestPrefix(key []byte) (prefix,value []byte) {
 			break
 		}
 		parent = m
-		if buf := m.leaf(); len(buf)!=0 { value = buf }
+		if buf := m.leaf(); len(buf)!=0 && m.leafFlags()==0 { value = buf }
 	}
 	prefix = prefix[:len(prefix)-len(key)]
 	return
@@ -203,31 +243,81 @@ func (r *radixAccess) getLongestPrefix(key []byte) (prefix,value []byte) {
 /*
 SECTION: Erase tree.
 */
-func (r *radixAccess) erase() {
+// erase frees all pages of the tree. fn is called for every leaf, the flags
+// tell nested buckets apart from values.
+func (r *radixAccess) erase(fn func(key,value []byte,flags uint8)) {
 	parent := radixAddr{t:r.tx,p:r.head,v:radixPageID(r.root)}
-	r.erase_recur(parent)
+	r.erase_recur(parent,radixSlice{slice:new([]byte)},fn)
 	r.head = new(radixNode)
 	r.root = 0
 }
 // Per-Node code, traversing the tree.
-func (r *radixAccess) erase_recur(a radixAddr) {
+func (r *radixAccess) erase_recur(a radixAddr,key radixSlice,fn func(key,value []byte,flags uint8)) {
 	if a.isNil() { return }
 	
+	if leaf := a.leaf(); len(leaf)!=0 && fn!=nil {
+		fn(key.bytes(),leaf,a.leafFlags())
+	}
 	for i,n := 0,a.n_edges(); i<n; i++ {
-		r.erase_recur(a.edge(i))
+		edge := a.edge(i)
+		r.erase_recur(edge,key.appnd(edge.prefix()),fn)
 	}
+	r.erase_recur(a.leafEx(),key,nil)
 	
 	if a.p==nil && a.v.isPage() {
 		r.tx.db.freelist.free(r.tx.meta.txid,r.tx.page(pgid(a.v.offset())))
 	}
 }
 
+/*
+SECTION: Relocation.
+*/
+// relocate decodes every node stored at or beyond the page limit, together
+// with it's ancestors, so that it is written to a new page by persist().
+// Values stored in pages of their own are moved into their node.
+func (r *radixAccess) relocate(limit pgid) {
+	if r.head==nil {
+		if !r.hasTail(radixAddr{t:r.tx,v:radixPageID(r.root)},limit) { return }
+		r.decodeRoot()
+	}
+	r.relocate_recur(r.head,limit)
+}
+func (r *radixAccess) relocate_recur(m *radixNode,limit pgid) {
+	if m.leafEx_p==nil && m.leafEx_v.isPage() && r.isTail(pgid(m.leafEx_v.offset()),limit) {
+		r.setLeaf(m,cloneBytes(radixAddr{t:r.tx,p:m}.leaf()),m.leafFlags)
+	}
+	for i,n := 0,int(m.n_edges); i<n; i++ {
+		if m.edges_p[i]==nil {
+			if !m.edges_v[i].isPage() || !r.hasTail(radixAddr{t:r.tx,v:m.edges_v[i]},limit) { continue }
+			r.decodeChild2(m.edges_v[i],&m.edges_p[i])
+		}
+		r.relocate_recur(m.edges_p[i],limit)
+	}
+}
+// hasTail reports, whether any node of the subtree is stored at or beyond limit.
+func (r *radixAccess) hasTail(a radixAddr,limit pgid) bool {
+	if a.isNil() { return false }
+	if a.p==nil && a.v.isPage() && r.isTail(pgid(a.v.offset()),limit) { return true }
+	for i,n := 0,a.n_edges(); i<n; i++ {
+		if r.hasTail(a.edge(i),limit) { return true }
+	}
+	return r.hasTail(a.leafEx(),limit)
+}
+func (r *radixAccess) isTail(id,limit pgid) bool {
+	return id+pgid(r.tx.page(id).overflow) >= limit
+}
+
 /*
 SECTION: Persisting the tree.
 */
 
 func (r *radixAccess) persist() (err error) {
 	if r.head==nil { return }
+	// Compute the counts of all modified nodes, so that node.write() can store them.
+	radixAddr{t:r.tx,p:r.head}.count()
+	if r.packing()==RadixPackSubtree {
+		r.persist_partition(r.head,r.tx.db.pageSize-r.tx.db.pageReserve())
+	}
 	err = r.persist_walk(r.head)
 	if err!=nil { return }
 	var rid radixID
@@ -240,14 +330,14 @@ func (r *radixAccess) persist() (err error) {
 
 func (r *radixAccess) persist_n_pages(node *radixNode) int {
 	pgsz := r.tx.db.pageSize
-	off := (pgsz-1)+pageHeaderSize
+	off := (pgsz-1)+r.tx.db.pageReserve()
 	
 	return (off+node.size())/pgsz
 }
 
 func (r *radixAccess) persist_externalize_leaf(node *radixNode) int {
 	pgsz := r.tx.db.pageSize
-	off := (pgsz-1)+pageHeaderSize
+	off := (pgsz-1)+r.tx.db.pageReserve()
 	
 	sz_1 := (off+node.size())/pgsz
 	sz_2 := (off+node.size_without_leafIn())/pgsz
@@ -270,13 +360,13 @@ func (r *radixAccess) persist_walk(node *radixNode) (err error) {
 		// within the persist_pack() function, because this can lead
 		// to tighter page-packing, which is desireable.
 		count := r.persist_n_pages(node)
-		sz := (r.tx.db.pageSize*count)-pageHeaderSize
+		sz := (r.tx.db.pageSize*count)-r.tx.db.pageReserve()
 		
 		// Subtract the page's root node's size from the space available.
 		sz -= node.size()
 		
 		// Traverse the root subtree.
-		r.persist_pack(node,&sz)
+		r.persist_pack_dispatch(node,&sz)
 	}
 	if node.leafEx_p!=nil {
 		_,err = r.persist_writeHead(&node.leafEx_p,&node.leafEx_v)
@@ -326,7 +416,7 @@ ALGO: Write a node + all inlined children into a page.
 */
 func (r *radixAccess) persist_writeHead(pnode **radixNode,prid *radixID) (pgid,error) {
 	pgsz := r.tx.db.pageSize
-	size := (*pnode).size()+pageHeaderSize
+	size := r.persist_size(*pnode)+r.tx.db.pageReserve()
 	pag,err := r.tx.allocate((size+pgsz-1)/pgsz)
 	if err!=nil { return 0,err }
 	pag.flags = radixPageFlag
@@ -334,6 +424,16 @@ func (r *radixAccess) persist_writeHead(pnode **radixNode,prid *radixID) (pgid,e
 	*prid = radixPageID(pag.id)
 	return pag.id,nil
 }
+// persist_size returns the number of bytes, a node and all it's inlined children occupy.
+func (r *radixAccess) persist_size(node *radixNode) (size int) {
+	size = node.size()
+	for i,n := 0,int(node.n_edges); i<n; i++ {
+		if node.edges_p[i]==nil { continue }
+		if (node.edges_p[i].flags&radixf_inlined)==0 { continue }
+		size += r.persist_size(node.edges_p[i])
+	}
+	return
+}
 func (r *radixAccess) persist_write(pag []byte,off *int,pnode **radixNode,prid *radixID) {
 	node := *pnode
 	
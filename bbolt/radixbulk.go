@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+import (
+	"bytes"
+)
+
+/*
+Bulk loading.
+
+As the keys arrive in ascending order, only the rightmost path of the tree is
+ever modified. Every node left of that path is complete and gets sealed: it is
+partitioned (see persist_partition) and all children, that are cut off, are
+written to their pages right away. Only the remainders, which fit into a single
+page each, stay in memory, until the tree is persisted on commit.
+*/
+type radixBulk struct{
+	acc      *radixAccess
+	capacity int
+	stack    []*radixNode // the rightmost path
+	depth    []int        // the length of the key at each node of the stack
+	prev     []byte
+}
+
+func (b *radixBulk) seal(node *radixNode) error {
+	r := b.acc
+	radixAddr{t:r.tx,p:node}.count()
+	for _,i := range r.persist_cut(node,b.capacity) {
+		if err := r.persist_walk(node.edges_p[i]); err!=nil { return err }
+		if _,err := r.persist_writeHead(&node.edges_p[i],&node.edges_v[i]); err!=nil { return err }
+	}
+	return nil
+}
+
+func (b *radixBulk) add(key,value []byte) error {
+	if len(key)==0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if len(value)==0 {
+		return ErrValueRequired
+	} else if int64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if b.prev!=nil {
+		switch bytes.Compare(b.prev,key) {
+		case 0: return ErrDuplicateKey
+		case 1: return ErrKeysUnsorted
+		}
+	}
+	// The counts of the rightmost path are about to change.
+	for _,n := range b.stack { n.flags &^= radixf_counted }
+	
+	// As key is greater than prev, it diverges at l or prev is a prefix of key.
+	// Both are copied before sealing, which may remap the database.
+	l := radixLongestPrefix(b.prev,key)
+	o := &radixNode{prefix:cloneBytes(key[l:]),leafIn:cloneBytes(value)}
+	b.prev = append(b.prev[:0],key...)
+	for n := len(b.stack); b.depth[n-1]>l; n = len(b.stack) {
+		top := b.stack[n-1]
+		if b.depth[n-2]<l {
+			// key diverges within the prefix of top: split it.
+			parent := b.stack[n-2]
+			m := &radixNode{prefix:top.prefix[:l-b.depth[n-2]]}
+			top.prefix = top.prefix[l-b.depth[n-2]:]
+			i,_ := m.insert(top.prefix[0])
+			m.edges_p[i] = top
+			parent.edges_p[parent.n_edges-1] = m
+			if err := b.seal(top); err!=nil { return err }
+			b.stack[n-1],b.depth[n-1] = m,l
+			continue
+		}
+		if err := b.seal(top); err!=nil { return err }
+		b.stack,b.depth = b.stack[:n-1],b.depth[:n-1]
+	}
+	
+	top := b.stack[len(b.stack)-1]
+	i,_ := top.insert(o.prefix[0])
+	top.edges_p[i] = o
+	b.stack = append(b.stack,o)
+	b.depth = append(b.depth,len(b.prev))
+	return nil
+}
+
+// BulkLoad fills an empty radix tree with the key-value pairs, returned by iter,
+// until iter returns ok=false. The keys must be in strictly ascending order,
+// otherwise ErrKeysUnsorted or ErrDuplicateKey is returned.
+//
+// The tree is built bottom-up, pages are written as soon as the subtrees are
+// complete and tightly packed, regardless of DB.RadixPacking. The slices returned
+// by iter are copied, so they may be reused by it, once iter is called again.
+// As writing pages may remap the database, iter must not be backed by a Cursor
+// of the same database.
+//
+// Returns ErrBucketNotEmpty, if the radix tree holds any keys. If an error is
+// returned, the tree holds the key-value pairs loaded so far.
+func (r *RadixBucket) BulkLoad(iter func() (k,v []byte,ok bool)) (err error) {
+	defer r.acc.tx.recoverError(&err)
+	if r.acc.tx.db==nil {
+		return ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return ErrTxNotWritable
+	} else if r.acc.rootAddr().count()!=0 {
+		return ErrBucketNotEmpty
+	}
+	r.acc.decodeRoot()
+	r.acc.head = new(radixNode)
+	
+	b := &radixBulk{
+		acc: &r.acc,
+		capacity: r.acc.tx.db.pageSize-r.acc.tx.db.pageReserve(),
+		stack: []*radixNode{r.acc.head},
+		depth: []int{0},
+	}
+	for {
+		k,v,ok := iter()
+		if !ok { break }
+		if err = b.add(k,v); err!=nil { break }
+		r.recordPut(k,nil,v)
+	}
+	
+	// Seal the rightmost path. The remainder of the root is persisted on commit.
+	for i := len(b.stack)-1; i>=0; i-- {
+		if serr := b.seal(b.stack[i]); serr!=nil && err==nil { err = serr }
+	}
+	return err
+}
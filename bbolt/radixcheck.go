@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+SECTION: Consistency checks of radix trees.
+
+The checker walks the tree in the same way as radixAddr does, but it never trusts
+the on-disk representation: every node header is bounds-checked against the
+page (including it's overflow pages) before it is decoded.
+
+Every node returns the number of keys in it's subtree, which is compared against
+the stored count of the node. ok is false, if the subtree was not fully verified,
+in which case no count is compared.
+*/
+
+type radixChecker struct{
+	tx        *Tx
+	bkt       *RadixBucket
+	reachable map[pgid]*page
+	freed     map[pgid]bool
+	ch        chan error
+}
+
+// check verifies a radix tree and it's nested buckets. Heap nodes (dirty nodes
+// of a writable transaction) are traversed, all SLS nodes are verified.
+func (c *radixChecker) check(rad *RadixBucket) {
+	c.bkt = rad
+	key := radixSlice{slice:new([]byte)}
+	if rad.acc.head!=nil {
+		c.checkHeap(rad.acc.head,true,0,key)
+		return
+	}
+	c.checkPage(rad.acc.root,true,0,key)
+}
+
+// checkNested verifies a nested bucket or radix tree.
+func (c *radixChecker) checkNested(key,value []byte,flags uint8) {
+	switch flags {
+	case bucketLeafFlag:
+		child := c.bkt.buckets[string(key)]
+		if child==nil {
+			if len(value)<bucketHeaderSize {
+				c.ch <- fmt.Errorf("radix: nested bucket %q: invalid header: %x",key,value)
+				return
+			}
+			child = (&Bucket{tx:c.tx}).openBucket(value)
+		}
+		c.tx.checkBucket(child,c.reachable,c.freed,c.ch)
+	case radixLeafFlag:
+		rad := c.bkt.radixes[string(key)]
+		if rad==nil {
+			if rad = openRadixBucket(c.tx,value); rad==nil {
+				c.ch <- fmt.Errorf("radix: nested radix tree %q: invalid header: %x",key,value)
+				return
+			}
+		}
+		rc := radixChecker{tx:c.tx,reachable:c.reachable,freed:c.freed,ch:c.ch}
+		rc.check(rad)
+	default:
+		c.ch <- fmt.Errorf("radix: key %q: invalid leaf flags: %x",key,flags)
+	}
+}
+
+func (c *radixChecker) checkHeap(n *radixNode,root bool,ek byte,key radixSlice) (count uint64,ok bool) {
+	if n.n_edges>256 {
+		c.ch <- fmt.Errorf("radix heap node: invalid edge count: %d",n.n_edges)
+		return
+	}
+	ok = true
+	if n.edge_nonsorted() || n.edge_collision() {
+		c.ch <- fmt.Errorf("radix heap node: unsorted edges: %x",n.edge_keys())
+	}
+	if root && len(n.prefix)!=0 {
+		c.ch <- fmt.Errorf("radix heap node: root has prefix: %x",n.prefix)
+	} else if !root && (len(n.prefix)==0 || n.prefix[0]!=ek) {
+		c.ch <- fmt.Errorf("radix heap node: prefix %x does not match edge %02x",n.prefix,ek)
+	}
+	if !root { key = key.appnd(n.prefix) }
+	leafOK := true
+	if n.leafEx_p==nil && n.leafEx_v!=0 {
+		leafOK = c.checkLeafRef(n.leafEx_v)!=nil
+	}
+	if n.leafFlags!=0 && leafOK {
+		c.checkNested(key.bytes(),radixAddr{t:c.tx,p:n}.leaf(),n.leafFlags)
+	}
+	ok = ok && leafOK
+	if n.hasLeaf() { count++ }
+	for i,l := 0,int(n.n_edges); i<l; i++ {
+		var sub uint64
+		var subOK bool
+		switch {
+		case n.edges_p[i]!=nil:
+			sub,subOK = c.checkHeap(n.edges_p[i],false,n.edges_k[i],key)
+		case n.edges_v[i].isPage():
+			sub,subOK = c.checkPage(pgid(n.edges_v[i].offset()),false,n.edges_k[i],key)
+		default:
+			c.ch <- fmt.Errorf("radix heap node: edge %02x: invalid reference: %x",n.edges_k[i],uint64(n.edges_v[i]))
+		}
+		count += sub
+		ok = ok && subOK
+	}
+	if ok && (n.flags&radixf_counted)!=0 && n.count!=count {
+		c.ch <- fmt.Errorf("radix heap node: count %d does not match %d keys",n.count,count)
+	}
+	return
+}
+
+// visit performs the checks, every referenced page is subject to.
+// It returns nil, if the page must not be traversed any further.
+func (c *radixChecker) visit(id pgid) *page {
+	if id<=1 || id>=c.tx.meta.pgid {
+		c.ch <- fmt.Errorf("page %d: radix: out of bounds: %d",int(id),int(c.tx.meta.pgid))
+		return nil
+	}
+	if !c.tx.checkPage(id,c.ch) { return nil }
+	p := c.tx.page(id)
+	if p.id!=id {
+		c.ch <- fmt.Errorf("page %d: radix: page id mismatch: %d",int(id),int(p.id))
+		return nil
+	}
+	if id+pgid(p.overflow)>=c.tx.meta.pgid {
+		c.ch <- fmt.Errorf("page %d: radix: overflow out of bounds: %d",int(id),int(p.overflow))
+		return nil
+	}
+
+	// Ensure each page is only referenced once.
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		if _, ok := c.reachable[id+i]; ok {
+			c.ch <- fmt.Errorf("page %d: multiple references", int(id+i))
+			return nil
+		}
+		c.reachable[id+i] = p
+	}
+
+	if c.freed[id] {
+		c.ch <- fmt.Errorf("page %d: reachable freed", int(id))
+	}
+	if (p.flags&radixPageFlag)==0 {
+		c.ch <- fmt.Errorf("page %d: invalid type: %s", int(id), p.typ())
+		return nil
+	}
+	return p
+}
+
+func (c *radixChecker) checkPage(id pgid,root bool,ek byte,key radixSlice) (uint64,bool) {
+	p := c.visit(id)
+	if p==nil { return 0,false }
+	buf := radixPageBuffer(p)[:(int(p.overflow)+1)*c.tx.db.pageSize-c.tx.db.pageReserve()]
+	return c.checkNode(p,buf,0,root,ek,key)
+}
+
+// checkLeafRef verifies an external leaf and returns it's value, or nil if it is invalid.
+func (c *radixChecker) checkLeafRef(v radixID) []byte {
+	if !v.isPage() {
+		c.ch <- fmt.Errorf("radix: external leaf is not a page reference: %x",uint64(v))
+		return nil
+	}
+	p := c.visit(pgid(v.offset()))
+	if p==nil { return nil }
+	buf := radixPageBuffer(p)[:(int(p.overflow)+1)*c.tx.db.pageSize-c.tx.db.pageReserve()]
+	leafEx,ne,pxl,lfil,hsz,flags,ok := c.header(p,buf,0)
+	if !ok { return nil }
+	if leafEx!=0 || ne!=0 || pxl!=0 || lfil==0 || flags!=0 {
+		c.ch <- fmt.Errorf("page %d: radix: malformed external leaf: edges=%d prefix=%d leafEx=%x leafIn=%d",int(p.id),ne,pxl,uint64(leafEx),lfil)
+		return nil
+	}
+	return buf[hsz:][:lfil]
+}
+
+// header decodes and bounds-checks the header of the node, located at off.
+// hsz is the size of the header, including the count of counted nodes.
+func (c *radixChecker) header(p *page,buf []byte,off int) (leafEx radixID,ne,pxl,lfil,hsz int,flags uint8,ok bool) {
+	if off+16>len(buf) {
+		c.ch <- fmt.Errorf("page %d: radix node %d: header exceeds page bounds",int(p.id),off)
+		return
+	}
+	leafEx = *(*radixID)(unsafe.Pointer(&buf[off]))
+	ne,pxl,lfil,hsz = radixNodeHeader(buf[off:])
+	flags = uint8(*(*uint32)(unsafe.Pointer(&buf[off+8]))>>30)
+	if ne>256 {
+		c.ch <- fmt.Errorf("page %d: radix node %d: invalid edge count: %d",int(p.id),off,ne)
+		return
+	}
+	if off+hsz+(ne*9)+pxl+lfil>len(buf) {
+		c.ch <- fmt.Errorf("page %d: radix node %d: node exceeds page bounds",int(p.id),off)
+		return
+	}
+	ok = true
+	return
+}
+
+func (c *radixChecker) checkNode(p *page,buf []byte,off int,root bool,ek byte,key radixSlice) (count uint64,ok bool) {
+	leafEx,ne,pxl,lfil,hsz,flags,ok := c.header(p,buf,off)
+	if !ok { return }
+
+	edges_v := (*[256]radixID)(unsafe.Pointer(&buf[off+hsz]))[:ne]
+	edges_k := buf[off+hsz+(ne*8):][:ne]
+	prefix := buf[off+hsz+(ne*9):][:pxl]
+
+	if root && pxl!=0 {
+		c.ch <- fmt.Errorf("page %d: radix node %d: root has prefix: %x",int(p.id),off,prefix)
+	} else if !root && (pxl==0 || prefix[0]!=ek) {
+		c.ch <- fmt.Errorf("page %d: radix node %d: prefix %x does not match edge %02x",int(p.id),off,prefix,ek)
+	}
+	for i := 1; i<ne; i++ {
+		if edges_k[i-1]>=edges_k[i] {
+			c.ch <- fmt.Errorf("page %d: radix node %d: unsorted edges: %x",int(p.id),off,edges_k)
+			break
+		}
+	}
+	key = key.appnd(prefix)
+	leaf := buf[off+hsz+(ne*9)+pxl:][:lfil]
+	if leafEx!=0 {
+		if leaf = c.checkLeafRef(leafEx); leaf==nil { flags = 0; ok = false }
+	}
+	if flags!=0 {
+		c.checkNested(key.bytes(),leaf,flags)
+	}
+	if len(leaf)!=0 { count++ }
+	for i,v := range edges_v {
+		var sub uint64
+		subOK := false
+		switch {
+		case v==0:
+			c.ch <- fmt.Errorf("page %d: radix node %d: edge %02x: nil reference",int(p.id),off,edges_k[i])
+		case v.isPage():
+			sub,subOK = c.checkPage(pgid(v.offset()),false,edges_k[i],key)
+		case v.inlined():
+			// Inlined children are always written behind their parent.
+			// This also rules out cycles within a page.
+			noff := int(v.offset()<<3)
+			if noff<=off {
+				c.ch <- fmt.Errorf("page %d: radix node %d: edge %02x: inline offset %d does not follow parent",int(p.id),off,edges_k[i],noff)
+				break
+			}
+			sub,subOK = c.checkNode(p,buf,noff,false,edges_k[i],key)
+		default:
+			c.ch <- fmt.Errorf("page %d: radix node %d: edge %02x: invalid reference: %x",int(p.id),off,edges_k[i],uint64(v))
+		}
+		count += sub
+		ok = ok && subOK
+	}
+	if ok && hsz>16 {
+		if stored := *(*uint64)(unsafe.Pointer(&buf[off+16])); stored!=count {
+			c.ch <- fmt.Errorf("page %d: radix node %d: count %d does not match %d keys",int(p.id),off,stored,count)
+		}
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package bbolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// openRadixCheckTx opens a fresh database and returns a writable transaction,
+// holding a persisted (but uncommitted) radix tree.
+func openRadixCheckTx(t *testing.T) (*DB, *Tx, *RadixBucket, func()) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tx.CreateRadixBucket([]byte("radix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		k := []byte(fmt.Sprintf("%c-key", 'a'+i))
+		if err := r.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.spill(); err != nil {
+		t.Fatal(err)
+	}
+	return db, tx, r, func() {
+		tx.Rollback()
+		db.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func expectCheckError(t *testing.T, tx *Tx, msg string) {
+	var errs []string
+	for err := range tx.Check() {
+		errs = append(errs, err.Error())
+	}
+	for _, e := range errs {
+		if strings.Contains(e, msg) {
+			return
+		}
+	}
+	t.Fatalf("expected error containing %q, got %q", msg, errs)
+}
+
+func TestRadixCheck_Valid(t *testing.T) {
+	_, tx, _, closer := openRadixCheckTx(t)
+	defer closer()
+	for err := range tx.Check() {
+		t.Fatal(err)
+	}
+}
+
+func TestRadixCheck_UnsortedEdges(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	ne, _, _, hsz := radixNodeHeader(buf)
+	buf[hsz+ne*8], buf[hsz+ne*8+1] = buf[hsz+ne*8+1], buf[hsz+ne*8]
+	expectCheckError(t, tx, "unsorted edges")
+}
+
+func TestRadixCheck_InvalidPageType(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	tx.page(r.acc.root).flags = leafPageFlag
+	expectCheckError(t, tx, "invalid type")
+}
+
+func TestRadixCheck_EdgeCount(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	*(*uint32)(unsafe.Pointer(&buf[8])) |= 0x1ff
+	expectCheckError(t, tx, "invalid edge count")
+}
+
+func TestRadixCheck_InlineOffset(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	_, _, _, hsz := radixNodeHeader(buf)
+	// Let the first edge of the root node point back at the root.
+	*(*radixID)(unsafe.Pointer(&buf[hsz])) = radixInlineID(0)
+	expectCheckError(t, tx, "nil reference")
+	*(*radixID)(unsafe.Pointer(&buf[hsz])) = radixInlineID(1 << 20)
+	expectCheckError(t, tx, "exceeds page bounds")
+}
+
+func TestRadixCheck_OutOfBounds(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	_, _, _, hsz := radixNodeHeader(buf)
+	*(*radixID)(unsafe.Pointer(&buf[hsz])) = radixPageID(tx.meta.pgid + 10)
+	expectCheckError(t, tx, "out of bounds")
+}
+
+func TestRadixCheck_ExternalLeaf(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	// An external leaf must never be inlined.
+	*(*radixID)(unsafe.Pointer(&buf[0])) = radixInlineID(64)
+	expectCheckError(t, tx, "external leaf is not a page reference")
+}
+
+func TestRadixCheck_Count(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	buf := radixPageBuffer(tx.page(r.acc.root))
+	*(*uint64)(unsafe.Pointer(&buf[16]))++
+	expectCheckError(t, tx, "count 17 does not match 16 keys")
+}
+
+// Ensure that the counts of nodes without a stored count are computed.
+func TestRadixCheck_UncountedNodes(t *testing.T) {
+	_, tx, r, closer := openRadixCheckTx(t)
+	defer closer()
+	r.acc.decodeRoot()
+	var uncount func(n *radixNode)
+	uncount = func(n *radixNode) {
+		n.flags &^= radixf_counted
+		n.count = 0
+		for i := 0; i < int(n.n_edges); i++ {
+			if n.edges_p[i] != nil {
+				uncount(n.edges_p[i])
+			}
+		}
+	}
+	uncount(r.acc.head)
+	if n := r.Len(); n != 16 {
+		t.Fatalf("unexpected length: %d", n)
+	} else if n := r.CountPrefix([]byte("c")); n != 1 {
+		t.Fatalf("unexpected count: %d", n)
+	} else if k, _ := r.KeyAt(2); string(k) != "c-key" {
+		t.Fatalf("unexpected key: %q", k)
+	}
+	for err := range tx.Check() {
+		t.Fatal(err)
+	}
+}
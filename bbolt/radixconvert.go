@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// NestedBucketError is returned, if a bucket can't be converted, because it
+// contains nested buckets or radix trees. Keys lists the keys of them.
+type NestedBucketError struct{
+	Keys [][]byte
+}
+func (e *NestedBucketError) Error() string {
+	return fmt.Sprintf("bucket contains %d nested buckets: %q",len(e.Keys),e.Keys)
+}
+
+// nested returns the keys of all nested buckets and radix trees.
+func (r *radixAccess) nested() (keys [][]byte) {
+	r.nested_recur(r.rootAddr(),radixSlice{slice:new([]byte)},&keys)
+	return
+}
+func (r *radixAccess) nested_recur(a radixAddr,key radixSlice,keys *[][]byte) {
+	if a.leafFlags()!=0 { *keys = append(*keys,cloneBytes(key.bytes())) }
+	for i,n := 0,a.n_edges(); i<n; i++ {
+		edge := a.edge(i)
+		r.nested_recur(edge,key.appnd(edge.prefix()),keys)
+	}
+}
+
+// seekConvert locates the child at key and verifies, that it has the given flag.
+func (b *Bucket) seekConvert(key []byte,flag uint32) (*Cursor,[]byte,error) {
+	if b.tx.db == nil {
+		return nil,nil,ErrTxClosed
+	} else if !b.tx.writable {
+		return nil,nil,ErrTxNotWritable
+	} else if len(key) == 0 {
+		return nil,nil,ErrBucketNameRequired
+	}
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if !bytes.Equal(key, k) {
+		return nil,nil,ErrBucketNotFound
+	} else if (flags & flag) == 0 {
+		return nil,nil,ErrIncompatibleValue
+	}
+	return c,v,nil
+}
+
+// ConvertToRadix converts the bucket at the given key into a radix tree, preserving
+// all key-value pairs and the sequence. The pages of the bucket are released.
+// Returns a *NestedBucketError, if the bucket contains nested buckets,
+// ErrValueRequired, if it contains empty values, which are not supported by radix trees,
+// and ErrCodecNotFound, if the values can not be decoded.
+// The radix-tree bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) ConvertToRadix(key []byte) (_ *RadixBucket, err error) {
+	defer b.tx.recoverError(&err)
+	c,_,err := b.seekConvert(key,bucketLeafFlag)
+	if err!=nil { return nil,err }
+	child := b.childBucket(key)
+	
+	// The values can not be decoded without the codec. An unregistered
+	// comparator does not matter, as the keys are sorted anyway.
+	if err := child.usable(); err==ErrCodecNotFound { return nil,err }
+	
+	// Verify, that every record can be converted, before anything is modified.
+	// The records are copied, as allocating pages may remap the database.
+	var nested,pairs [][]byte
+	empty := false
+	cc := child.Cursor()
+	for k, v := cc.First(); k != nil; k, v = cc.Next() {
+		if _, _, flags := cc.keyValue(); flags!=0 {
+			nested = append(nested,cloneBytes(k))
+		} else if len(v)==0 {
+			empty = true
+		} else {
+			pairs = append(pairs,cloneBytes(k),cloneBytes(v))
+		}
+	}
+	if len(nested)!=0 {
+		return nil,&NestedBucketError{Keys:nested}
+	} else if empty {
+		return nil,ErrValueRequired
+	}
+	
+	// Radix trees order their keys bytewise, whatever the comparator of the bucket.
+	if child.Comparator()!="" { sort.Sort(radixPairs(pairs)) }
+	
+	// The keys are moved, not changed.
+	defer b.tx.mute()()
+	
+	p,err := b.tx.allocate(1)
+	if err!=nil { return nil,err }
+	(&radixNode{}).write(radixPageBuffer(p))
+	p.flags = radixPageFlag
+	rad := openRadixBucket(b.tx,radixHeader{root:p.id,sequence:child.Sequence()}.bytes())
+	rad.path = b.tx.childPath(b.path,key)
+	
+	err = rad.BulkLoad(func() (key,value []byte,ok bool) {
+		if len(pairs)==0 { return nil,nil,false }
+		key,value,ok = pairs[0],pairs[1],true
+		pairs = pairs[2:]
+		return
+	})
+	if err!=nil { return nil,err }
+	
+	child.erase()
+	delete(b.buckets, string(key))
+	
+	// Replace the bucket with the radix tree, which's header is written on spill.
+	key = cloneBytes(key)
+	c.seek(key)
+	c.node().put(key, key, rad.header(), 0, radixLeafFlag)
+	b.radixes[string(key)] = rad
+	b.tx.recordStructure(changeToRadix,b.path,key,nil)
+	return rad,nil
+}
+
+// radixPairs sorts a list of alternating keys and values by key.
+type radixPairs [][]byte
+func (p radixPairs) Len() int { return len(p)/2 }
+func (p radixPairs) Less(i, j int) bool { return bytes.Compare(p[i*2],p[j*2])<0 }
+func (p radixPairs) Swap(i, j int) {
+	p[i*2],p[j*2] = p[j*2],p[i*2]
+	p[i*2+1],p[j*2+1] = p[j*2+1],p[i*2+1]
+}
+
+// ConvertToBucket converts the radix tree at the given key into a bucket, preserving
+// all key-value pairs and the sequence. The pages of the radix tree are released.
+// Returns a *NestedBucketError, if the radix tree contains nested buckets.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) ConvertToBucket(key []byte) (_ *Bucket, err error) {
+	defer b.tx.recoverError(&err)
+	c,v,err := b.seekConvert(key,radixLeafFlag)
+	if err!=nil { return nil,err }
+	rad := b.obtainRadixBucket(key,v)
+	if rad==nil { return nil,ErrIncompatibleValue }
+	if nested := rad.acc.nested(); len(nested)!=0 {
+		return nil,&NestedBucketError{Keys:nested}
+	}
+	
+	// The keys are moved, not changed.
+	defer b.tx.mute()()
+	
+	// Replace the radix tree with an empty bucket.
+	delete(b.radixes, string(key))
+	key = cloneBytes(key)
+	c.node().put(key, key, createInlineBucket(), 0, bucketLeafFlag)
+	b.page = nil
+	child := b.Bucket(key)
+	b.tx.recordStructure(changeToBucket,b.path,key,nil)
+	
+	// The values remain valid, as the pages of the radix tree are not
+	// released before the transaction is committed.
+	it := rad.Iterator()
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		if err := child.Put(k,v); err!=nil { return nil,err }
+	}
+	if err := child.SetSequence(rad.Sequence()); err!=nil { return nil,err }
+	rad.erase()
+	return child,nil
+}
+
+// ConvertToRadix converts the bucket at the given key into a radix tree.
+// See Bucket.ConvertToRadix.
+func (tx *Tx) ConvertToRadix(key []byte) (rad *RadixBucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.ConvertToRadix(key)
+}
+
+// ConvertToBucket converts the radix tree at the given key into a bucket.
+// See Bucket.ConvertToBucket.
+func (tx *Tx) ConvertToBucket(key []byte) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.ConvertToBucket(key)
+}
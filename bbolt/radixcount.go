@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+/*
+Counted nodes.
+
+Every node stores the number of keys within it's subtree (nested buckets
+included), so that counting, ranking and selecting keys is done in O(k),
+by descending a single path of the tree.
+*/
+
+func (r *radixAccess) rootAddr() radixAddr {
+	return radixAddr{t:r.tx,p:r.head,v:radixPageID(r.root)}
+}
+
+// countPrefix returns the number of keys starting with prefix.
+func (r *radixAccess) countPrefix(key []byte) uint64 {
+	a := r.rootAddr()
+	for len(key)!=0 {
+		m,ok := a.lookup(key)
+		if !ok { return 0 }
+		prefix := m.prefix()
+		l := radixLongestPrefix(prefix,key)
+		if l==len(key) { return m.count() }
+		if l<len(prefix) { return 0 }
+		key = key[l:]
+		a = m
+	}
+	return a.count()
+}
+
+// keyAt returns the i-th key in ascending order, or ok=false if i is out of range.
+func (r *radixAccess) keyAt(i uint64) (key,value []byte,ok bool) {
+	a := r.rootAddr()
+	if i>=a.count() { return }
+	k := radixSlice{slice:new([]byte)}
+	for {
+		if a.hasLeaf() {
+			if i==0 { break }
+			i--
+		}
+		next := radixAddr{}
+		for j,n := 0,a.n_edges(); j<n; j++ {
+			edge := a.edge(j)
+			c := edge.count()
+			if i<c { next = edge; break }
+			i -= c
+		}
+		// Only reachable, if the counts are inconsistent.
+		if next.isNil() { return }
+		a = next
+		k = k.appnd(a.prefix())
+	}
+	key,ok = k.bytes(),true
+	if a.leafFlags()==0 { value = a.leaf() }
+	return
+}
+
+// rank returns the number of keys, that are less than key.
+func (r *radixAccess) rank(key []byte) (n uint64) {
+	a := r.rootAddr()
+	for len(key)!=0 {
+		// a's own key is a proper prefix of key.
+		if a.hasLeaf() { n++ }
+		var m radixAddr
+		for j,l := 0,a.n_edges(); j<l; j++ {
+			k := a.edge_k(j)
+			if k>key[0] { break }
+			if k==key[0] { m = a.edge(j); break }
+			n += a.edge(j).count()
+		}
+		if m.isNil() { return }
+		prefix := m.prefix()
+		l := radixLongestPrefix(prefix,key)
+		switch {
+		case l==len(prefix):
+			key = key[l:]
+			a = m
+		case l==len(key):
+			// key is a proper prefix of every key within m.
+			return
+		default:
+			if prefix[l]<key[l] { n += m.count() }
+			return
+		}
+	}
+	return
+}
+
+// Len returns the number of keys in the radix tree, including nested buckets.
+func (r *RadixBucket) Len() int {
+	defer r.acc.tx.recoverRead()
+	return int(r.acc.rootAddr().count())
+}
+
+// CountPrefix returns the number of keys, starting with prefix.
+func (r *RadixBucket) CountPrefix(prefix []byte) int {
+	defer r.acc.tx.recoverRead()
+	return int(r.acc.countPrefix(prefix))
+}
+
+// KeyAt returns the key/value pair at position i in ascending key order.
+// Returns a nil key if i is out of range. The value is nil, if the key is a nested bucket.
+// The returned key and value are only valid for the life of the transaction.
+func (r *RadixBucket) KeyAt(i int) (key,value []byte) {
+	defer r.acc.tx.recoverRead()
+	if i<0 { return nil,nil }
+	key,value,_ = r.acc.keyAt(uint64(i))
+	return
+}
+
+// Rank returns the number of keys less than key, which is the position of key,
+// if it exists. Together with KeyAt, this allows pagination by offset.
+func (r *RadixBucket) Rank(key []byte) int {
+	defer r.acc.tx.recoverRead()
+	return int(r.acc.rank(key))
+}
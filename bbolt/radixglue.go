@@ -35,15 +35,56 @@ SECTION: public api.
 Copyright (c) 2018 Simon Schmidt
 */
 
-func radixPgid2bytes(p pgid) []byte {
-	b := make([]byte,8)
-	*((*pgid)(unsafe.Pointer(&b[0]))) = p
-	return b
+/*
+The header of a radix tree is stored as the value of it's key.
+
+Version 0 headers consist of the root page id only (8 bytes). Version 1 headers
+are laid out as follows (later versions may append further fields):
+{
+	pgid   root     : 64;
+	uint32 version  : 32;
+	uint32 flags    : 32; // reserved
+	uint64 sequence : 64;
+	uint64 count    : 64; // reserved
 }
-func radixBytes2Pgid(b []byte) (p pgid) {
-	copy(((*[8]byte)(unsafe.Pointer(&p)))[:],b)
+*/
+type radixHeader struct{
+	root     pgid
+	version  uint32
+	flags    uint32
+	sequence uint64
+	count    uint64
+}
+
+const (
+	radixHeaderSize    = int(unsafe.Sizeof(radixHeader{}))
+	radixHeaderVersion = 1
+)
+
+func radixReadHeader(v []byte) (h radixHeader,ok bool) {
+	switch {
+	case len(v)==8:
+		copy(((*[8]byte)(unsafe.Pointer(&h.root)))[:],v)
+		ok = true
+	case len(v)>=radixHeaderSize:
+		copy(((*[radixHeaderSize]byte)(unsafe.Pointer(&h)))[:],v)
+		ok = h.version>=1
+	}
 	return
 }
+func (h radixHeader) bytes() []byte {
+	h.version = radixHeaderVersion
+	b := make([]byte,radixHeaderSize)
+	copy(b,((*[radixHeaderSize]byte)(unsafe.Pointer(&h)))[:])
+	return b
+}
+
+// openRadixBucket opens the radix tree from it's header. Returns nil if the header is invalid.
+func openRadixBucket(tx *Tx,v []byte) *RadixBucket {
+	h,ok := radixReadHeader(v)
+	if !ok { return nil }
+	return &RadixBucket{acc:radixAccess{tx:tx,root:h.root},sequence:h.sequence}
+}
 
 /*
 Implements a Radix tree in BoltDB, optimized for sparse nodes.
@@ -58,25 +99,64 @@ http://en.wikipedia.org/wiki/Radix_tree
 */
 type RadixBucket struct{
 	acc radixAccess
+	sequence uint64
+	buckets map[string]*Bucket      // subbucket cache
+	radixes map[string]*RadixBucket // radix tree cache
+	path [][]byte                   // names from the root, only set if changes are captured
 }
-func (r *RadixBucket) spill() error {
-	return r.acc.persist()
+
+// header returns the header of this radix tree, as stored in the parent.
+func (r *RadixBucket) header() []byte {
+	return radixHeader{root:r.acc.root,sequence:r.sequence}.bytes()
+}
+
+// Sequence returns the current integer for the radix tree without incrementing it.
+func (r *RadixBucket) Sequence() uint64 { return r.sequence }
+
+// SetSequence updates the sequence number for the radix tree.
+func (r *RadixBucket) SetSequence(v uint64) (err error) {
+	defer r.acc.tx.recoverError(&err)
+	if r.acc.tx.db==nil {
+		return ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return ErrTxNotWritable
+	}
+	r.sequence = v
+	r.acc.tx.recordSequence(r.path,v)
+	return nil
+}
+
+// NextSequence returns an autoincrementing integer for the radix tree.
+func (r *RadixBucket) NextSequence() (seq uint64, err error) {
+	defer r.acc.tx.recoverError(&err)
+	if r.acc.tx.db==nil {
+		return 0, ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	r.sequence++
+	r.acc.tx.recordSequence(r.path,r.sequence)
+	return r.sequence, nil
 }
 
 // Get retrieves the value for a key in the bucket.
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
 // The returned value is only valid for the life of the transaction.
 func (r *RadixBucket) Get(key []byte) []byte {
+	defer r.acc.tx.recoverRead()
 	if len(key) == 0 {
 		return nil
 	} else if len(key) > MaxKeySize {
 		return nil
 	}
-	return r.acc.get(key).leaf()
+	a := r.acc.get(key)
+	if a.leafFlags()!=0 { return nil }
+	return a.leaf()
 }
 
 // LongestPrefix is like Get, but instead of an exact match, it will return the longest prefix match.
 func (r *RadixBucket) GetLongestPrefix(key []byte) (pref,val []byte) {
+	defer r.acc.tx.recoverRead()
 	if len(key) == 0 {
 		return nil,nil
 	}
@@ -87,8 +167,10 @@ func (r *RadixBucket) GetLongestPrefix(key []byte) (pref,val []byte) {
 // If the key exist then its previous value will be overwritten.
 // Supplied value MUST remain valid for the life of the transaction.
 // Returns an error if the bucket was created from a read-only transaction,
-// if the key is blank, if the key is too large, or if the value is too large.
-func (r *RadixBucket) Put(key,value []byte) error {
+// if the key is blank, if the key is too large, if the value is too large,
+// or if the key is a nested bucket.
+func (r *RadixBucket) Put(key,value []byte) (err error) {
+	defer r.acc.tx.recoverError(&err)
 	if r.acc.tx.db==nil {
 		return ErrTxClosed
 	} else if !r.acc.tx.writable {
@@ -105,14 +187,19 @@ func (r *RadixBucket) Put(key,value []byte) error {
 	}
 	if len(key)==0 { return ErrKeyRequired }
 	
-	r.acc.insert(key,value)
-	return nil
+	if !r.acc.tx.recording() { return r.acc.put(key,value,0) }
+	var prev []byte
+	err = r.acc.insert(key,0,func(old []byte,_ uint8) VisitOp { prev = old; return VisitOpSET(value) })
+	if err==nil { r.recordPut(key,prev,value) }
+	return err
 }
 
 // Delete removes a key from the bucket.
 // If the key does not exist then nothing is done and a nil error is returned.
-// Returns an error if the bucket was created from a read-only transaction.
-func (r *RadixBucket) Delete(key []byte) error {
+// Returns an error if the bucket was created from a read-only transaction,
+// or if the key is a nested bucket.
+func (r *RadixBucket) Delete(key []byte) (err error) {
+	defer r.acc.tx.recoverError(&err)
 	if r.acc.tx.db==nil {
 		return ErrTxClosed
 	} else if !r.acc.tx.writable {
@@ -123,67 +210,206 @@ func (r *RadixBucket) Delete(key []byte) error {
 	} else if len(key) > MaxKeySize {
 		return nil
 	}
-	r.acc.del(key)
+	if !r.acc.tx.recording() { return r.acc.del(key,0) }
+	var prev []byte
+	err = r.acc.insert(key,0,func(old []byte,_ uint8) VisitOp { prev = old; return VisitOpDELETE() })
+	if err==nil { r.recordDelete(key,prev) }
+	return err
+}
+
+// Accept visits the record with the given key using a single lookup.
+// If the record exists, vis.VisitFull() is called, otherwise vis.VisitEmpty().
+// The returned VisitOp is then applied to the radix tree.
+//
+// VisitOpNOP(), VisitOpSET(), VisitOpSET_COPY() and VisitOpDELETE() are supported.
+// If the record is a nested bucket, vis.VisitBucket() is called instead.
+// Bucket-creation operations are not supported and yield ErrUnsupportedVisitOp.
+// If writable is false, any write operation yields ErrInvalidWriteAttempt.
+func (r *RadixBucket) Accept(key []byte,vis Visitor,writable bool) (err error) {
+	defer r.acc.tx.recoverError(&err)
+	if r.acc.tx.db==nil {
+		return ErrTxClosed
+	} else if writable && !r.acc.tx.writable {
+		return ErrTxNotWritable
+	} else if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	
+	vis.VisitBefore()
+	defer vis.VisitAfter()
+	
+	var op VisitOp
+	var prev []byte
+	visit := func(old []byte,flags uint8) VisitOp {
+		switch {
+		case (flags&bucketLeafFlag)!=0:
+			vis.VisitBucket(key,r.obtainBucket(key,old))
+			return VisitOpNOP()
+		case flags!=0:
+			return VisitOpNOP()
+		}
+		if len(old)==0 {
+			op = vis.VisitEmpty(key)
+		} else {
+			op = vis.VisitFull(key,old)
+		}
+		prev = old
+		switch {
+		case op.bkt(): return VisitOpNOP()
+		case op.set() && int64(len(op.buf)) > MaxValueSize: return VisitOpNOP()
+		}
+		return op
+	}
+	if !writable {
+		a := r.acc.get(key)
+		visit(a.leaf(),a.leafFlags())
+	} else if err := r.acc.insert(key,0,visit); err!=nil {
+		return err
+	}
+	switch {
+	case op.bkt(): return ErrUnsupportedVisitOp
+	case op.set() && int64(len(op.buf)) > MaxValueSize: return ErrValueTooLarge
+	case !writable && (op.set() || op.del()): return ErrInvalidWriteAttempt
+	case op.set(): r.recordPut(key,prev,op.buf)
+	case op.del(): r.recordDelete(key,prev)
+	}
 	return nil
 }
 
 // Iterator creates a iterator for this radix tree.
 // The iterator is only valid as long as the transaction is open.
-// The iterator initially points to the first key-value pair.
+// The iterator is initially positioned before the first key-value pair.
 // For reverse iteration, please call Last().
 // Do not use a iterator after the transaction is closed.
 func (r *RadixBucket) Iterator() *RadixIterator {
-	return &RadixIterator{r.acc.traversal()}
+	defer r.acc.tx.recoverRead()
+	return &RadixIterator{trav:r.acc.traversal()}
 }
 
 // Performs a Prefix-scan on this radix-tree.
 // The returned iterator will only traverse key-value pairs, which's key
-// has the given prefix.
-//
-//
-// Caveats
-//
-// On the returned iterator, the LongestCommonPrefix() method SHALL be malfunctioning!
+// has the given prefix. All methods of the iterator (including Seek and
+// LongestCommonPrefix) are confined to these key-value pairs.
 func (r *RadixBucket) PrefixScan(prefix []byte) *RadixIterator {
-	return &RadixIterator{r.acc.prefixScan(prefix)}
+	defer r.acc.tx.recoverRead()
+	return &RadixIterator{trav:r.acc.prefixScan(prefix)}
+}
+
+// Range performs a range-scan on this radix-tree.
+// The returned iterator will only traverse key-value pairs, which's key is
+// greater than or equal to start and less than end. A nil bound is unbounded.
+// Subtrees outside of the bounds are skipped rather than visited.
+//
+// If both bounds are given and start is greater than end, the range is reversed:
+// the iterator traverses the key-value pairs, which's key is less than or equal
+// to start and greater than end, in descending order. On such an iterator, Next()
+// and Seek() move towards end; Prev() and SeekLT() move towards start.
+func (r *RadixBucket) Range(start,end []byte) *RadixIterator {
+	defer r.acc.tx.recoverRead()
+	if start!=nil && end!=nil && bytes.Compare(start,end)>0 {
+		it := &RadixIterator{trav:r.acc.rangeScan(radixSucc(end),radixSucc(start)),reverse:true}
+		it.Reset()
+		return it
+	}
+	return &RadixIterator{trav:r.acc.rangeScan(start,end)}
 }
 
 // Minimum performs a minimum key-value lookup.
 func (r *RadixBucket) Minimum() (key,value []byte) {
+	defer r.acc.tx.recoverRead()
 	return r.acc.minPair()
 }
 
 // Maximum performs a maximum key-value lookup.
 func (r *RadixBucket) Maximum() (key,value []byte) {
+	defer r.acc.tx.recoverRead()
 	return r.acc.maxPair()
 }
 
+// RadixIterator iterates over the key-value pairs of a radix tree in sorted order.
+//
+// The iterator has a current position, that is either before the first pair,
+// after the last pair or at a specific pair (or around the pairs matched by
+// LongestCommonPrefix). Next() and Prev() move relative to
+// this position, so they can be interleaved freely, like on a Cursor.
+//
+// The returned keys are only valid until the next call to the iterator.
 type RadixIterator struct{
-	trav *radixTraversal
+	trav    *radixTraversal
+	reverse bool
+}
+
+// radixSucc returns the smallest key, that is greater than key.
+func radixSucc(key []byte) []byte {
+	return append(append(make([]byte,0,len(key)+1),key...),0)
 }
 
-// Reset resets the iterator to the first key-value pair in this radix tree.
+// Reset moves the iterator before the first key-value pair in this radix tree.
+// Calling Next() will return the first key-value pair.
 func (r *RadixIterator) Reset() {
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { r.trav.end(); return }
 	r.trav.reset()
 }
-// Last resets the iterator to the last key-value pair in this radix tree.
+// Last moves the iterator after the last key-value pair in this radix tree.
+// Calling Prev() will return the last key-value pair.
 func (r *RadixIterator) Last() {
-	r.trav.last()
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { r.trav.reset(); return }
+	r.trav.end()
 }
 
 // Next obtains the next key-value pair from this radix tree.
+// If there is no next pair, the iterator is moved after the last pair.
 func (r *RadixIterator) Next() (key,value []byte,ok bool) {
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { return r.trav.prev() }
 	return r.trav.next()
 }
 
 // Prev obtains the previous key-value pair from this radix tree.
-//
-// If Prev is called after Next, thus switching traversal order, glitches such
-// as duplicate key-value pairs may occur.
+// If there is no previous pair, the iterator is moved before the first pair.
 func (r *RadixIterator) Prev() (key,value []byte,ok bool) {
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { return r.trav.next() }
 	return r.trav.prev()
 }
 
+// Seek moves the iterator to the first key-value pair, which's key is greater
+// than or equal to the given key, and returns it.
+// Subsequent calls to Next() continue after the returned key-value pair.
+//
+// Seek is equivalent to SeekGE.
+func (r *RadixIterator) Seek(key []byte) (k,value []byte,ok bool) {
+	return r.SeekGE(key)
+}
+
+// SeekGE moves the iterator to the first key-value pair, which's key is greater
+// than or equal to the given key, and returns it.
+// Subsequent calls to Next() continue after the returned key-value pair.
+//
+// On a reversed range, SeekGE moves to the last key-value pair, which's key is
+// less than or equal to the given key.
+func (r *RadixIterator) SeekGE(key []byte) (k,value []byte,ok bool) {
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { return r.trav.seekLT(radixSucc(key)) }
+	return r.trav.seekGE(key)
+}
+
+// SeekLT moves the iterator to the last key-value pair, which's key is less
+// than the given key, and returns it.
+// Subsequent calls to Prev() continue before the returned key-value pair.
+//
+// On a reversed range, SeekLT moves to the first key-value pair, which's key is
+// greater than the given key.
+func (r *RadixIterator) SeekLT(key []byte) (k,value []byte,ok bool) {
+	defer r.trav.root.t.recoverRead()
+	if r.reverse { return r.trav.seekGE(radixSucc(key)) }
+	return r.trav.seekLT(key)
+}
+
 // LongestCommonPrefix finds the longest prefix possible byte-string 'match' so that
 // 'match' is a prefix of the parameter 'key' and 'match' is a prefix of the key of
 // at least one existing key-value pair within the radix tree.
@@ -191,7 +417,13 @@ func (r *RadixIterator) Prev() (key,value []byte,ok bool) {
 // Calling Next() will return the first key-value pair of which 'match' is a prefix.
 //
 // Calling Prev() will return the last key-value pair of which 'match' is a prefix.
+//
+// After either call, the iterator continues from the returned key-value pair.
+//
+// On a range-scan, 'match' is computed regardless of the bounds, however Next()
+// and Prev() will not leave them.
 func (r *RadixIterator) LongestCommonPrefix(key []byte) (match,rest []byte) {
+	defer r.trav.root.t.recoverRead()
 	return r.trav.longestCommonPrefix(key)
 }
 
@@ -205,14 +437,17 @@ func (b *Bucket) deleteRadixBucketInner(k ,v []byte) {
 	if b.radixes!=nil {
 		if rad,ok := b.radixes[string(k)]; ok {
 			delete(b.radixes,string(k))
-			rad.acc.erase()
+			rad.erase()
 			return
 		}
 	}
-	rad := radixAccess{tx:b.tx,root:radixBytes2Pgid(v)}
-	rad.erase()
+	if rad := openRadixBucket(b.tx,v); rad!=nil {
+		rad.path = b.tx.childPath(b.path,k)
+		rad.erase()
+	}
 }
-func (b *Bucket) DeleteRadixBucket(key []byte) error {
+func (b *Bucket) DeleteRadixBucket(key []byte) (err error) {
+	defer b.tx.recoverError(&err)
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
@@ -235,19 +470,26 @@ func (b *Bucket) DeleteRadixBucket(key []byte) error {
 	
 	// Delete the node if we have a matching key.
 	c.node().del(key)
+	b.tx.recordStructure(changeDeleteBucket,b.path,key,nil)
 	return nil
 }
 
 func (b *Bucket) obtainRadixBucket(k ,v []byte) *RadixBucket {
 	if b.radixes==nil {
-		return &RadixBucket{acc:radixAccess{tx:b.tx,root:radixBytes2Pgid(v)}}
+		return openRadixBucket(b.tx,v)
 	}
 	if rad,ok := b.radixes[string(k)]; ok { return rad }
-	if len(v)<8 { return nil }
-	rad := &RadixBucket{acc:radixAccess{tx:b.tx,root:radixBytes2Pgid(v)}}
+	rad := openRadixBucket(b.tx,v)
+	if rad==nil { return nil }
+	rad.path = b.tx.childPath(b.path,k)
 	b.radixes[string(k)] = rad
 	return rad
 }
+// peekRadixBucket returns the cached radix tree, or opens it without caching it.
+func (b *Bucket) peekRadixBucket(k ,v []byte) *RadixBucket {
+	if rad,ok := b.radixes[string(k)]; ok { return rad }
+	return openRadixBucket(b.tx,v)
+}
 func (b *Bucket) createOrObtainRadixBucket(key []byte,obtain bool) (*RadixBucket, error) {
 	if b.tx.db == nil {
 		return nil, ErrTxClosed
@@ -276,8 +518,9 @@ func (b *Bucket) createOrObtainRadixBucket(key []byte,obtain bool) (*RadixBucket
 	p.flags = radixPageFlag
 	
 	key = cloneBytes(key)
-	v = radixPgid2bytes(p.id)
+	v = radixHeader{root:p.id}.bytes()
 	c.node().put(key, key, v, 0, radixLeafFlag)
+	b.tx.recordStructure(changeCreateRadix,b.path,key,nil)
 	
 	return b.obtainRadixBucket(key,v),nil
 }
@@ -285,14 +528,16 @@ func (b *Bucket) createOrObtainRadixBucket(key []byte,obtain bool) (*RadixBucket
 // CreateRadixBucket creates a new radix-tree bucket at the given key and returns the new bucket.
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
-func (b *Bucket) CreateRadixBucket(key []byte) (*RadixBucket, error) {
+func (b *Bucket) CreateRadixBucket(key []byte) (rad *RadixBucket, err error) {
+	defer b.tx.recoverError(&err)
 	return b.createOrObtainRadixBucket(key,false)
 }
 
 // CreateRadixBucketIfExist creates a new radix-tree bucket if it doesn't already exist and returns a reference to it.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
-func (b *Bucket) CreateRadixBucketIfNotExists(key []byte) (*RadixBucket, error) {
+func (b *Bucket) CreateRadixBucketIfNotExists(key []byte) (rad *RadixBucket, err error) {
+	defer b.tx.recoverError(&err)
 	return b.createOrObtainRadixBucket(key,true)
 }
 
@@ -300,38 +545,52 @@ func (b *Bucket) CreateRadixBucketIfNotExists(key []byte) (*RadixBucket, error)
 // Returns nil if the radix-tree bucket does not exist.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) RadixBucket(k []byte) *RadixBucket {
+	defer b.tx.recoverRead()
 	c := b.Cursor()
 	if b.radixes==nil {
 		nk, v, flags := c.seek(k)
 		if !bytes.Equal(k,nk) { return nil }
 		if (flags & radixLeafFlag) == 0 { return nil }
-		return &RadixBucket{acc:radixAccess{tx:b.tx,root:radixBytes2Pgid(v)}}
+		return openRadixBucket(b.tx,v)
 	}
 	if rad,ok := b.radixes[string(k)]; ok { return rad }
 	nk, v, flags := c.seek(k)
-	if len(v)<8 { return nil }
 	if !bytes.Equal(k,nk) { return nil }
 	if (flags & radixLeafFlag) == 0 { return nil }
-	rad := &RadixBucket{acc:radixAccess{tx:b.tx,root:radixBytes2Pgid(v)}}
+	rad := openRadixBucket(b.tx,v)
+	if rad==nil { return nil }
+	rad.path = b.tx.childPath(b.path,k)
 	b.radixes[string(k)] = rad
 	return rad
 }
 
-func (tx *Tx) DeleteRadixBucket(key []byte) error { return tx.root.DeleteRadixBucket(key) }
+func (tx *Tx) DeleteRadixBucket(key []byte) (err error) {
+	defer tx.recoverError(&err)
+	return tx.root.DeleteRadixBucket(key)
+}
 
 // CreateRadixBucket creates a new radix-tree bucket at the given key and returns the new bucket.
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
-func (tx *Tx) CreateRadixBucket(key []byte) (*RadixBucket, error) { return tx.root.CreateRadixBucket(key) }
+func (tx *Tx) CreateRadixBucket(key []byte) (rad *RadixBucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.CreateRadixBucket(key)
+}
 
 // CreateRadixBucketIfExist creates a new radix-tree bucket if it doesn't already exist and returns a reference to it.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
-func (tx *Tx) CreateRadixBucketIfNotExists(key []byte) (*RadixBucket, error) { return tx.root.CreateRadixBucketIfNotExists(key) }
+func (tx *Tx) CreateRadixBucketIfNotExists(key []byte) (rad *RadixBucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.CreateRadixBucketIfNotExists(key)
+}
 
 // RadixBucket retrieves a radix-tree bucket by name.
 // Returns nil if the radix-tree bucket does not exist.
 // The radix-tree bucket instance is only valid for the lifetime of the transaction.
-func (tx *Tx) RadixBucket(key []byte) *RadixBucket { return tx.root.RadixBucket(key) }
+func (tx *Tx) RadixBucket(key []byte) *RadixBucket {
+	defer tx.recoverRead()
+	return tx.root.RadixBucket(key)
+}
 
 
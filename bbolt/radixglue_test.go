@@ -0,0 +1,93 @@
+package bbolt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that radix trees with a version 0 header (a bare root pgid) can still
+// be read, and that their header gets upgraded when written.
+func TestRadixBucket_LegacyHeader(t *testing.T) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	name := []byte("radix")
+	header := func(tx *Tx) []byte {
+		k, v, flags := tx.root.Cursor().seek(name)
+		if string(k) != string(name) || (flags&radixLeafFlag) == 0 {
+			t.Fatalf("unexpected key: %q (%x)", k, flags)
+		}
+		return v
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		r, err := tx.CreateRadixBucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate the header to the legacy format.
+	if err := db.Update(func(tx *Tx) error {
+		v := header(tx)
+		if len(v) != radixHeaderSize {
+			t.Fatalf("unexpected header size: %d", len(v))
+		}
+		v = cloneBytes(v[:8])
+		c := tx.root.Cursor()
+		c.seek(name)
+		c.node().put(name, name, v, 0, radixLeafFlag)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if v := header(tx); len(v) != 8 {
+			t.Fatalf("unexpected header size: %d", len(v))
+		}
+		r := tx.RadixBucket(name)
+		if v := r.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if r.Sequence() != 0 {
+			t.Fatalf("unexpected sequence: %d", r.Sequence())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.RadixBucket(name).NextSequence()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if v := header(tx); len(v) != radixHeaderSize {
+			t.Fatalf("unexpected header size: %d", len(v))
+		} else if h, ok := radixReadHeader(v); !ok || h.sequence != 1 || h.version != radixHeaderVersion {
+			t.Fatalf("unexpected header: %+v", h)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -68,94 +68,229 @@ func (r *radixAccess) traverse(f func(key,value []byte) bool) {
 }
 
 /*
-A state-machine base variant of the recursive radixTraverse() function.
+A stack of nodes from the root of the traversal down to the current position.
+Each frame remembers the edge index, under which its node is found within
+its parent and the length of the key up to (and including) its prefix.
 */
-type radixTraversalNode struct{
-	parent *radixTraversalNode
-	a      radixAddr
-	prefix radixSlice
-	i,n    int
-}
-func (r *radixTraversalNode) call() (nr *radixTraversalNode,key,value []byte) {
-start:
-	if r.i<0 {
-		r.i=0
-		if buf := r.a.leaf(); len(buf)!=0 { return r,r.prefix.bytes(),buf }
-	}
-	if r.i<r.n {
-		edge := r.a.edge(r.i)
-		r.i++
-		r = &radixTraversalNode{r,edge,r.prefix.appnd(edge.prefix()),-1,edge.n_edges()}
-		goto start
-	}
-	if r.parent!=nil {
-		r = r.parent
-		goto start
+type radixFrame struct{
+	a    radixAddr
+	i    int
+	klen int
+}
+
+const (
+	radixBefore = iota // before the first key-value pair
+	radixAfter         // after the last key-value pair
+	radixAt            // at the key-value pair of the topmost frame
+	radixAround        // Next() enters, Prev() leaves the subtree of the topmost frame
+)
+
+/*
+A cursor-like traversal with a well-defined current position.
+
+The position is either before the first pair, after the last pair, at a
+key-value pair or around a subtree. Next() and Prev() move relative to that
+position, so they can be interleaved freely.
+*/
+type radixTraversal struct{
+	root  radixAddr
+	base  []byte
+	lo,hi []byte // optional bounds, see radixrange.go
+	key   []byte
+	stack []radixFrame
+	state int
+}
+func (r *radixTraversal) top() *radixFrame { return &r.stack[len(r.stack)-1] }
+func (r *radixTraversal) rewind() {
+	r.key = append(r.key[:0],r.base...)
+	r.stack = append(r.stack[:0],radixFrame{r.root,-1,len(r.base)})
+}
+func (r *radixTraversal) push(i int) {
+	t := r.top()
+	edge := t.a.edge(i)
+	r.key = append(r.key[:t.klen],edge.prefix()...)
+	r.stack = append(r.stack,radixFrame{edge,i,len(r.key)})
+}
+func (r *radixTraversal) pair() (key,value []byte,ok bool) {
+	t := r.top()
+	r.state = radixAt
+	// Nested buckets have no value.
+	if t.a.leafFlags()!=0 { return r.key[:t.klen],nil,true }
+	return r.key[:t.klen],t.a.leaf(),true
+}
+
+// first moves to the first pair within the subtree of the topmost frame.
+func (r *radixTraversal) first() (key,value []byte,ok bool) {
+	for {
+		t := r.top()
+		if len(t.a.leaf())!=0 { return r.pair() }
+		if t.a.n_edges()==0 { return r.up() }
+		r.push(0)
 	}
-	return
 }
-func (r *radixTraversalNode) callR() (nr *radixTraversalNode,key,value []byte) {
-start:
-	if r.i>0 {
-		r.i--
-		edge := r.a.edge(r.i)
-		N := edge.n_edges()
-		r = &radixTraversalNode{r,edge,r.prefix.appnd(edge.prefix()),N,N}
+// last moves to the last pair within the subtree of the topmost frame.
+func (r *radixTraversal) last() (key,value []byte,ok bool) {
+	for {
+		t := r.top()
+		if n := t.a.n_edges(); n>0 { r.push(n-1); continue }
+		if len(t.a.leaf())!=0 { return r.pair() }
+		return r.down()
 	}
-	if r.i==0 {
-		r.i--
-		if buf := r.a.leaf(); len(buf)!=0 { key,value = r.prefix.bytes(),buf }
+}
+// up moves to the first pair following the subtree of the topmost frame.
+func (r *radixTraversal) up() (key,value []byte,ok bool) {
+	if len(r.stack)>1 {
+		i := r.top().i
+		r.stack = r.stack[:len(r.stack)-1]
+		return r.from(i+1)
 	}
-	if r.i<0 {
-		r = r.parent
+	r.state = radixAfter
+	return
+}
+// down moves to the last pair preceding the subtree of the topmost frame.
+func (r *radixTraversal) down() (key,value []byte,ok bool) {
+	if len(r.stack)>1 {
+		i := r.top().i
+		r.stack = r.stack[:len(r.stack)-1]
+		return r.before(i)
 	}
-	nr = r
-	if key!=nil && value!=nil { return }
-	if nr==nil { return }
-	goto start
+	r.state = radixBefore
+	return
 }
-
-func (r *radixTraversalNode) longestCommonPrefix(key []byte) (nr *radixTraversalNode,rest []byte) {
-	for {
-		if len(key)==0 { break }
-		i,m,ok := r.a.lookup_i(key)
-		if !ok { break }
-		r.i = i+1
-		r = &radixTraversalNode{r,m,r.prefix.appnd(m.prefix()),-1,m.n_edges()}
-		key,ok = m.match(key)
-		if !ok { break }
+// from moves to the first pair within edge i or any later edge of the topmost frame.
+func (r *radixTraversal) from(i int) (key,value []byte,ok bool) {
+	if i<r.top().a.n_edges() {
+		r.push(i)
+		return r.first()
 	}
-	return r,key
+	return r.up()
 }
-
-type radixTraversal struct{
-	slice radixSlice
-	node *radixTraversalNode
-	root radixAddr
+// before moves to the last pair preceding edge i of the topmost frame.
+func (r *radixTraversal) before(i int) (key,value []byte,ok bool) {
+	if i>0 {
+		r.push(i-1)
+		return r.last()
+	}
+	if len(r.top().a.leaf())!=0 { return r.pair() }
+	return r.down()
 }
+
 func (r *radixTraversal) reset() {
-	if r.slice.slice==nil { r.slice.slice = new([]byte) }
-	r.node = &radixTraversalNode{nil,r.root,r.slice,-1,r.root.n_edges()}
+	r.rewind()
+	r.state = radixBefore
 }
-func (r *radixTraversal) last() {
-	if r.slice.slice==nil { r.slice.slice = new([]byte) }
-	r.node = &radixTraversalNode{nil,r.root,r.slice,r.root.n_edges(),r.root.n_edges()}
+func (r *radixTraversal) end() {
+	r.rewind()
+	r.state = radixAfter
 }
-func (r *radixTraversal) next() (key,value []byte,ok bool) {
-	if r.node==nil { return }
-	r.node,key,value = r.node.call()
-	ok = r.node!=nil
+func (r *radixTraversal) advance() (key,value []byte,ok bool) {
+	switch r.state {
+	case radixBefore:
+		r.rewind()
+		return r.first()
+	case radixAt:
+		return r.from(0)
+	case radixAround:
+		return r.first()
+	}
 	return
 }
-func (r *radixTraversal) prev() (key,value []byte,ok bool) {
-	if r.node==nil { return }
-	r.node,key,value = r.node.callR()
-	ok = r.node!=nil
+func (r *radixTraversal) retreat() (key,value []byte,ok bool) {
+	switch r.state {
+	case radixAfter:
+		r.rewind()
+		return r.last()
+	case radixAt:
+		return r.down()
+	case radixAround:
+		return r.last()
+	}
 	return
 }
+
+// ceil moves to the first pair, which's key is greater than or equal to key.
+func (r *radixTraversal) ceil(key []byte) (k,value []byte,ok bool) {
+	r.rewind()
+	l := radixLongestPrefix(r.base,key)
+	if l<len(r.base) {
+		// The key lies outside of the traversed subtree.
+		if l==len(key) || key[l]<r.base[l] { return r.first() }
+		r.state = radixAfter
+		return
+	}
+	key = key[l:]
+	for len(key)!=0 {
+		j,m,ok := r.top().a.lookup_i(key)
+		if !ok { return r.from(j) }
+		p := m.prefix()
+		l := radixLongestPrefix(p,key)
+		switch {
+		case l==len(p) && l<len(key):
+			// The key continues below m.
+			r.push(j)
+			key = key[l:]
+			continue
+		case l==len(key) || p[l]>key[l]:
+			// The whole subtree of m is greater than or equal to the key.
+			return r.from(j)
+		}
+		// The whole subtree of m is less than the key.
+		return r.from(j+1)
+	}
+	return r.first()
+}
+
+// lower moves to the last pair, which's key is less than key.
+func (r *radixTraversal) lower(key []byte) (k,value []byte,ok bool) {
+	r.rewind()
+	l := radixLongestPrefix(r.base,key)
+	if l<len(r.base) {
+		// The key lies outside of the traversed subtree.
+		if l==len(key) || key[l]<r.base[l] {
+			r.state = radixBefore
+			return
+		}
+		return r.last()
+	}
+	key = key[l:]
+	for len(key)!=0 {
+		j,m,ok := r.top().a.lookup_i(key)
+		if !ok { return r.before(j) }
+		p := m.prefix()
+		l := radixLongestPrefix(p,key)
+		switch {
+		case l==len(p) && l<len(key):
+			// The key continues below m.
+			r.push(j)
+			key = key[l:]
+			continue
+		case l==len(key) || p[l]>key[l]:
+			// The whole subtree of m is greater than or equal to the key.
+			return r.before(j)
+		}
+		// The whole subtree of m is less than the key.
+		r.push(j)
+		return r.last()
+	}
+	// Every pair within the subtree of the topmost frame is >= key.
+	return r.down()
+}
+
 func (r *radixTraversal) longestCommonPrefix(key []byte) (match,rest []byte) {
-	r.reset()
-	r.node,rest = r.node.longestCommonPrefix(key)
+	r.rewind()
+	r.state = radixAround
+	if len(r.root.leaf())==0 && r.root.n_edges()==0 { return nil,key }
+	l := radixLongestPrefix(r.base,key)
+	rest = key[l:]
+	if l==len(r.base) {
+		for len(rest)!=0 {
+			j,m,ok := r.top().a.lookup_i(rest)
+			if !ok { break }
+			r.push(j)
+			rest,ok = m.match(rest)
+			if !ok { break }
+		}
+	}
 	match = key[:len(key)-len(rest)]
 	return
 }
@@ -168,11 +303,11 @@ func (r *radixAccess) traversal() *radixTraversal {
 }
 
 func (r *radixAccess) prefixScan(key []byte) *radixTraversal {
-	buf := radixSlice{slice:new([]byte)}
+	var buf []byte
 	parent := radixAddr{t:r.tx,p:r.head,v:radixPageID(r.root)}
 	for {
 		if len(key)==0 {
-			t := &radixTraversal{slice:buf,root:parent}
+			t := &radixTraversal{root:parent,base:buf}
 			t.reset()
 			return t
 		}
@@ -185,7 +320,7 @@ func (r *radixAccess) prefixScan(key []byte) *radixTraversal {
 			// If the key was exthausted, we'll tolerate this
 			if len(key)!=0 { break }
 		}
-		buf = buf.appnd(m.prefix())
+		buf = append(buf,m.prefix()...)
 		parent = m
 	}
 	t := new(radixTraversal)
@@ -201,6 +336,7 @@ func (r *radixAccess) minPair() (key,value []byte) {
 	for {
 		if a.isNil() { return }
 		if buf := a.leaf() ; len(buf)!=0 {
+			if a.leafFlags()!=0 { buf = nil }
 			return prefix.bytes(),buf
 		}
 		if a.n_edges()==0 { return }
@@ -216,6 +352,7 @@ func (r *radixAccess) maxPair() (key,value []byte) {
 	for {
 		if a.isNil() { return }
 		if buf := a.leaf() ; len(buf)!=0 {
+			if a.leafFlags()!=0 { buf = nil }
 			key,value = prefix.bytes(),buf
 		}
 		ne := a.n_edges()
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+/*
+Approximate matching.
+
+An automaton is run along the paths of the tree. The first byte of every child is
+taken from the edges_k table of the parent, so subtrees, that can't match, are
+pruned without touching their nodes. If the automaton can only continue with one
+specific byte, the edge is located using a binary search rather than a scan.
+
+States are represented as []int; a nil state is dead.
+*/
+type radixAutomaton interface{
+	start() []int
+	step(s []int,b byte) []int
+	accept(s []int) bool
+	// only returns the only byte, that keeps the state alive, if there is one.
+	only(s []int) (byte,bool)
+}
+
+// radixLevenshtein keeps a row of the Levenshtein matrix as state.
+type radixLevenshtein struct{
+	key []byte
+	max int
+}
+func (l *radixLevenshtein) start() []int {
+	if l.max<0 { return nil }
+	row := make([]int,len(l.key)+1)
+	for i := range row { row[i] = i }
+	return row
+}
+func (l *radixLevenshtein) step(s []int,b byte) []int {
+	row := make([]int,len(s))
+	row[0] = s[0]+1
+	alive := row[0]<=l.max
+	for j := 1; j<len(row); j++ {
+		cost := 1
+		if l.key[j-1]==b { cost = 0 }
+		row[j] = s[j-1]+cost
+		if d := s[j]+1; d<row[j] { row[j] = d }
+		if d := row[j-1]+1; d<row[j] { row[j] = d }
+		if row[j]<=l.max { alive = true }
+	}
+	if !alive { return nil }
+	return row
+}
+func (l *radixLevenshtein) accept(s []int) bool { return s[len(s)-1]<=l.max }
+func (l *radixLevenshtein) only(s []int) (byte,bool) {
+	// Without any edits left, only the next byte of the key is allowed.
+	for j,d := range s {
+		if d<l.max { return 0,false }
+		if d==l.max {
+			if j==len(l.key) { return 0,false }
+			for _,e := range s[j+1:] {
+				if e<=l.max { return 0,false }
+			}
+			return l.key[j],true
+		}
+	}
+	return 0,false
+}
+
+// radixWildcard keeps the set of positions within the pattern as state.
+type radixWildcard struct{
+	pattern []byte
+}
+// closure adds j and, if the pattern continues with stars, the positions behind them.
+func (w *radixWildcard) closure(s []int,j int) []int {
+	for {
+		if n := len(s); n==0 || s[n-1]<j { s = append(s,j) }
+		if j==len(w.pattern) || w.pattern[j]!='*' { return s }
+		j++
+	}
+}
+func (w *radixWildcard) start() []int { return w.closure(nil,0) }
+func (w *radixWildcard) step(s []int,b byte) (t []int) {
+	// s is sorted, so t stays sorted.
+	for _,j := range s {
+		if j==len(w.pattern) { continue }
+		switch c := w.pattern[j]; {
+		case c=='*':
+			t = w.closure(t,j)
+		case c=='?' || c==b:
+			t = w.closure(t,j+1)
+		}
+	}
+	return
+}
+func (w *radixWildcard) accept(s []int) bool { return s[len(s)-1]==len(w.pattern) }
+func (w *radixWildcard) only(s []int) (b byte,ok bool) {
+	for _,j := range s {
+		if j==len(w.pattern) { continue }
+		c := w.pattern[j]
+		if c=='*' || c=='?' || (ok && c!=b) { return 0,false }
+		b,ok = c,true
+	}
+	return
+}
+
+type radixMatchFrame struct{
+	a       radixAddr
+	s       []int
+	i,n     int
+	klen    int
+	visited bool
+}
+
+// RadixMatchIterator streams the key-value pairs, matched by FuzzySearch or
+// Match, in ascending key order.
+//
+// The returned keys are only valid until the next call to the iterator.
+type RadixMatchIterator struct{
+	root  radixAddr
+	auto  radixAutomaton
+	key   []byte
+	stack []radixMatchFrame
+}
+
+func (r *RadixMatchIterator) push(a radixAddr,s []int,klen int) {
+	f := radixMatchFrame{a:a,s:s,klen:klen,n:a.n_edges()}
+	if b,ok := r.auto.only(s); ok {
+		i,_,ok := a.lookup_i([]byte{b})
+		f.i = i
+		f.n = i
+		if ok { f.n++ }
+	}
+	r.stack = append(r.stack,f)
+}
+
+// Reset moves the iterator before the first matching key-value pair.
+func (r *RadixMatchIterator) Reset() {
+	defer r.root.t.recoverRead()
+	r.key = r.key[:0]
+	r.stack = r.stack[:0]
+	if s := r.auto.start(); s!=nil { r.push(r.root,s,0) }
+}
+
+// Next obtains the next matching key-value pair.
+// The value is nil, if the key is a nested bucket.
+func (r *RadixMatchIterator) Next() (key,value []byte,ok bool) {
+	defer r.root.t.recoverRead()
+	for len(r.stack)!=0 {
+		f := &r.stack[len(r.stack)-1]
+		if !f.visited {
+			f.visited = true
+			if f.a.hasLeaf() && r.auto.accept(f.s) {
+				if f.a.leafFlags()==0 { value = f.a.leaf() }
+				return r.key[:f.klen],value,true
+			}
+		}
+		if f.i>=f.n {
+			r.stack = r.stack[:len(r.stack)-1]
+			continue
+		}
+		i := f.i
+		f.i++
+		
+		// Prune using the edges_k table, before the child is touched.
+		s := r.auto.step(f.s,f.a.edge_k(i))
+		if s==nil { continue }
+		edge := f.a.edge(i)
+		prefix := edge.prefix()
+		for _,b := range prefix[1:] {
+			if s = r.auto.step(s,b); s==nil { break }
+		}
+		if s==nil { continue }
+		r.key = append(r.key[:f.klen],prefix...)
+		r.push(edge,s,len(r.key))
+	}
+	return
+}
+
+func (r *RadixBucket) matchIterator(auto radixAutomaton) *RadixMatchIterator {
+	it := &RadixMatchIterator{root:r.acc.rootAddr(),auto:auto}
+	it.Reset()
+	return it
+}
+
+// FuzzySearch returns an iterator over all keys, which's Levenshtein distance
+// to key is at most maxEdits. Insertions, deletions and substitutions are
+// counted in bytes.
+func (r *RadixBucket) FuzzySearch(key []byte,maxEdits int) *RadixMatchIterator {
+	defer r.acc.tx.recoverRead()
+	return r.matchIterator(&radixLevenshtein{key:key,max:maxEdits})
+}
+
+// Match returns an iterator over all keys, that match pattern. Within the
+// pattern, '?' matches any single byte and '*' matches any sequence of bytes,
+// including the empty one. Every other byte matches itself.
+func (r *RadixBucket) Match(pattern []byte) *RadixMatchIterator {
+	defer r.acc.tx.recoverRead()
+	return r.matchIterator(&radixWildcard{pattern:pattern})
+}
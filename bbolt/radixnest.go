@@ -0,0 +1,313 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package bbolt
+
+import "bytes"
+
+/*
+SECTION: Nested buckets and radix trees.
+
+The leaf of a radix node may hold the header of a nested bucket or radix tree
+instead of a value. Such leaves are marked with bucketLeafFlag or radixLeafFlag
+(see radixNode.leafFlags), just like the elements of a leaf page.
+*/
+
+func (r *RadixBucket) obtainBucket(k,v []byte) *Bucket {
+	if child := r.buckets[string(k)]; child!=nil { return child }
+	child := (&Bucket{tx:r.acc.tx}).openBucket(v)
+	child.path = r.acc.tx.childPath(r.path,k)
+	if r.acc.tx.writable {
+		if r.buckets==nil { r.buckets = make(map[string]*Bucket) }
+		r.buckets[string(k)] = child
+	}
+	return child
+}
+func (r *RadixBucket) obtainRadixBucket(k,v []byte) *RadixBucket {
+	if rad := r.radixes[string(k)]; rad!=nil { return rad }
+	rad := openRadixBucket(r.acc.tx,v)
+	if rad==nil { return nil }
+	rad.path = r.acc.tx.childPath(r.path,k)
+	if r.acc.tx.writable {
+		if r.radixes==nil { r.radixes = make(map[string]*RadixBucket) }
+		r.radixes[string(k)] = rad
+	}
+	return rad
+}
+
+// Bucket retrieves a nested bucket by name.
+// Returns nil if the bucket does not exist.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) Bucket(name []byte) *Bucket {
+	defer r.acc.tx.recoverRead()
+	if child := r.buckets[string(name)]; child!=nil { return child }
+	if len(name)==0 || len(name)>MaxKeySize { return nil }
+	a := r.acc.get(name)
+	if a.leafFlags()!=bucketLeafFlag { return nil }
+	return r.obtainBucket(name,a.leaf())
+}
+
+// RadixBucket retrieves a nested radix-tree bucket by name.
+// Returns nil if the radix-tree bucket does not exist.
+// The radix-tree bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) RadixBucket(name []byte) *RadixBucket {
+	defer r.acc.tx.recoverRead()
+	if rad := r.radixes[string(name)]; rad!=nil { return rad }
+	if len(name)==0 || len(name)>MaxKeySize { return nil }
+	a := r.acc.get(name)
+	if a.leafFlags()!=radixLeafFlag { return nil }
+	return r.obtainRadixBucket(name,a.leaf())
+}
+
+func (r *RadixBucket) checkNested(key []byte) error {
+	if r.acc.tx.db == nil {
+		return ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return ErrTxNotWritable
+	} else if len(key) == 0 {
+		return ErrBucketNameRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+func (r *RadixBucket) createOrObtainBucket(key []byte,obtain bool) (*Bucket, error) {
+	if err := r.checkNested(key); err!=nil { return nil,err }
+	var err error
+	e := r.acc.insert(key,bucketLeafFlag,func(old []byte,flags uint8) VisitOp {
+		switch {
+		case old==nil:
+			r.acc.tx.recordStructure(changeCreateBucket,r.path,key,nil)
+			return VisitOpSET(createInlineBucket())
+		case flags!=bucketLeafFlag: err = ErrIncompatibleValue
+		case !obtain: err = ErrBucketExists
+		}
+		return VisitOpNOP()
+	})
+	if e!=nil { return nil,e }
+	if err!=nil { return nil,err }
+	return r.Bucket(key),nil
+}
+
+func (r *RadixBucket) createOrObtainRadixBucket(key []byte,obtain bool) (*RadixBucket, error) {
+	if err := r.checkNested(key); err!=nil { return nil,err }
+	var err error
+	e := r.acc.insert(key,radixLeafFlag,func(old []byte,flags uint8) VisitOp {
+		switch {
+		case old==nil:
+			p,e := r.acc.tx.allocate(1)
+			if e!=nil { err = e; break }
+			(&radixNode{}).write(radixPageBuffer(p))
+			p.flags = radixPageFlag
+			r.acc.tx.recordStructure(changeCreateRadix,r.path,key,nil)
+			return VisitOpSET(radixHeader{root:p.id}.bytes())
+		case flags!=radixLeafFlag: err = ErrIncompatibleValue
+		case !obtain: err = ErrBucketExists
+		}
+		return VisitOpNOP()
+	})
+	if e!=nil { return nil,e }
+	if err!=nil { return nil,err }
+	return r.RadixBucket(key),nil
+}
+
+// CreateBucket creates a new bucket at the given key and returns the new bucket.
+// Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) CreateBucket(key []byte) (b *Bucket, err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.createOrObtainBucket(key,false)
+}
+
+// CreateBucketIfNotExists creates a new bucket if it doesn't already exist and returns a reference to it.
+// Returns an error if the bucket name is blank, or if the bucket name is too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) CreateBucketIfNotExists(key []byte) (b *Bucket, err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.createOrObtainBucket(key,true)
+}
+
+// CreateRadixBucket creates a new radix-tree bucket at the given key and returns the new bucket.
+// Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
+// The radix-tree bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) CreateRadixBucket(key []byte) (rad *RadixBucket, err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.createOrObtainRadixBucket(key,false)
+}
+
+// CreateRadixBucketIfNotExists creates a new radix-tree bucket if it doesn't already exist and returns a reference to it.
+// Returns an error if the bucket name is blank, or if the bucket name is too long.
+// The radix-tree bucket instance is only valid for the lifetime of the transaction.
+func (r *RadixBucket) CreateRadixBucketIfNotExists(key []byte) (rad *RadixBucket, err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.createOrObtainRadixBucket(key,true)
+}
+
+func (r *RadixBucket) deleteNested(key []byte,flags uint8) error {
+	if r.acc.tx.db == nil {
+		return ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return ErrTxNotWritable
+	} else if len(key) == 0 || len(key) > MaxKeySize {
+		return ErrBucketNotFound
+	}
+	var err error
+	e := r.acc.insert(key,flags,func(old []byte,oflags uint8) VisitOp {
+		switch {
+		case old==nil:
+			err = ErrBucketNotFound
+		case oflags!=flags:
+			err = ErrIncompatibleValue
+		default:
+			r.eraseNested(key,old,flags)
+			r.acc.tx.recordStructure(changeDeleteBucket,r.path,key,nil)
+			return VisitOpDELETE()
+		}
+		return VisitOpNOP()
+	})
+	if e!=nil { return e }
+	return err
+}
+
+// DeleteBucket deletes a nested bucket at the given key.
+// Returns an error if the bucket does not exists, or if the key represents a non-bucket value.
+func (r *RadixBucket) DeleteBucket(key []byte) (err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.deleteNested(key,bucketLeafFlag)
+}
+
+// DeleteRadixBucket deletes a nested radix-tree bucket at the given key.
+// Returns an error if the radix-tree bucket does not exists, or if the key represents a different value.
+func (r *RadixBucket) DeleteRadixBucket(key []byte) (err error) {
+	defer r.acc.tx.recoverError(&err)
+	return r.deleteNested(key,radixLeafFlag)
+}
+
+// eraseNested releases all pages of a nested bucket or radix tree.
+// Values are only recorded as deleted.
+func (r *RadixBucket) eraseNested(key,value []byte,flags uint8) {
+	switch flags {
+	case 0:
+		r.recordDelete(key,value)
+	case bucketLeafFlag:
+		child := r.buckets[string(key)]
+		delete(r.buckets,string(key))
+		if child==nil {
+			child = (&Bucket{tx:r.acc.tx}).openBucket(value)
+			child.path = r.acc.tx.childPath(r.path,key)
+		}
+		child.erase()
+	case radixLeafFlag:
+		rad := r.radixes[string(key)]
+		delete(r.radixes,string(key))
+		if rad==nil {
+			if rad = openRadixBucket(r.acc.tx,value); rad==nil { return }
+			rad.path = r.acc.tx.childPath(r.path,key)
+		}
+		rad.erase()
+	}
+}
+
+// relocate moves all pages of this radix tree and it's nested buckets, that
+// are stored at or beyond limit. See (*Bucket).relocate()
+func (r *RadixBucket) relocate(limit pgid) error {
+	r.acc.relocate(limit)
+	for _,k := range r.acc.nested() {
+		if child := r.Bucket(k); child!=nil {
+			if err := child.relocate(limit); err!=nil { return err }
+		} else if rad := r.RadixBucket(k); rad!=nil {
+			if err := rad.relocate(limit); err!=nil { return err }
+		} else {
+			// The header of the radix tree can not be read.
+			return ErrIncompatibleValue
+		}
+	}
+	return nil
+}
+
+// erase releases all pages of this radix tree and it's nested buckets.
+func (r *RadixBucket) erase() {
+	r.acc.erase(r.eraseNested)
+	r.buckets = nil
+	r.radixes = nil
+}
+
+// spill writes the nested buckets and all the nodes of this radix tree to dirty pages.
+func (r *RadixBucket) spill() error {
+	for name, child := range r.buckets {
+		// See (*Bucket).spill()
+		var value []byte
+		if child.inlineable() {
+			child.free()
+			value = child.write()
+		} else {
+			if err := child.spill(); err != nil {
+				return err
+			}
+			value = child.header()
+		}
+		if child.rootNode == nil {
+			continue
+		}
+		if err := r.acc.put([]byte(name),value,bucketLeafFlag); err!=nil {
+			return err
+		}
+	}
+	for name, child := range r.radixes {
+		if err := child.spill(); err!=nil {
+			return err
+		}
+		// Skip unmodified radix trees.
+		value := child.header()
+		if bytes.Equal(r.acc.get([]byte(name)).leaf(),value) {
+			continue
+		}
+		if err := r.acc.put([]byte(name),value,radixLeafFlag); err!=nil {
+			return err
+		}
+	}
+	return r.acc.persist()
+}
+
+// rebalance attempts to balance all nodes of the nested buckets.
+func (r *RadixBucket) rebalance() {
+	for _, child := range r.buckets {
+		child.rebalance()
+	}
+	for _, child := range r.radixes {
+		child.rebalance()
+	}
+}
+
+// dereference removes all references to the old mmap.
+func (r *RadixBucket) dereference() {
+	r.acc.dereference()
+	for _, child := range r.buckets {
+		child.dereference()
+	}
+	for _, child := range r.radixes {
+		child.dereference()
+	}
+}
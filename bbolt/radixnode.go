@@ -34,6 +34,7 @@ const (
 const (
 	radixf_mmap = 1<<iota
 	radixf_inlined
+	radixf_counted // count is valid
 )
 
 
@@ -74,10 +75,13 @@ func radixPageID(p pgid) radixID {
 
 type radixNode struct{
 	flags uint
+	leafFlags uint8 // bucketLeafFlag or radixLeafFlag, if the leaf is a nested bucket.
 	
 	leafEx_p *radixNode
 	leafEx_v radixID
 	n_edges uint16
+	count uint64 // number of keys in the subtree, if radixf_counted is set.
+	psize int    // size of the part of the heap subtree, stored with the node. See persist_partition().
 	
 	edges_p [256]*radixNode
 	edges_v [256]radixID
@@ -110,13 +114,31 @@ func (r *radixNode) del(k byte) (i int,ok bool) {
 	return
 }
 func (r *radixNode) hasLeaf() bool {
-	return len(r.leafIn)==0 && r.leafEx_v==0 && r.leafEx_p==nil
+	return len(r.leafIn)!=0 || r.leafEx_v!=0 || r.leafEx_p!=nil
 }
 func (r *radixNode) transferLeaf(o *radixNode) {
 	o.leafEx_p,o.leafEx_v,o.leafIn = r.leafEx_p,r.leafEx_v,r.leafIn
 	r.leafEx_p,r.leafEx_v,r.leafIn = nil,0,nil
 }
 func (r *radixNode) edge_keys() []byte { return r.edges_k[:r.n_edges] }
+func (r *radixNode) dereference() {
+	r.prefix = cloneBytes(r.prefix)
+	if len(r.leafIn)!=0 { r.leafIn = cloneBytes(r.leafIn) }
+	if r.leafEx_p!=nil { r.leafEx_p.dereference() }
+	for i,n := 0,int(r.n_edges); i<n; i++ {
+		if r.edges_p[i]!=nil { r.edges_p[i].dereference() }
+	}
+}
+// clone returns a deep copy of the heap subtree of r, or nil.
+func (r *radixNode) clone() *radixNode {
+	if r==nil { return nil }
+	c := *r
+	c.leafEx_p = r.leafEx_p.clone()
+	for i,n := 0,int(r.n_edges); i<n; i++ {
+		c.edges_p[i] = r.edges_p[i].clone()
+	}
+	return &c
+}
 func (r *radixNode) edge_collision() bool {
 	b := make(map[byte]bool,r.n_edges)
 	for _,e := range r.edges_k[:r.n_edges] {
@@ -138,9 +160,12 @@ func (r *radixNode) edge_nonsorted() bool {
 /*
 {
 	radixID leafEx      : 64;
-	uint    len(prefix) : 23; //24
+	uint    leafFlags   :  2;
+	uint    len(prefix) : 21;
 	uint    n_edges     :  9; // 8
-	uint    len(leafIn) : 32;
+	uint    counted     :  1;
+	uint    len(leafIn) : 31;
+	uint64  count       : 64; // if counted
 	
 	radixID edges_v[...]
 	byte    edges_k[...]
@@ -149,8 +174,25 @@ func (r *radixNode) edge_nonsorted() bool {
 }
 */
 
+const (
+	radixPrefixMask  = 0x1fffff
+	radixCountedFlag = 1<<31
+)
+
+// radixNodeHeader decodes the header of a node. hsz is the offset of edges_v.
+func radixNodeHeader(buf []byte) (ne,pxl,lfil,hsz int) {
+	compound := *((*uint32)(unsafe.Pointer(&buf[ 8])))
+	len_leaf := *((*uint32)(unsafe.Pointer(&buf[12])))
+	ne = int(compound&0x1ff)
+	pxl = int((compound>>9)&radixPrefixMask)
+	lfil = int(len_leaf&^radixCountedFlag)
+	hsz = 16
+	if (len_leaf&radixCountedFlag)!=0 { hsz = 24 }
+	return
+}
+
 func (r *radixNode) size() (i int) {
-	i  = 16
+	i  = 24
 	i += int(r.n_edges) * 9
 	i += len(r.prefix)+len(r.leafIn)
 	i += 7
@@ -158,7 +200,7 @@ func (r *radixNode) size() (i int) {
 	return
 }
 func (r *radixNode) size_without_leafIn() (i int) {
-	i  = 16
+	i  = 24
 	i += int(r.n_edges) * 9
 	i += len(r.prefix)
 	i += 7
@@ -168,30 +210,33 @@ func (r *radixNode) size_without_leafIn() (i int) {
 
 func (r *radixNode) write(buf []byte) {
 	*(*radixID)(unsafe.Pointer(&buf[0])) = r.leafEx_v
-	compound := (uint32(len(r.prefix))<<9) | uint32(r.n_edges)
+	compound := (uint32(r.leafFlags)<<30) | (uint32(len(r.prefix))<<9) | uint32(r.n_edges)
 	*(*uint32)(unsafe.Pointer(&buf[8])) = compound
-	*(*uint32)(unsafe.Pointer(&buf[12])) = uint32(len(r.leafIn))
+	*(*uint32)(unsafe.Pointer(&buf[12])) = uint32(len(r.leafIn))|radixCountedFlag
+	*(*uint64)(unsafe.Pointer(&buf[16])) = r.count
 	
 	ne := int(r.n_edges)
-	copy(((*[256]radixID)(unsafe.Pointer(&buf[16])))[:ne],r.edges_v[:ne])
-	copy(buf[16+(ne*8):],r.edges_k[:ne])
-	copy(buf[16+(ne*9):],r.prefix)
-	copy(buf[16+(ne*9)+len(r.prefix):],r.leafIn)
+	copy(((*[256]radixID)(unsafe.Pointer(&buf[24])))[:ne],r.edges_v[:ne])
+	copy(buf[24+(ne*8):],r.edges_k[:ne])
+	copy(buf[24+(ne*9):],r.prefix)
+	copy(buf[24+(ne*9)+len(r.prefix):],r.leafIn)
 }
 func (r *radixNode) read(buf []byte) {
 	*r = radixNode{flags:radixf_mmap}
 	r.leafEx_v = *(*radixID)(unsafe.Pointer(&buf[0]))
-	compound := *(*uint32)(unsafe.Pointer(&buf[8]))
-	r.n_edges = uint16(compound&0x1ff)
-	pxl := int(compound>>9)
-	
-	lfil := int(*(*uint32)(unsafe.Pointer(&buf[12])))
+	ne,pxl,lfil,hsz := radixNodeHeader(buf)
+	r.n_edges = uint16(ne)
+	r.leafFlags = uint8(*(*uint32)(unsafe.Pointer(&buf[8]))>>30)
+	if hsz>16 {
+		// Nodes written prior to the counted format have their counts computed lazily.
+		r.count = *(*uint64)(unsafe.Pointer(&buf[16]))
+		r.flags |= radixf_counted
+	}
 	
-	ne := int(r.n_edges)
-	copy(r.edges_v[:ne],((*[256]radixID)(unsafe.Pointer(&buf[16])))[:ne])
-	copy(r.edges_k[:ne],buf[16+(ne*8):])
-	r.prefix = buf[16+(ne*9):][:pxl]
-	r.leafIn = buf[16+(ne*9)+pxl:][:lfil]
+	copy(r.edges_v[:ne],((*[256]radixID)(unsafe.Pointer(&buf[hsz])))[:ne])
+	copy(r.edges_k[:ne],buf[hsz+(ne*8):])
+	r.prefix = buf[hsz+(ne*9):][:pxl]
+	r.leafIn = buf[hsz+(ne*9)+pxl:][:lfil]
 }
 
 func radixPageBuffer(p *page) []byte {
@@ -237,16 +282,48 @@ func (a radixAddr) leaf() []byte {
 func (a radixAddr) leafIn() (leaf []byte) {
 	if a.p==nil {
 		buf,_ := a.node()
-		compound := *((*uint32)(unsafe.Pointer(&buf[ 8])))
-		len_leaf := *((*uint32)(unsafe.Pointer(&buf[12])))
-		ne := compound & 0xff
-		prefix := compound>>9
-		leaf = buf[16+(ne*9)+prefix:][:len_leaf]
+		ne,pxl,lfil,hsz := radixNodeHeader(buf)
+		leaf = buf[hsz+(ne*9)+pxl:][:lfil]
 	} else {
 		leaf = a.p.leafIn
 	}
 	return
 }
+// leafFlags returns the flags of the leaf, which are non-zero for nested buckets.
+func (a radixAddr) hasLeaf() bool {
+	if a.p==nil { return len(a.leafIn())!=0 || !a.leafEx().isNil() }
+	return a.p.hasLeaf()
+}
+// count returns the number of keys in the subtree. The counts of heap nodes
+// are cached, until insert() invalidates them.
+func (a radixAddr) count() (n uint64) {
+	if a.isNil() { return 0 }
+	if a.p==nil {
+		buf,_ := a.node()
+		if _,_,_,hsz := radixNodeHeader(buf); hsz>16 {
+			return *(*uint64)(unsafe.Pointer(&buf[16]))
+		}
+	} else if (a.p.flags&radixf_counted)!=0 {
+		return a.p.count
+	}
+	if a.hasLeaf() { n++ }
+	for i,l := 0,a.n_edges(); i<l; i++ {
+		n += a.edge(i).count()
+	}
+	if a.p!=nil {
+		a.p.count = n
+		a.p.flags |= radixf_counted
+	}
+	return
+}
+func (a radixAddr) leafFlags() uint8 {
+	if a.isNil() { return 0 }
+	if a.p==nil {
+		buf,_ := a.node()
+		return uint8(*((*uint32)(unsafe.Pointer(&buf[8])))>>30)
+	}
+	return a.p.leafFlags
+}
 func (a radixAddr) leafEx() (b radixAddr){
 	if a.p==nil {
 		buf,pag := a.node()
@@ -273,9 +350,10 @@ func (a radixAddr) n_edges() int{
 func (a radixAddr) edge(i int) (b radixAddr) {
 	if a.p==nil {
 		buf,pag := a.node()
+		_,_,_,hsz := radixNodeHeader(buf)
 		b = a
 		b.b = pag
-		b.v = (*[256]radixID)(unsafe.Pointer(&buf[16]))[i]
+		b.v = (*[256]radixID)(unsafe.Pointer(&buf[hsz]))[i]
 	} else {
 		b = a
 		b.p = a.p.edges_p[i]
@@ -286,9 +364,8 @@ func (a radixAddr) edge(i int) (b radixAddr) {
 func (a radixAddr) edge_k(i int) (b byte) {
 	if a.p==nil {
 		buf,_ := a.node()
-		compound := *((*uint32)(unsafe.Pointer(&buf[8])))
-		n_edges := int(compound&0x1ff)
-		return (*[256]byte)(unsafe.Pointer(&buf[16+(n_edges*8)]))[i]
+		n_edges,_,_,hsz := radixNodeHeader(buf)
+		return (*[256]byte)(unsafe.Pointer(&buf[hsz+(n_edges*8)]))[i]
 	} else {
 		return a.p.edges_k[i]
 	}
@@ -299,12 +376,8 @@ func (a radixAddr) edge_k(i int) (b byte) {
 func (a radixAddr) prefix() (prefix []byte) {
 	if a.p==nil {
 		buf,_ := a.node()
-		compound := *((*uint32)(unsafe.Pointer(&buf[8])))
-		l_prefix := int(compound>>9)
-		n_edges := int(compound&0x1ff)
-		i := 16
-		i += n_edges * 9
-		prefix = buf[i:][:l_prefix]
+		n_edges,l_prefix,_,hsz := radixNodeHeader(buf)
+		prefix = buf[hsz+(n_edges*9):][:l_prefix]
 	} else {
 		prefix = a.p.prefix
 	}
@@ -314,12 +387,8 @@ func (a radixAddr) match(key []byte) (rest []byte,ok bool) {
 	var prefix []byte
 	if a.p==nil {
 		buf,_ := a.node()
-		compound := *((*uint32)(unsafe.Pointer(&buf[8])))
-		l_prefix := int(compound>>9)
-		n_edges := int(compound&0x1ff)
-		i := 16
-		i += n_edges * 9
-		prefix = buf[i:][:l_prefix]
+		n_edges,l_prefix,_,hsz := radixNodeHeader(buf)
+		prefix = buf[hsz+(n_edges*9):][:l_prefix]
 	} else {
 		prefix = a.p.prefix
 	}
@@ -335,13 +404,12 @@ func (a radixAddr) lookup(key []byte) (b radixAddr,ok bool) {
 func (a radixAddr) lookup_i(key []byte) (i int,b radixAddr,ok bool) {
 	if a.p==nil {
 		buf,pag := a.node()
-		compound := *((*uint32)(unsafe.Pointer(&buf[8])))
-		n_edges := int(compound&0x1ff)
-		i,ok = radixBinSearch((*[256]byte)(unsafe.Pointer(&buf[16+(n_edges*8)])),n_edges,key[0])
+		n_edges,_,_,hsz := radixNodeHeader(buf)
+		i,ok = radixBinSearch((*[256]byte)(unsafe.Pointer(&buf[hsz+(n_edges*8)])),n_edges,key[0])
 		if !ok { return }
 		b = a
 		b.b = pag
-		b.v = (*[256]radixID)(unsafe.Pointer(&buf[16]))[i]
+		b.v = (*[256]radixID)(unsafe.Pointer(&buf[hsz]))[i]
 	} else {
 		i,ok = radixBinSearch(&a.p.edges_k,int(a.p.n_edges),key[0])
 		if !ok { return }
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RadixPacking selects the strategy, that is used to pack the nodes of a radix
+// tree into pages. Inlined nodes are stored within the page of their parent.
+type RadixPacking int
+
+const (
+	// RadixPackGreedy inlines the children of a node in edge order, descending
+	// into each inlined child before its siblings are considered.
+	RadixPackGreedy RadixPacking = iota
+
+	// RadixPackSubtree partitions the tree bottom-up, by the size of it's
+	// subtrees, into the minimal number of pages. This avoids the partially
+	// filled pages, the greedy strategy leaves behind in deep, narrow tries.
+	RadixPackSubtree
+
+	// RadixPackBreadthFirst inlines the nodes closest to the root of the page
+	// first, which reduces the number of pages touched by a lookup at the
+	// expense of space.
+	RadixPackBreadthFirst
+)
+
+func (p RadixPacking) String() string {
+	switch p {
+	case RadixPackGreedy: return "greedy"
+	case RadixPackSubtree: return "subtree"
+	case RadixPackBreadthFirst: return "breadth-first"
+	}
+	return fmt.Sprintf("RadixPacking(%d)",int(p))
+}
+
+func (r *radixAccess) packing() RadixPacking {
+	return r.tx.db.RadixPacking
+}
+
+// persist_pack_dispatch packs the heap subtree of the page root node into the space psz.
+func (r *radixAccess) persist_pack_dispatch(node *radixNode,psz *int) {
+	switch r.packing() {
+	case RadixPackSubtree:
+		// Already partitioned by persist_partition.
+	case RadixPackBreadthFirst:
+		r.persist_pack_bfs(node,psz)
+	default:
+		r.persist_pack(node,psz)
+	}
+}
+
+/*
+persist_partition partitions the heap subtree of node into pages (Kundu and Misra):
+Bottom-up, every node is combined with the remainders of it's children. As long as
+the combination exceeds the capacity of a page, the largest remainder is cut off
+and becomes the root of a page of it's own. This yields the minimal number of pages.
+The remainder of node is recorded in node.psize and returned.
+*/
+func (r *radixAccess) persist_partition(node *radixNode,capacity int) int {
+	for i,n := 0,int(node.n_edges); i<n; i++ {
+		if node.edges_p[i]==nil { continue }
+		r.persist_partition(node.edges_p[i],capacity)
+	}
+	r.persist_cut(node,capacity)
+	return node.psize
+}
+
+// persist_cut performs a single step of persist_partition, on a node, which's children
+// have been partitioned already. It returns the edge indices of the children, that are cut off.
+func (r *radixAccess) persist_cut(node *radixNode,capacity int) (cut []int) {
+	var children []int
+	for i,n := 0,int(node.n_edges); i<n; i++ {
+		if node.edges_p[i]==nil { continue }
+		children = append(children,i)
+	}
+	
+	// Externalize leaf in order to shrink the node.
+	if len(children)!=0 { r.persist_externalize_leaf(node) }
+	
+	node.psize = node.size()
+	for _,i := range children { node.psize += node.edges_p[i].psize }
+	
+	sort.Slice(children,func(i,j int) bool {
+		return node.edges_p[children[i]].psize>node.edges_p[children[j]].psize
+	})
+	for _,i := range children {
+		c := node.edges_p[i]
+		if node.psize<=capacity {
+			c.flags |= radixf_inlined
+		} else {
+			c.flags &^= radixf_inlined
+			node.psize -= c.psize
+			cut = append(cut,i)
+		}
+	}
+	return
+}
+
+func (r *radixAccess) persist_pack_bfs(node *radixNode,psz *int) {
+	queue := []*radixNode{node}
+	for len(queue)!=0 {
+		node,queue = queue[0],queue[1:]
+		externalized := false
+		for i,n := 0,int(node.n_edges); i<n; i++ {
+			c := node.edges_p[i]
+			
+			// Skip non-heap children.
+			if c==nil { continue }
+			
+			// Externalize leaf in order to shrink the node.
+			if !externalized {
+				r.persist_externalize_leaf(node)
+				externalized = true
+			}
+			
+			// Skip too-large nodes.
+			if *psz<c.size() { continue }
+			
+			c.flags |= radixf_inlined
+			*psz -= c.size()
+			queue = append(queue,c)
+		}
+	}
+}
+
+// decodeAll decodes every node of the tree into the heap.
+func (r *radixAccess) decodeAll() {
+	r.decodeRoot()
+	r.decodeAll_recur(r.head)
+}
+func (r *radixAccess) decodeAll_recur(node *radixNode) {
+	for i,n := 0,int(node.n_edges); i<n; i++ {
+		r.decodeChild2(node.edges_v[i],&node.edges_p[i])
+		r.decodeAll_recur(node.edges_p[i])
+	}
+}
+
+// Compact loads all nodes of the radix tree, so that the whole tree is rewritten
+// on commit, packed according to DB.RadixPacking. External leafs and nested buckets
+// are left as they are. Compact holds the entire tree in memory until then.
+func (r *RadixBucket) Compact() (err error) {
+	defer r.acc.tx.recoverError(&err)
+	if r.acc.tx.db==nil {
+		return ErrTxClosed
+	} else if !r.acc.tx.writable {
+		return ErrTxNotWritable
+	}
+	r.acc.decodeAll()
+	return nil
+}
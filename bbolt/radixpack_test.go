@@ -0,0 +1,187 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// radixLookupPages returns the number of pages, a lookup of key touches.
+func radixLookupPages(r *RadixBucket, key []byte) int {
+	a := r.acc.rootAddr()
+	n := 1
+	for len(key) != 0 {
+		m, ok := a.lookup(key)
+		if !ok {
+			return n
+		}
+		if m.p == nil && m.v.isPage() {
+			n++
+		}
+		if key, ok = m.match(key); !ok {
+			return n
+		}
+		a = m
+	}
+	if ex := a.leafEx(); ex.p == nil && ex.v.isPage() {
+		n++
+	}
+	return n
+}
+
+// radixNarrowKeys returns keys of a deep trie, with a fan-out of two.
+func radixNarrowKeys(n int) [][]byte {
+	rand := rand.New(rand.NewSource(1))
+	keys := make([][]byte, n)
+	for i := range keys {
+		k := make([]byte, 32)
+		for j := range k {
+			k[j] = "ab"[rand.Intn(2)]
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
+// radixWideKeys returns keys of a shallow trie, with a fan-out of sixteen.
+func radixWideKeys(n int) [][]byte {
+	rand := rand.New(rand.NewSource(1))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%016x", rand.Int63()))
+	}
+	return keys
+}
+
+func benchmarkRadixPacking(b *testing.B, packing RadixPacking, keys [][]byte) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db, err := Open(f.Name(), 0666, &Options{RadixPacking: packing})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := r.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		stats := r.Stats()
+		faults := 0
+		for _, k := range keys {
+			faults += radixLookupPages(r, k)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if r.Get(keys[i%len(keys)]) == nil {
+				b.Fatal("key not found")
+			}
+		}
+		b.StopTimer()
+
+		b.ReportMetric(float64(stats.PageN+stats.OverflowN)/float64(stats.KeyN), "pages/key")
+		b.ReportMetric(float64(stats.Inuse)/float64(stats.Alloc), "fill")
+		b.ReportMetric(float64(faults)/float64(len(keys)), "faults/lookup")
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkRadixPacking_Narrow_Greedy(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackGreedy, radixNarrowKeys(20000))
+}
+func BenchmarkRadixPacking_Narrow_Subtree(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackSubtree, radixNarrowKeys(20000))
+}
+func BenchmarkRadixPacking_Narrow_BreadthFirst(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackBreadthFirst, radixNarrowKeys(20000))
+}
+func BenchmarkRadixPacking_Wide_Greedy(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackGreedy, radixWideKeys(20000))
+}
+func BenchmarkRadixPacking_Wide_Subtree(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackSubtree, radixWideKeys(20000))
+}
+func BenchmarkRadixPacking_Wide_BreadthFirst(b *testing.B) {
+	benchmarkRadixPacking(b, RadixPackBreadthFirst, radixWideKeys(20000))
+}
+
+func benchmarkRadixLoad(b *testing.B, bulk bool) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db, err := Open(f.Name(), 0666, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := radixWideKeys(100000)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if bulk {
+			j := 0
+			err = r.BulkLoad(func() ([]byte, []byte, bool) {
+				if j == len(keys) {
+					return nil, nil, false
+				}
+				j++
+				return keys[j-1], keys[j-1], true
+			})
+		} else {
+			for _, k := range keys {
+				if err = r.Put(k, k); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := r.spill(); err != nil {
+			b.Fatal(err)
+		}
+		stats := r.Stats()
+		b.ReportMetric(float64(stats.PageN+stats.OverflowN)/float64(stats.KeyN), "pages/key")
+		tx.Rollback()
+	}
+}
+
+func BenchmarkRadixBucket_Put(b *testing.B)      { benchmarkRadixLoad(b, false) }
+func BenchmarkRadixBucket_BulkLoad(b *testing.B) { benchmarkRadixLoad(b, true) }
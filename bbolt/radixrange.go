@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package bbolt
+
+import (
+	"bytes"
+)
+
+/*
+Bounded traversal.
+
+The bounds [lo,hi) are enforced on top of the unbounded traversal: entering
+the range is done by descending towards the bound (thus skipping every subtree
+in front of it), leaving the range is detected at the first pair beyond it.
+*/
+
+func (r *radixTraversal) below(key []byte) bool { return r.lo!=nil && bytes.Compare(key,r.lo)<0 }
+func (r *radixTraversal) above(key []byte) bool { return r.hi!=nil && bytes.Compare(key,r.hi)>=0 }
+
+func (r *radixTraversal) clipHi(key,value []byte,ok bool) ([]byte,[]byte,bool) {
+	if ok && r.above(key) {
+		r.state = radixAfter
+		return nil,nil,false
+	}
+	return key,value,ok
+}
+func (r *radixTraversal) clipLo(key,value []byte,ok bool) ([]byte,[]byte,bool) {
+	if ok && r.below(key) {
+		r.state = radixBefore
+		return nil,nil,false
+	}
+	return key,value,ok
+}
+
+func (r *radixTraversal) next() (key,value []byte,ok bool) {
+	if r.state==radixBefore && r.lo!=nil { return r.clipHi(r.ceil(r.lo)) }
+	key,value,ok = r.advance()
+	if ok && r.below(key) { return r.clipHi(r.ceil(r.lo)) }
+	return r.clipHi(key,value,ok)
+}
+func (r *radixTraversal) prev() (key,value []byte,ok bool) {
+	if r.state==radixAfter && r.hi!=nil { return r.clipLo(r.lower(r.hi)) }
+	key,value,ok = r.retreat()
+	if ok && r.above(key) { return r.clipLo(r.lower(r.hi)) }
+	return r.clipLo(key,value,ok)
+}
+func (r *radixTraversal) seekGE(key []byte) (k,value []byte,ok bool) {
+	if r.below(key) { key = r.lo }
+	return r.clipHi(r.ceil(key))
+}
+func (r *radixTraversal) seekLT(key []byte) (k,value []byte,ok bool) {
+	if r.hi!=nil && bytes.Compare(key,r.hi)>0 { key = r.hi }
+	return r.clipLo(r.lower(key))
+}
+
+func (r *radixAccess) rangeScan(lo,hi []byte) *radixTraversal {
+	var t *radixTraversal
+	if lo!=nil && hi!=nil {
+		if bytes.Compare(lo,hi)>=0 {
+			// The range is empty.
+			t = new(radixTraversal)
+			t.root.t = r.tx
+			t.root.p = new(radixNode)
+			t.reset()
+			return t
+		}
+		// Every key within [lo,hi) shares the common prefix of lo and hi.
+		t = r.prefixScan(lo[:radixLongestPrefix(lo,hi)])
+	} else {
+		t = r.traversal()
+	}
+	t.lo,t.hi = lo,hi
+	return t
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package bbolt
+
+// RadixStats records statistics about resources used by one or more radix trees.
+type RadixStats struct {
+	// Tree statistics.
+	TreeN       int // number of radix trees
+	KeyN        int // number of keys/value pairs
+	NodeN       int // number of nodes
+	BranchNodeN int // number of nodes with at least one edge
+	EdgeN       int // number of edges
+	Depth       int // number of levels in the deepest radix tree
+
+	// Node placement statistics.
+	PageNodeN   int // number of nodes, that are the root of a page
+	InlineNodeN int // number of nodes, that are inlined into their parent's page
+	HeapNodeN   int // number of modified nodes, not yet written to a page
+
+	// Page count statistics.
+	PageN             int // number of logical pages (including external leaf pages)
+	OverflowN         int // number of physical overflow pages
+	ExternalLeafPageN int // number of pages holding oversized values (see leafEx)
+
+	// Payload statistics.
+	PrefixBytes int // bytes used by node prefixes
+	LeafBytes   int // bytes used by values
+
+	// Page size utilization.
+	Alloc int // bytes allocated for physical pages
+	Inuse int // bytes actually used for radix data
+}
+
+func (s *RadixStats) Add(other RadixStats) {
+	s.TreeN += other.TreeN
+	s.KeyN += other.KeyN
+	s.NodeN += other.NodeN
+	s.BranchNodeN += other.BranchNodeN
+	s.EdgeN += other.EdgeN
+	if s.Depth < other.Depth {
+		s.Depth = other.Depth
+	}
+	s.PageNodeN += other.PageNodeN
+	s.InlineNodeN += other.InlineNodeN
+	s.HeapNodeN += other.HeapNodeN
+	s.PageN += other.PageN
+	s.OverflowN += other.OverflowN
+	s.ExternalLeafPageN += other.ExternalLeafPageN
+	s.PrefixBytes += other.PrefixBytes
+	s.LeafBytes += other.LeafBytes
+	s.Alloc += other.Alloc
+	s.Inuse += other.Inuse
+}
+
+// AvgFanout returns the average number of edges of the nodes, that have edges.
+func (s *RadixStats) AvgFanout() float64 {
+	if s.BranchNodeN == 0 {
+		return 0
+	}
+	return float64(s.EdgeN) / float64(s.BranchNodeN)
+}
+
+// FillRatio returns the ratio of bytes in use to bytes allocated.
+// This is a measure of how tightly the nodes are packed into pages.
+func (s *RadixStats) FillRatio() float64 {
+	if s.Alloc == 0 {
+		return 0
+	}
+	return float64(s.Inuse) / float64(s.Alloc)
+}
+
+// Stats returns stats on a radix tree.
+func (r *RadixBucket) Stats() RadixStats {
+	defer r.acc.tx.recoverRead()
+	return r.acc.stats()
+}
+
+func (a radixAddr) nodeSize() int {
+	buf,_ := a.node()
+	ne,pxl,lfil,hsz := radixNodeHeader(buf)
+	i  := hsz
+	i += ne * 9
+	i += pxl + lfil
+	i += 7
+	i &= ^7
+	return i
+}
+
+func (r *radixAccess) stats() (s RadixStats) {
+	s.TreeN = 1
+	r.stats_recur(radixAddr{t:r.tx,p:r.head,v:radixPageID(r.root)},1,&s)
+	s.Alloc = (s.PageN+s.OverflowN)*r.tx.db.pageSize
+	return
+}
+func (r *radixAccess) stats_page(a radixAddr,s *RadixStats) {
+	p := r.tx.page(pgid(a.v.offset()))
+	s.PageN++
+	s.OverflowN += int(p.overflow)
+	s.Inuse += pageHeaderSize
+}
+func (r *radixAccess) stats_recur(a radixAddr,depth int,s *RadixStats) {
+	if a.isNil() { return }
+	s.NodeN++
+	if depth>s.Depth { s.Depth = depth }
+
+	switch {
+	case a.p!=nil:
+		s.HeapNodeN++
+	case a.v.isPage():
+		s.PageNodeN++
+		r.stats_page(a,s)
+		s.Inuse += a.nodeSize()
+	default:
+		s.InlineNodeN++
+		s.Inuse += a.nodeSize()
+	}
+
+	if ex := a.leafEx(); ex.p==nil && ex.v.isPage() {
+		s.ExternalLeafPageN++
+		r.stats_page(ex,s)
+		s.Inuse += ex.nodeSize()
+	}
+	if leaf := a.leaf(); len(leaf)!=0 {
+		s.KeyN++
+		s.LeafBytes += len(leaf)
+	}
+	s.PrefixBytes += len(a.prefix())
+
+	n := a.n_edges()
+	if n>0 {
+		s.BranchNodeN++
+		s.EdgeN += n
+	}
+	for i := 0; i<n; i++ {
+		r.stats_recur(a.edge(i),depth+1,s)
+	}
+}
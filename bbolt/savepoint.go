@@ -0,0 +1,271 @@
+package bbolt
+
+// Savepoint marks the state of a writable transaction. RollbackTo() undoes
+// all changes made since the savepoint was taken, without discarding the
+// changes made before it. Savepoints nest: rolling back to or releasing a
+// savepoint releases all savepoints taken after it.
+//
+// A savepoint holds a copy of the materialized nodes and radix trees of the
+// transaction, so taking one costs time and memory in proportion to the
+// changes made so far.
+type Savepoint struct {
+	tx       *Tx
+	released bool
+
+	meta           meta
+	pages          map[pgid]bool // pages allocated before the savepoint.
+	free           []pgid        // free pages of the freelist.
+	pendingN       int           // number of pages freed by the transaction.
+	changes        int
+	commitHandlers int
+	snapshots      []snapshot
+	snapshotsSet   bool
+
+	buckets []savedBucket
+	nodes   []savedNode
+	radixes []savedRadix
+}
+
+// savedBucket holds the state of a Bucket.
+type savedBucket struct {
+	b        *Bucket
+	bucket   bucket
+	page     *page
+	rootNode *node
+	ext      *bucketExt
+	nodes    map[pgid]*node
+	buckets  map[string]*Bucket
+	radixes  map[string]*RadixBucket
+}
+
+// savedNode holds a copy of a node.
+type savedNode struct {
+	n    *node
+	node node
+}
+
+// savedRadix holds the state of a RadixBucket and a copy of its heap tree.
+type savedRadix struct {
+	r        *RadixBucket
+	root     pgid
+	head     *radixNode
+	sequence uint64
+	buckets  map[string]*Bucket
+	radixes  map[string]*RadixBucket
+}
+
+// Savepoint marks the current state of the transaction, so that the changes
+// made after it can be undone by Savepoint.RollbackTo(). Buckets, radix
+// trees and cursors obtained after the savepoint must not be used after
+// rolling back to it. Cursors and iterators are invalidated by a rollback.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+
+	f := tx.db.freelist
+	sp := &Savepoint{
+		tx:             tx,
+		meta:           *tx.meta,
+		pages:          make(map[pgid]bool, len(tx.pages)),
+		free:           append([]pgid(nil), f.getFreePageIDs()...),
+		changes:        len(tx.changes),
+		commitHandlers: len(tx.commitHandlers),
+		snapshots:      tx.snapshots,
+		snapshotsSet:   tx.snapshotsSet,
+	}
+	for id := range tx.pages {
+		sp.pages[id] = true
+	}
+	if txp := f.pending[tx.meta.txid]; txp != nil {
+		sp.pendingN = len(txp.ids)
+	}
+	sp.saveBucket(&tx.root)
+
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp, nil
+}
+
+// RollbackTo undoes all changes made since the savepoint was taken. The
+// savepoint remains valid, all savepoints taken after it are released.
+// Returns ErrSavepointReleased, if the savepoint was released.
+func (sp *Savepoint) RollbackTo() error {
+	i, err := sp.index()
+	if err != nil {
+		return err
+	}
+	tx := sp.tx
+	tx.releaseSavepoints(i + 1)
+
+	for _, s := range sp.buckets {
+		*s.b.bucket = s.bucket
+		s.b.page = s.page
+		s.b.rootNode = s.rootNode
+		s.b.ext = s.ext
+		s.b.nodes = copyNodeMap(s.nodes)
+		s.b.buckets = copyBucketMap(s.buckets)
+		s.b.radixes = copyRadixMap(s.radixes)
+	}
+	for _, s := range sp.nodes {
+		*s.n = s.node
+		s.n.inodes = append(inodes(nil), s.node.inodes...)
+		s.n.children = append(nodes(nil), s.node.children...)
+	}
+	for _, s := range sp.radixes {
+		s.r.acc.root = s.root
+		s.r.acc.head = s.head.clone()
+		s.r.sequence = s.sequence
+		s.r.buckets = copyBucketMap(s.buckets)
+		s.r.radixes = copyRadixMap(s.radixes)
+	}
+
+	// Return the pages allocated since the savepoint to the freelist.
+	var allocated []*page
+	for id, p := range tx.pages {
+		if !sp.pages[id] {
+			allocated = append(allocated, p)
+			delete(tx.pages, id)
+		}
+	}
+	tx.db.freelist.rewind(tx.meta.txid, sp.free, sp.pendingN, allocated)
+
+	*tx.meta = sp.meta
+	tx.changes = tx.changes[:sp.changes]
+	tx.commitHandlers = tx.commitHandlers[:sp.commitHandlers]
+	tx.snapshots, tx.snapshotsSet = sp.snapshots, sp.snapshotsSet
+	return nil
+}
+
+// Release discards the savepoint and all savepoints taken after it. The
+// changes made since the savepoint are kept.
+// Returns ErrSavepointReleased, if the savepoint was already released.
+func (sp *Savepoint) Release() error {
+	i, err := sp.index()
+	if err != nil {
+		return err
+	}
+	sp.tx.releaseSavepoints(i)
+	return nil
+}
+
+// index returns the position of the savepoint in the savepoints of the
+// transaction.
+func (sp *Savepoint) index() (int, error) {
+	if sp.tx.db == nil {
+		return 0, ErrTxClosed
+	} else if sp.released {
+		return 0, ErrSavepointReleased
+	}
+	for i, s := range sp.tx.savepoints {
+		if s == sp {
+			return i, nil
+		}
+	}
+	return 0, ErrSavepointReleased
+}
+
+// releaseSavepoints releases the savepoints from position i onwards.
+func (tx *Tx) releaseSavepoints(i int) {
+	for _, sp := range tx.savepoints[i:] {
+		sp.released = true
+	}
+	tx.savepoints = tx.savepoints[:i]
+}
+
+// saveBucket saves the state of b, its nodes and its cached children.
+func (sp *Savepoint) saveBucket(b *Bucket) {
+	sp.buckets = append(sp.buckets, savedBucket{
+		b:        b,
+		bucket:   *b.bucket,
+		page:     b.page,
+		rootNode: b.rootNode,
+		ext:      b.ext,
+		nodes:    copyNodeMap(b.nodes),
+		buckets:  copyBucketMap(b.buckets),
+		radixes:  copyRadixMap(b.radixes),
+	})
+	for _, n := range b.nodes {
+		s := savedNode{n: n, node: *n}
+		s.node.inodes = append(inodes(nil), n.inodes...)
+		s.node.children = append(nodes(nil), n.children...)
+		sp.nodes = append(sp.nodes, s)
+	}
+	for _, child := range b.buckets {
+		sp.saveBucket(child)
+	}
+	for _, child := range b.radixes {
+		sp.saveRadix(child)
+	}
+}
+
+// saveRadix saves the state of r, its heap tree and its cached children.
+func (sp *Savepoint) saveRadix(r *RadixBucket) {
+	sp.radixes = append(sp.radixes, savedRadix{
+		r:        r,
+		root:     r.acc.root,
+		head:     r.acc.head.clone(),
+		sequence: r.sequence,
+		buckets:  copyBucketMap(r.buckets),
+		radixes:  copyRadixMap(r.radixes),
+	})
+	for _, child := range r.buckets {
+		sp.saveBucket(child)
+	}
+	for _, child := range r.radixes {
+		sp.saveRadix(child)
+	}
+}
+
+// dereference removes all references to the old mmap.
+func (sp *Savepoint) dereference() {
+	for i := range sp.nodes {
+		n := &sp.nodes[i].node
+		if n.key != nil {
+			n.key = cloneBytes(n.key)
+		}
+		for j := range n.inodes {
+			n.inodes[j].key = cloneBytes(n.inodes[j].key)
+			n.inodes[j].value = cloneBytes(n.inodes[j].value)
+		}
+	}
+	for _, s := range sp.radixes {
+		if s.head != nil {
+			s.head.dereference()
+		}
+	}
+}
+
+func copyNodeMap(m map[pgid]*node) map[pgid]*node {
+	if m == nil {
+		return nil
+	}
+	c := make(map[pgid]*node, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyBucketMap(m map[string]*Bucket) map[string]*Bucket {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]*Bucket, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyRadixMap(m map[string]*RadixBucket) map[string]*RadixBucket {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]*RadixBucket, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,242 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"sort"
+	"unsafe"
+)
+
+// The snapshot table is stored in the pages referenced by the meta page of
+// versionSnapshots. Without snapshots, there is no table and the meta page
+// is of version. The table holds the number of snapshots, followed by a
+// snapshotRecordSize header and the name of each snapshot.
+const snapshotRecordSize = 8 + 8 + 8 + 2
+
+// snapshot pins the state of a committed transaction under a name.
+type snapshot struct {
+	name string
+	txid txid
+	root pgid // Root page of the root bucket.
+	pgid pgid // High water mark.
+}
+
+// Snapshot pins the state of the last committed transaction under name. The
+// pages it references are not reused until the snapshot is dropped, even if
+// the database is closed and reopened in between. OpenSnapshot() begins a
+// read-only transaction on the snapshot.
+//
+// Like a long running read-only transaction, a snapshot keeps the pages that
+// are changed after it was taken from being reclaimed, so the database grows
+// until it is dropped. While there are snapshots, the file uses a format
+// version, that versions of this package without snapshots refuse to open.
+// Returns ErrSnapshotExists, if a snapshot of the same name exists.
+func (db *DB) Snapshot(name string) error {
+	if name == "" {
+		return ErrSnapshotNameRequired
+	} else if len(name) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return db.Update(func(tx *Tx) error {
+		i, found := findSnapshot(db.snapshots, name)
+		if found {
+			return ErrSnapshotExists
+		}
+
+		// The transaction has not changed anything yet, so its meta still
+		// describes the last committed transaction.
+		s := snapshot{name: name, txid: tx.meta.txid - 1, root: tx.meta.root.root, pgid: tx.meta.pgid}
+		snapshots := append(db.snapshots[:i:i], s)
+		tx.setSnapshots(append(snapshots, db.snapshots[i:]...))
+		return nil
+	})
+}
+
+// OpenSnapshot begins a read-only transaction on the snapshot name. The
+// transaction must be closed like any other read-only transaction. Tx.ID()
+// returns the id of the transaction, that was pinned by the snapshot.
+// Returns ErrSnapshotNotFound, if there is no snapshot of that name.
+func (db *DB) OpenSnapshot(name string) (*Tx, error) {
+	if name == "" {
+		return nil, ErrSnapshotNotFound
+	}
+	return db.beginTxAt(name)
+}
+
+// DropSnapshot removes the snapshot name. Its pages are reclaimed, once no
+// other snapshot or open transaction uses them. Open transactions on the
+// snapshot remain valid.
+// Returns ErrSnapshotNotFound, if there is no snapshot of that name.
+func (db *DB) DropSnapshot(name string) error {
+	return db.Update(func(tx *Tx) error {
+		i, found := findSnapshot(db.snapshots, name)
+		if !found {
+			return ErrSnapshotNotFound
+		}
+		tx.setSnapshots(append(db.snapshots[:i:i], db.snapshots[i+1:]...))
+		return nil
+	})
+}
+
+// Snapshots returns the names of all snapshots in ascending order.
+func (db *DB) Snapshots() []string {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	names := make([]string, len(db.snapshots))
+	for i, s := range db.snapshots {
+		names[i] = s.name
+	}
+	return names
+}
+
+// findSnapshot returns the index of the snapshot name in the sorted table,
+// or the index to insert it at.
+func findSnapshot(snapshots []snapshot, name string) (int, bool) {
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].name >= name })
+	return i, i < len(snapshots) && snapshots[i].name == name
+}
+
+// snapshot returns the snapshot name, or nil. The caller must hold the meta
+// lock or the writer lock.
+func (db *DB) snapshot(name string) *snapshot {
+	if i, found := findSnapshot(db.snapshots, name); found {
+		s := db.snapshots[i]
+		return &s
+	}
+	return nil
+}
+
+// pin makes tx read the state of the snapshot. The freelist and the snapshot
+// table of the current state are dropped, so that Tx.WriteTo() copies a
+// consistent database.
+func (s *snapshot) pin(tx *Tx) {
+	tx.meta.txid = s.txid
+	tx.meta.root = bucket{root: s.root}
+	tx.meta.freelist = pgidNoFreelist
+	tx.meta.setSnapshotTable(0)
+
+	// The end of the file may have been truncated since, but not below the
+	// pages of the snapshot.
+	if s.pgid < tx.meta.pgid {
+		tx.meta.pgid = s.pgid
+	}
+	*tx.root.bucket = tx.meta.root
+}
+
+// setSnapshots replaces the snapshot table, when the transaction commits.
+func (tx *Tx) setSnapshots(snapshots []snapshot) {
+	tx.snapshots = snapshots
+	tx.snapshotsSet = true
+}
+
+// commitSnapshots writes the snapshot table to newly allocated pages.
+func (tx *Tx) commitSnapshots() error {
+	if id := tx.meta.snapshotTable(); id != 0 {
+		tx.db.freelist.free(tx.meta.txid, tx.db.page(id))
+	}
+	tx.meta.setSnapshotTable(0)
+	if len(tx.snapshots) == 0 {
+		return nil
+	}
+
+	size := 4
+	for _, s := range tx.snapshots {
+		size += snapshotRecordSize + len(s.name)
+	}
+	p, err := tx.allocate((pageHeaderSize+size+tx.db.pageTrailer)/tx.db.pageSize + 1)
+	if err != nil {
+		return err
+	}
+	p.flags |= snapshotPageFlag
+
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(&p.ptr))[:size:size]
+	binary.BigEndian.PutUint32(buf, uint32(len(tx.snapshots)))
+	buf = buf[4:]
+	for _, s := range tx.snapshots {
+		binary.BigEndian.PutUint64(buf[0:], uint64(s.txid))
+		binary.BigEndian.PutUint64(buf[8:], uint64(s.root))
+		binary.BigEndian.PutUint64(buf[16:], uint64(s.pgid))
+		binary.BigEndian.PutUint16(buf[24:], uint16(len(s.name)))
+		buf = buf[snapshotRecordSize+copy(buf[snapshotRecordSize:], s.name):]
+	}
+	tx.meta.setSnapshotTable(p.id)
+	return nil
+}
+
+// loadSnapshots reads the snapshot table of the last committed transaction.
+func (db *DB) loadSnapshots() error {
+	db.snapshots = nil
+	id := db.meta().snapshotTable()
+	if id == 0 {
+		return nil
+	}
+	if id >= db.meta().pgid {
+		return ErrInvalid
+	}
+	if err := db.verifyPage(id); err != nil {
+		return verifyError(err)
+	}
+	p := db.page(id)
+	if p.flags&snapshotPageFlag == 0 {
+		return ErrInvalid
+	}
+
+	size := (int(p.overflow)+1)*db.pageSize - pageHeaderSize - db.pageTrailer
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(&p.ptr))[:size:size]
+	n := int(binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	snapshots := make([]snapshot, 0, n)
+	for i := 0; i < n; i++ {
+		if len(buf) < snapshotRecordSize {
+			return ErrInvalid
+		}
+		l := int(binary.BigEndian.Uint16(buf[24:]))
+		if len(buf) < snapshotRecordSize+l {
+			return ErrInvalid
+		}
+		snapshots = append(snapshots, snapshot{
+			name: string(buf[snapshotRecordSize : snapshotRecordSize+l]),
+			txid: txid(binary.BigEndian.Uint64(buf[0:])),
+			root: pgid(binary.BigEndian.Uint64(buf[8:])),
+			pgid: pgid(binary.BigEndian.Uint64(buf[16:])),
+		})
+		buf = buf[snapshotRecordSize+l:]
+	}
+	db.snapshots = snapshots
+	return nil
+}
+
+// pinSnapshots moves the free pages, that are reachable from a snapshot, to
+// the pending pages of the last committed transaction. The freelist on disk
+// does not tell them apart from free pages. Each page is recorded as
+// allocated by the oldest snapshot using it, so the writers release it, once
+// all of these snapshots are dropped.
+func (db *DB) pinSnapshots() {
+	if len(db.snapshots) == 0 {
+		return
+	}
+	snapshots := append([]snapshot(nil), db.snapshots...)
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].txid < snapshots[j].txid })
+
+	pinned := make(map[pgid]txid)
+	for _, s := range snapshots {
+		tx := &Tx{}
+		tx.init(db)
+		s.pin(tx)
+		for id := range tx.reachable() {
+			if _, ok := pinned[id]; !ok && db.freelist.freed(id) {
+				pinned[id] = s.txid
+			}
+		}
+	}
+
+	ids := make(pgids, 0, len(pinned))
+	for id := range pinned {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	alloctx := make([]txid, len(ids))
+	for i, id := range ids {
+		alloctx[i] = pinned[id]
+	}
+	db.freelist.pend(db.meta().txid, ids, alloctx)
+}
@@ -21,6 +21,15 @@ type txid uint64
 // them. Pages can not be reclaimed by the writer until no more transactions
 // are using them. A long running read transaction can cause the database to
 // quickly grow.
+//
+// If a page fails its checksum, the methods, that return an error, return
+// ErrChecksum, or ErrDecrypt for a page of an encrypted database, that fails
+// authentication. The methods without an error result, like Bucket.Get() or
+// the methods of Cursor, return nil instead. In both cases the transaction
+// keeps the error: Err() returns it, Rollback() returns it, and Commit()
+// rolls the transaction back and returns it. DB.View() and DB.Update()
+// return it as well. A value of a bucket with a codec, that can not be
+// decoded, is handled alike with ErrDecode.
 type Tx struct {
 	writable       bool
 	managed        bool
@@ -30,6 +39,14 @@ type Tx struct {
 	pages          map[pgid]*page
 	stats          TxStats
 	commitHandlers []func()
+	corrupted      bool // Set by Check(), if a page failed its checksum.
+	err            error // First page or value, that could not be read, see Err().
+	capture        bool     // Set if changes are published to subscribers.
+	muted          bool     // Suspends the capture of changes.
+	changes        []Change // Changes made by the transaction, if captured.
+	snapshots      []snapshot // Snapshot table to commit, if snapshotsSet.
+	snapshotsSet   bool
+	savepoints     []*Savepoint // Savepoints, that have not been released.
 
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
@@ -94,37 +111,56 @@ func (tx *Tx) Stats() TxStats {
 	return tx.stats
 }
 
+// Err returns ErrChecksum or ErrDecrypt, if a page read by the transaction
+// failed its checksum, ErrDecode, if a value could not be decoded, or nil.
+// Once set, the transaction can only be rolled back.
+func (tx *Tx) Err() error {
+	return tx.err
+}
+
 // Bucket retrieves a bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist, or can not be opened. Use
+// OpenBucket() to tell these cases apart.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (tx *Tx) Bucket(name []byte) *Bucket {
+	defer tx.recoverRead()
 	return tx.root.Bucket(name)
 }
 
+// OpenBucket retrieves a bucket by name. See Bucket.OpenBucket().
+func (tx *Tx) OpenBucket(name []byte) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
+	return tx.root.OpenBucket(name)
+}
+
 // CreateBucket creates a new bucket.
 // Returns an error if the bucket already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
-func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+func (tx *Tx) CreateBucket(name []byte) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
 	return tx.root.CreateBucket(name)
 }
 
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
-func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (b *Bucket, err error) {
+	defer tx.recoverError(&err)
 	return tx.root.CreateBucketIfNotExists(name)
 }
 
 // DeleteBucket deletes a bucket.
 // Returns an error if the bucket cannot be found or if the key represents a non-bucket value.
-func (tx *Tx) DeleteBucket(name []byte) error {
+func (tx *Tx) DeleteBucket(name []byte) (err error) {
+	defer tx.recoverError(&err)
 	return tx.root.DeleteBucket(name)
 }
 
 // ForEach executes a function for each bucket in the root.
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller.
-func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
+func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) (err error) {
+	defer tx.recoverError(&err)
 	return tx.root.ForEach(func(k, v []byte) error {
 		return fn(k, tx.root.Bucket(k))
 	})
@@ -137,15 +173,28 @@ func (tx *Tx) OnCommit(fn func()) {
 
 // Commit writes all changes to disk and updates the meta page.
 // Returns an error if a disk write error occurs, or if Commit is
-// called on a read-only transaction.
-func (tx *Tx) Commit() error {
+// called on a read-only transaction. If a page checksum does not match,
+// or a page fails to decrypt, the transaction is rolled back and ErrChecksum
+// or ErrDecrypt is returned. This includes the pages read before, see Err().
+func (tx *Tx) Commit() (err error) {
 	_assert(!tx.managed, "managed tx commit not allowed")
 	if tx.db == nil {
 		return ErrTxClosed
 	} else if !tx.writable {
 		return ErrTxNotWritable
+	} else if tx.err != nil {
+		tx.rollback()
+		return tx.err
 	}
 
+	// Report corrupted pages instead of crashing.
+	defer func() {
+		if r := recover(); r != nil {
+			err = checksumError(r)
+			tx.rollback()
+		}
+	}()
+
 	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
 
 	// Rebalance nodes which have had deletions.
@@ -166,6 +215,14 @@ func (tx *Tx) Commit() error {
 	// Free the old root bucket.
 	tx.meta.root.root = tx.root.root
 
+	// Write the changed snapshot table before the freelist.
+	if tx.snapshotsSet {
+		if err := tx.commitSnapshots(); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
 	// Free the old freelist because commit writes out a fresh freelist.
 	if tx.meta.freelist != pgidNoFreelist {
 		tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
@@ -211,6 +268,19 @@ func (tx *Tx) Commit() error {
 	}
 	tx.stats.WriteTime += time.Since(startTime)
 
+	// Snapshots take effect once the meta page is written.
+	if tx.snapshotsSet {
+		tx.db.metalock.Lock()
+		tx.db.snapshots = tx.snapshots
+		tx.db.metalock.Unlock()
+	}
+
+	// Queue the changes while the writer lock is held, so that subscribers
+	// receive them in the order of the transaction ids.
+	if tx.capture {
+		tx.db.publish(tx.meta.txid, tx.changes)
+	}
+
 	// Finalize the transaction.
 	tx.close()
 
@@ -226,7 +296,7 @@ func (tx *Tx) commitFreelist() error {
 	// Allocate new pages for the new free list. This will overestimate
 	// the size of the freelist but not underestimate the size (which would be bad).
 	opgid := tx.meta.pgid
-	p, err := tx.allocate((tx.db.freelist.size() / tx.db.pageSize) + 1)
+	p, err := tx.allocate(((tx.db.freelist.size() + tx.db.pageTrailer) / tx.db.pageSize) + 1)
 	if err != nil {
 		tx.rollback()
 		return err
@@ -249,13 +319,14 @@ func (tx *Tx) commitFreelist() error {
 
 // Rollback closes the transaction and ignores all previous updates. Read-only
 // transactions must be rolled back and not committed.
+// Returns the error of a page, that failed its checksum, see Err().
 func (tx *Tx) Rollback() error {
 	_assert(!tx.managed, "managed tx rollback not allowed")
 	if tx.db == nil {
 		return ErrTxClosed
 	}
 	tx.rollback()
-	return nil
+	return tx.err
 }
 
 func (tx *Tx) rollback() {
@@ -264,7 +335,13 @@ func (tx *Tx) rollback() {
 	}
 	if tx.writable {
 		tx.db.freelist.rollback(tx.meta.txid)
-		tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+		if !tx.db.hasSyncedFreelist() {
+			// There is no freelist page to reload, return the pages
+			// allocated by the transaction instead.
+			tx.db.freelist.rollbackAllocs(tx.meta.txid, tx.pages)
+		} else {
+			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+		}
 	}
 	tx.close()
 }
@@ -300,6 +377,7 @@ func (tx *Tx) close() {
 	tx.meta = nil
 	tx.root = Bucket{tx: tx}
 	tx.pages = nil
+	tx.savepoints = nil
 }
 
 // Copy writes the entire database to a writer.
@@ -350,13 +428,10 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 		return n, fmt.Errorf("meta 1 copy: %s", err)
 	}
 
-	// Move past the meta pages in the file.
-	if _, err := f.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
-		return n, fmt.Errorf("seek: %s", err)
-	}
-
-	// Copy data pages.
-	wn, err := io.CopyN(w, f, tx.Size()-int64(tx.db.pageSize*2))
+	// Copy data pages, which follow the meta pages in the file. In WAL mode,
+	// pages, that were not checkpointed yet, are read from the log.
+	size := tx.Size() - int64(tx.db.pageSize*2)
+	wn, err := io.CopyN(w, io.NewSectionReader(tx.db.fileReader(f), int64(tx.db.pageSize*2), size), size)
 	n += wn
 	if err != nil {
 		return n, err
@@ -397,6 +472,22 @@ func (tx *Tx) Check() <-chan error {
 }
 
 func (tx *Tx) check(ch chan error) {
+	// Report corrupted pages, that could not be verified before reading
+	// them, and close the channel to signal completion. The errors kept by
+	// the cursors are reported only, they do not fail the transaction.
+	prev := tx.err
+	defer func() {
+		if r := recover(); r != nil {
+			ch <- checksumError(r)
+			tx.corrupted = true
+		} else if tx.err != prev {
+			ch <- tx.err
+			tx.corrupted = true
+		}
+		tx.err = prev
+		close(ch)
+	}()
+
 	// Force loading free list if opened in ReadOnly mode.
 	tx.db.loadFreelist()
 
@@ -415,35 +506,39 @@ func (tx *Tx) check(ch chan error) {
 	reachable := make(map[pgid]*page)
 	reachable[0] = tx.page(0) // meta0
 	reachable[1] = tx.page(1) // meta1
-	if tx.meta.freelist != pgidNoFreelist {
+	if tx.meta.freelist != pgidNoFreelist && tx.checkPage(tx.meta.freelist, ch) {
 		for i := uint32(0); i <= tx.page(tx.meta.freelist).overflow; i++ {
 			reachable[tx.meta.freelist+pgid(i)] = tx.page(tx.meta.freelist)
 		}
 	}
+	if id := tx.meta.snapshotTable(); id != 0 && tx.checkPage(id, ch) {
+		for i := uint32(0); i <= tx.page(id).overflow; i++ {
+			reachable[id+pgid(i)] = tx.page(id)
+		}
+	}
 
 	// Recursively check buckets.
 	tx.checkBucket(&tx.root, reachable, freed, ch)
 
 	// Ensure all pages below high water mark are either reachable or freed.
-	for i := pgid(0); i < tx.meta.pgid; i++ {
+	// Pages below corrupted pages could not be reached.
+	for i := pgid(0); i < tx.meta.pgid && !tx.corrupted; i++ {
 		_, isReachable := reachable[i]
 		if !isReachable && !freed[i] {
 			ch <- fmt.Errorf("page %d: unreachable unfreed", int(i))
 		}
 	}
-
-	// Close the channel to signal completion.
-	close(ch)
 }
 
 func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool, ch chan error) {
-	// Ignore inline buckets.
+	// Inline buckets have no pages, but they may still contain radix trees.
 	if b.root == 0 {
+		tx.checkChildren(b, reachable, freed, ch)
 		return
 	}
 
 	// Check every page used by this bucket.
-	b.tx.forEachPage(b.root, 0, func(p *page, _ int) {
+	ok := tx.forEachCheckedPage(b.root, ch, func(p *page) {
 		if p.id > tx.meta.pgid {
 			ch <- fmt.Errorf("page %d: out of bounds: %d", int(p.id), int(b.tx.meta.pgid))
 		}
@@ -465,13 +560,73 @@ func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bo
 		}
 	})
 
-	// Check each bucket within this bucket.
-	_ = b.ForEach(func(k, v []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.checkBucket(child, reachable, freed, ch)
+	// The children can not be read from corrupted pages.
+	if ok {
+		tx.checkChildren(b, reachable, freed, ch)
+	}
+}
+
+// checkPage verifies the checksum of a page, before Check() reads it.
+func (tx *Tx) checkPage(id pgid, ch chan error) bool {
+	if _, ok := tx.pages[id]; ok {
+		return true
+	}
+	if err := tx.db.verifyPage(id); err != nil {
+		ch <- err
+		tx.corrupted = true
+		return false
+	}
+	return true
+}
+
+// forEachCheckedPage works like forEachPage, but does not descend into pages,
+// that fail the checksum. It returns false, if any page failed.
+func (tx *Tx) forEachCheckedPage(id pgid, ch chan error, fn func(*page)) bool {
+	if !tx.checkPage(id, ch) {
+		return false
+	}
+	p := tx.page(id)
+	fn(p)
+
+	ok := true
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			elem := p.branchPageElement(uint16(i))
+			if !tx.forEachCheckedPage(elem.pgid, ch, fn) {
+				ok = false
+			}
 		}
-		return nil
-	})
+	}
+	return ok
+}
+
+// checkChildren checks each bucket and radix tree within this bucket.
+func (tx *Tx) checkChildren(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool, ch chan error) {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		_, v, flags := c.keyValue()
+		switch {
+		case (flags & bucketLeafFlag) != 0:
+			if child := b.childBucket(k); child != nil {
+				switch child.usable() {
+				case ErrCodecNotFound:
+					ch <- fmt.Errorf("bucket %q: codec %q not registered", k, child.ext.codecName)
+				case ErrComparatorNotFound:
+					ch <- fmt.Errorf("bucket %q: comparator %q not registered", k, child.ext.cmpName)
+				}
+				tx.checkBucket(child, reachable, freed, ch)
+			}
+		case (flags & radixLeafFlag) != 0:
+			// Prefer the cached radix tree, as it may hold dirty nodes.
+			rad := b.peekRadixBucket(k, v)
+			if rad == nil {
+				ch <- fmt.Errorf("radix tree %q: invalid header: %x", k, v)
+				continue
+			}
+			rc := radixChecker{tx: tx, reachable: reachable, freed: freed, ch: ch}
+			rc.check(rad)
+		}
+	}
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
@@ -502,13 +657,27 @@ func (tx *Tx) write() error {
 	tx.pages = make(map[pgid]*page)
 	sort.Sort(pages)
 
+	// In WAL mode, the pages are logged with the meta page instead.
+	if tx.db.wal != nil {
+		tx.db.wal.reset()
+	}
+
 	// Write pages to disk in order.
 	for _, p := range pages {
+		if err := tx.db.sealPage(p); err != nil {
+			return err
+		}
+		tx.db.unverifyPage(p.id)
 		size := (int(p.overflow) + 1) * tx.db.pageSize
 		offset := int64(p.id) * int64(tx.db.pageSize)
 
 		// Write out page in "max allocation" sized chunks.
 		ptr := (*[maxAllocSize]byte)(unsafe.Pointer(p))
+		if tx.db.wal != nil {
+			tx.db.wal.add(offset, ptr[:size])
+			tx.stats.Write++
+			continue
+		}
 		for {
 			// Limit our write to our max allocation size.
 			sz := size
@@ -537,13 +706,21 @@ func (tx *Tx) write() error {
 		}
 	}
 
-	// Ignore file sync if flag is set on DB.
-	if !tx.db.NoSync || IgnoreNoSync {
+	if tx.db.wal != nil {
+		tx.db.wal.mapPages(tx.db.pageSize)
+	}
+
+	// Ignore file sync if flag is set on DB. In WAL mode, the file is synced
+	// by checkpoints.
+	if tx.db.wal == nil && (!tx.db.NoSync || IgnoreNoSync) {
 		if err := fdatasync(tx.db); err != nil {
 			return err
 		}
 	}
 
+	// Remember which pages this transaction wrote for WriteDeltaTo().
+	tx.db.recordWritten(pages, tx.meta.txid)
+
 	// Put small pages back to page pool.
 	for _, p := range pages {
 		// Ignore page sizes over 1 page.
@@ -571,6 +748,21 @@ func (tx *Tx) writeMeta() error {
 	p := tx.db.pageInBuffer(buf, 0)
 	tx.meta.write(p)
 
+	// In WAL mode, the transaction is committed, once its record is logged.
+	// The meta pages are read from the log until the next checkpoint.
+	if w := tx.db.wal; w != nil {
+		w.add(int64(p.id)*int64(tx.db.pageSize), buf)
+		if err := w.commit(tx.meta.txid, !tx.db.NoSync || IgnoreNoSync, tx.db.pageSize); err != nil {
+			return err
+		}
+		tx.db.metalock.Lock()
+		tx.db.meta0 = tx.db.page(0).meta()
+		tx.db.meta1 = tx.db.page(1).meta()
+		tx.db.metalock.Unlock()
+		tx.stats.Write++
+		return nil
+	}
+
 	// Write the meta page to file.
 	if _, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
 		return err
@@ -619,7 +811,8 @@ func (tx *Tx) forEachPage(pgid pgid, depth int, fn func(*page, int)) {
 
 // Page returns page information for a given page number.
 // This is only safe for concurrent use when used by a writable transaction.
-func (tx *Tx) Page(id int) (*PageInfo, error) {
+func (tx *Tx) Page(id int) (info *PageInfo, err error) {
+	defer tx.recoverError(&err)
 	if tx.db == nil {
 		return nil, ErrTxClosed
 	} else if pgid(id) >= tx.meta.pgid {
@@ -628,7 +821,7 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 
 	// Build the page info.
 	p := tx.db.page(pgid(id))
-	info := &PageInfo{
+	info = &PageInfo{
 		ID:            id,
 		Count:         int(p.count),
 		OverflowCount: int(p.overflow),
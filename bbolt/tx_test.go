@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"testing"
 
 	bolt "github.com/maxymania/go-unstable/bbolt"
@@ -61,6 +63,113 @@ func TestTx_Check_ReadOnly(t *testing.T) {
 	tx.Rollback()
 }
 
+// Ensure that consistency checking descends into radix trees.
+func TestTx_Check_RadixBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	db.StrictMode = true
+
+	// Grow radix trees in the root bucket and in a nested bucket, so that
+	// they span many pages, carry external leafs and are partially deleted.
+	big := make([]byte, 3*os.Getpagesize())
+	for round := 0; round < 10; round++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			r, err := tx.CreateRadixBucketIfNotExists([]byte("radix"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nr, err := b.CreateRadixBucketIfNotExists([]byte("nested"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 500; i++ {
+				k := []byte(fmt.Sprintf("%03d/%04d", round, i))
+				if err := r.Put(k, k); err != nil {
+					t.Fatal(err)
+				}
+				if err := nr.Put(k, k); err != nil {
+					t.Fatal(err)
+				}
+				if round > 0 && i%3 == 0 {
+					if err := r.Delete([]byte(fmt.Sprintf("%03d/%04d", round-1, i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			return r.Put([]byte(fmt.Sprintf("big/%d", round)), big)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Check from a read-only transaction as well.
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the trees must release every radix page.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteRadixBucket([]byte("radix")); err != nil {
+			t.Fatal(err)
+		}
+		return tx.Bucket([]byte("widgets")).DeleteRadixBucket([]byte("nested"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that radix pages are not reclaimed, when the freelist is rebuilt.
+func TestTx_Check_RadixBucket_NoFreelistSync(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		r, err := tx.CreateRadixBucket([]byte("radix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			k := []byte(fmt.Sprintf("key-%d", i))
+			if err := r.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen with freelist sync, which rebuilds the freelist from reachable pages.
+	db.o = &bolt.Options{}
+	db.MustReopen()
+	db.MustCheck()
+	if err := db.View(func(tx *bolt.Tx) error {
+		r := tx.RadixBucket([]byte("radix"))
+		for i := 0; i < 2000; i++ {
+			k := []byte(fmt.Sprintf("key-%d", i))
+			if v := r.Get(k); !bytes.Equal(k, v) {
+				t.Fatalf("unexpected value for %s: %q", k, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that committing a closed transaction returns an error.
 func TestTx_Commit_ErrTxClosed(t *testing.T) {
 	db := MustOpenDB()
@@ -871,3 +980,489 @@ func ExampleTx_CopyFile() {
 	// Output:
 	// The value for 'foo' in the clone is: bar
 }
+
+// Ensure that a delta brings a copy of the database up to date.
+func TestTx_WriteDeltaTo(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	put := func(from, to int) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			r, err := tx.CreateRadixBucketIfNotExists([]byte("radix"))
+			if err != nil {
+				return err
+			}
+			for i := from; i < to; i++ {
+				k := []byte(fmt.Sprintf("%08d", i))
+				if err := b.Put(k, make([]byte, 100)); err != nil {
+					return err
+				}
+				if err := r.Put(k, k); err != nil {
+					return err
+				}
+			}
+			return b.Delete([]byte(fmt.Sprintf("%08d", from/2)))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 1000)
+
+	// Take a full backup.
+	path := tempfile()
+	defer os.Remove(path)
+	var base int
+	if err := db.View(func(tx *bolt.Tx) error {
+		base = tx.ID()
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	put(1000, 1100)
+	put(2000, 2010)
+
+	var full, delta bytes.Buffer
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, err := tx.WriteTo(&full); err != nil {
+			return err
+		}
+		_, err := tx.WriteDeltaTo(&delta, base)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() >= full.Len()/2 {
+		t.Fatalf("delta too large: %d of %d bytes", delta.Len(), full.Len())
+	}
+
+	if err := bolt.ApplyDelta(path, bytes.NewReader(delta.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if err := db2.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return db.View(func(tx0 *bolt.Tx) error {
+			if tx.ID() != tx0.ID() {
+				t.Fatalf("unexpected txid: %d, expected %d", tx.ID(), tx0.ID())
+			}
+			b, b0 := tx.Bucket([]byte("widgets")), tx0.Bucket([]byte("widgets"))
+			if n, n0 := b.Stats().KeyN, b0.Stats().KeyN; n != n0 {
+				t.Fatalf("unexpected key count: %d, expected %d", n, n0)
+			}
+			r, r0 := tx.RadixBucket([]byte("radix")), tx0.RadixBucket([]byte("radix"))
+			if n, n0 := r.Len(), r0.Len(); n != n0 {
+				t.Fatalf("unexpected radix key count: %d, expected %d", n, n0)
+			}
+			return b0.ForEach(func(k, v []byte) error {
+				if !bytes.Equal(b.Get(k), v) {
+					t.Fatalf("unexpected value for %q", k)
+				}
+				if !bytes.Equal(r.Get(k), r0.Get(k)) {
+					t.Fatalf("unexpected radix value for %q", k)
+				}
+				return nil
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a delta is rejected by a database it does not fit.
+func TestTx_WriteDeltaTo_Mismatch(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	path := tempfile()
+	defer os.Remove(path)
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte(fmt.Sprintf("b%d", i)))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A delta starting after the backup must not be applied.
+	var delta bytes.Buffer
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteDeltaTo(&delta, tx.ID()-1)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bolt.ApplyDelta(path, bytes.NewReader(delta.Bytes())); err != bolt.ErrDeltaMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A corrupted meta page must not be applied.
+	delta.Reset()
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteDeltaTo(&delta, 0)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	buf := delta.Bytes()
+	buf[len(buf)-db.Info().PageSize+40] ^= 0xff
+	if err := bolt.ApplyDelta(path, bytes.NewReader(buf)); err != bolt.ErrDeltaInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that the pages written before the database was closed are still
+// known after reopening it, unless the saved record is damaged.
+func TestTx_WriteDeltaTo_Reopen(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	put := func(from, to int) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := from; i < to; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(base int, full bool) {
+		if err := db.View(func(tx *bolt.Tx) error {
+			if f := tx.FullDelta(base); f != full {
+				t.Fatalf("unexpected full delta: %v", f)
+			}
+			var delta bytes.Buffer
+			if _, err := tx.WriteDeltaTo(&delta, base); err != nil {
+				return err
+			}
+			if small := delta.Len() < int(tx.Size())/2; small == full {
+				t.Fatalf("unexpected delta size: %d of %d bytes", delta.Len(), tx.Size())
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 1000)
+	var base int
+	if err := db.View(func(tx *bolt.Tx) error {
+		base = tx.ID()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	put(1000, 1010)
+	check(0, true)
+	check(base, false)
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	put(1010, 1020)
+	check(base, false)
+
+	// A damaged record is not used.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(db.f + "-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)/2] ^= 0xff
+	if err := ioutil.WriteFile(db.f+"-delta", buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	check(base, true)
+}
+
+// Ensure that a savepoint undoes the changes made after it, and only those.
+func TestTx_Savepoint(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	put := func(tx *bolt.Tx, from, to int) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		r, err := tx.CreateRadixBucketIfNotExists([]byte("radix"))
+		if err != nil {
+			return err
+		}
+		for i := from; i < to; i++ {
+			k := []byte(fmt.Sprintf("%08d", i))
+			if err := b.Put(k, make([]byte, 100)); err != nil {
+				return err
+			}
+			if err := r.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := put(tx, 0, 500); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte("large"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 500)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := put(tx, 500, 600); err != nil {
+			return err
+		}
+		want = dumpTx(tx)
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := put(tx, 1000, 2000); err != nil {
+				return err
+			}
+			b, r := tx.Bucket([]byte("widgets")), tx.RadixBucket([]byte("radix"))
+			for i := 0; i < 300; i++ {
+				k := []byte(fmt.Sprintf("%08d", i))
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				if err := r.Delete(k); err != nil {
+					return err
+				}
+			}
+			if _, err := b.NextSequence(); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte("large")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte("new")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateRadixBucket([]byte("newradix")); err != nil {
+				return err
+			}
+			tx.OnCommit(func() { t.Fatal("commit handler not rolled back") })
+
+			// The savepoint remains valid after rolling back to it.
+			if err := sp.RollbackTo(); err != nil {
+				return err
+			}
+			if got := dumpTx(tx); !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected contents after rollback %d", i)
+			}
+		}
+
+		if err := put(tx, 3000, 3100); err != nil {
+			return err
+		}
+		if err := sp.Release(); err != nil {
+			return err
+		}
+		if err := sp.RollbackTo(); err != bolt.ErrSavepointReleased {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want = dumpTx(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if got := dumpDB(t, db); !reflect.DeepEqual(got, want) {
+		t.Fatal("unexpected contents after reopen")
+	}
+	db.MustCheck()
+}
+
+// Ensure that rolling back to or releasing a savepoint releases the
+// savepoints taken after it.
+func TestTx_Savepoint_Nested(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		var sps []*bolt.Savepoint
+		for _, k := range []string{"a", "b", "c"} {
+			sp, err := tx.Savepoint()
+			if err != nil {
+				return err
+			}
+			sps = append(sps, sp)
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		if err := sps[1].RollbackTo(); err != nil {
+			return err
+		}
+		if b.Get([]byte("a")) == nil || b.Get([]byte("b")) != nil || b.Get([]byte("c")) != nil {
+			t.Fatal("unexpected contents after rollback")
+		}
+		if err := sps[2].RollbackTo(); err != bolt.ErrSavepointReleased {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := b.Put([]byte("d"), []byte("d")); err != nil {
+			return err
+		}
+		if err := sps[0].Release(); err != nil {
+			return err
+		}
+		if err := sps[1].RollbackTo(); err != bolt.ErrSavepointReleased {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b.Get([]byte("a")) == nil || b.Get([]byte("b")) != nil || b.Get([]byte("d")) == nil {
+			t.Fatal("unexpected contents")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a savepoint survives the remapping of the database, when the
+// transaction allocates pages.
+func TestTx_Savepoint_Remap(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		// Materialize the nodes, which reference the mmap.
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i += 10 {
+			if err := b.Put(u64tob(uint64(i)), []byte("changed")); err != nil {
+				return err
+			}
+		}
+		want := dumpTx(tx)
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+
+		// Each radix tree allocates a page.
+		for i := 0; i < 2000; i++ {
+			if _, err := tx.CreateRadixBucket(u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		if err := sp.RollbackTo(); err != nil {
+			return err
+		}
+		if got := dumpTx(tx); !reflect.DeepEqual(got, want) {
+			t.Fatal("unexpected contents after rollback")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that savepoints require an open, writable transaction.
+func TestTx_Savepoint_Errors(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, err := tx.Savepoint(); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Savepoint(); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := sp.RollbackTo(); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := sp.Release(); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// In WAL mode, a commit appends the images of the pages it writes to the
+// write-ahead log and only syncs the log. The pages are not written to the
+// database file, readers find them in the log until a checkpoint writes them
+// into the file, syncs it and truncates the log. Open replays the commits in
+// the log, that were not checkpointed, after a crash.
+//
+// The log holds one record per commit. A record starts with a walHeaderSize
+// header: the magic, the txid, the size and the checksum of the body. The
+// body holds the images of the pages written by the commit, each preceded by
+// a walEntrySize header with the offset in the database file and the length
+// of the image. The meta page is the last image.
+const (
+	walHeaderSize = 4 + 4 + 8 + 8 + 8
+	walEntrySize  = 8 + 4 + 4
+)
+
+// walMagic identifies a record of the write-ahead log.
+const walMagic uint32 = 0xED0C1A6B
+
+// walSuffix is appended to the path of the database to get the path of its
+// write-ahead log.
+const walSuffix = "-wal"
+
+// wal is the write-ahead log of a database in WAL mode. Apart from pages, it
+// is only accessed while the writer lock is held.
+type wal struct {
+	path     string
+	file     *os.File
+	size     int64  // Bytes appended since the last checkpoint.
+	buf      []byte // Record of the committing transaction.
+	mapped   int    // Length of buf, whose pages are in pages.
+	interval time.Duration
+	limit    int64
+
+	// pages maps the id of each page logged since the last checkpoint to its
+	// latest image, which runs to the end of the logged span of pages. The
+	// images are slices of records, which are never modified.
+	mu    sync.RWMutex
+	pages map[pgid][]byte
+
+	kick     chan struct{} // Requests a checkpoint.
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// openWAL replays the write-ahead log of the database, if there is one. In
+// WAL mode, the log is kept open for the commits, otherwise it is removed.
+func (db *DB) openWAL(mode os.FileMode, options *Options) error {
+	path := db.path + walSuffix
+	if db.readOnly {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return ErrWALNotReplayed
+		}
+		return nil
+	}
+
+	flag := os.O_RDWR
+	if options.WAL {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, mode)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := db.replayWAL(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if !options.WAL {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+
+	db.wal = &wal{
+		path:     path,
+		file:     f,
+		interval: options.CheckpointInterval,
+		limit:    options.CheckpointSize,
+		pages:    make(map[pgid][]byte),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if db.wal.interval <= 0 {
+		db.wal.interval = DefaultCheckpointInterval
+	}
+	if db.wal.limit <= 0 {
+		db.wal.limit = DefaultCheckpointSize
+	}
+	return nil
+}
+
+// replayWAL writes the pages of all complete records of the log to the
+// database file and truncates the log. A torn or corrupted record ends the
+// log, as its commit did not return.
+func (db *DB) replayWAL(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var hdr [walHeaderSize]byte
+	var off int64
+	var last txid
+	var replayed bool
+	for off+walHeaderSize <= info.Size() {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			return err
+		}
+		id := txid(binary.BigEndian.Uint64(hdr[8:]))
+		size := binary.BigEndian.Uint64(hdr[16:])
+		if binary.BigEndian.Uint32(hdr[0:]) != walMagic || id <= last || size > uint64(info.Size()-off-walHeaderSize) {
+			break
+		}
+		body := make([]byte, size)
+		if _, err := f.ReadAt(body, off+walHeaderSize); err != nil {
+			return err
+		}
+		if walSum(body) != binary.BigEndian.Uint64(hdr[24:]) {
+			break
+		}
+
+		if err := walEntries(body, func(offset int64, b []byte) error {
+			_, err := db.file.WriteAt(b, offset)
+			return err
+		}); err != nil {
+			return err
+		}
+		replayed = true
+		last = id
+		off += walHeaderSize + int64(size)
+	}
+
+	if replayed {
+		if err := db.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// walEntries calls fn with the offset and the image of each page in the body
+// of a record.
+func walEntries(body []byte, fn func(offset int64, b []byte) error) error {
+	for len(body) > 0 {
+		if len(body) < walEntrySize {
+			return ErrInvalid
+		}
+		offset := int64(binary.BigEndian.Uint64(body[0:]))
+		n := int(binary.BigEndian.Uint32(body[8:]))
+		if len(body) < walEntrySize+n {
+			return ErrInvalid
+		}
+		if err := fn(offset, body[walEntrySize:walEntrySize+n]); err != nil {
+			return err
+		}
+		body = body[walEntrySize+n:]
+	}
+	return nil
+}
+
+// walSum returns the checksum of the body of a record.
+func walSum(body []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(body)
+	return h.Sum64()
+}
+
+// reset starts the record of the committing transaction. The record of the
+// previous commit is not reused, as readers may refer to its images.
+func (w *wal) reset() {
+	w.buf = make([]byte, walHeaderSize)
+	w.mapped = walHeaderSize
+}
+
+// add appends the image of the page at offset to the record.
+func (w *wal) add(offset int64, b []byte) {
+	var e [walEntrySize]byte
+	binary.BigEndian.PutUint64(e[0:], uint64(offset))
+	binary.BigEndian.PutUint32(e[8:], uint32(len(b)))
+	w.buf = append(w.buf, e[:]...)
+	w.buf = append(w.buf, b...)
+}
+
+// mapPages makes the pages added to the record since the last call replace
+// the pages of the database file for reads. Like the pages written to the
+// file outside of WAL mode, they are not reachable before the meta page is.
+func (w *wal) mapPages(pageSize int) {
+	w.mu.Lock()
+	_ = walEntries(w.buf[w.mapped:], func(offset int64, b []byte) error {
+		id := pgid(offset / int64(pageSize))
+		for i := 0; i < len(b); i += pageSize {
+			w.pages[id] = b[i:]
+			id++
+		}
+		return nil
+	})
+	w.mu.Unlock()
+	w.mapped = len(w.buf)
+}
+
+// commit appends the record to the log and syncs it, if sync is set. Then
+// the meta page replaces the one of the database file for reads. Once the
+// log grows beyond its limit, a checkpoint is requested.
+func (w *wal) commit(id txid, sync bool, pageSize int) error {
+	body := w.buf[walHeaderSize:]
+	binary.BigEndian.PutUint32(w.buf[0:], walMagic)
+	binary.BigEndian.PutUint64(w.buf[8:], uint64(id))
+	binary.BigEndian.PutUint64(w.buf[16:], uint64(len(body)))
+	binary.BigEndian.PutUint64(w.buf[24:], walSum(body))
+
+	_, err := w.file.WriteAt(w.buf, w.size)
+	if err == nil && sync {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Drop the record, so that it is not replayed.
+		_ = w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.mapPages(pageSize)
+
+	if w.size >= w.limit {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// page returns the logged image of the page with the given id, or nil if the
+// page was not logged since the last checkpoint.
+func (w *wal) page(id pgid) []byte {
+	w.mu.RLock()
+	b := w.pages[id]
+	w.mu.RUnlock()
+	return b
+}
+
+// walReader reads the database file, with the pages from the log in place
+// of those, that were not checkpointed yet.
+type walReader struct {
+	w        *wal
+	f        *os.File
+	pageSize int64
+}
+
+// fileReader returns a reader of the database file f, that sees the commits
+// in the write-ahead log.
+func (db *DB) fileReader(f *os.File) io.ReaderAt {
+	if db.wal == nil {
+		return f
+	}
+	return &walReader{w: db.wal, f: f, pageSize: int64(db.pageSize)}
+}
+
+// ReadAt implements io.ReaderAt. The log may hold pages beyond the end of
+// the file.
+func (r *walReader) ReadAt(b []byte, off int64) (int, error) {
+	r.w.mu.RLock()
+	defer r.w.mu.RUnlock()
+
+	n, err := r.f.ReadAt(b, off)
+	end := off + int64(len(b))
+	for id := off / r.pageSize; id*r.pageSize < end; id++ {
+		img, ok := r.w.pages[pgid(id)]
+		if !ok {
+			continue
+		}
+		lo, hi := id*r.pageSize, (id+1)*r.pageSize
+		if lo < off {
+			lo = off
+		}
+		if hi > end {
+			hi = end
+		}
+		if int(hi-off) > n {
+			for i := n; i < int(lo-off); i++ {
+				b[i] = 0
+			}
+			n = int(hi - off)
+		}
+		copy(b[lo-off:hi-off], img[lo-id*r.pageSize:])
+	}
+	if n == len(b) {
+		err = nil
+	}
+	return n, err
+}
+
+// Checkpoint writes the pages of the commits in the write-ahead log into the
+// database file, syncs it and truncates the log. In WAL mode, this is done in
+// the background, once the CheckpointInterval has passed or the log has grown
+// beyond CheckpointSize. Checkpoint does nothing, if WAL mode is not enabled.
+//
+// Checkpoint waits for the writer lock, so it must not be called while the
+// calling goroutine holds a read-write transaction.
+func (db *DB) Checkpoint() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	return db.checkpoint()
+}
+
+// checkpoint writes the logged pages into the database file, syncs it and
+// truncates the log. The caller must hold the writer lock.
+func (db *DB) checkpoint() error {
+	w := db.wal
+	if w == nil || w.file == nil || w.size == 0 {
+		return nil
+	}
+
+	// Only the writer changes the logged pages.
+	ids := make(pgids, 0, len(w.pages))
+	for id := range w.pages {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	for _, id := range ids {
+		if _, err := db.ops.writeAt(w.pages[id][:db.pageSize], int64(id)*int64(db.pageSize)); err != nil {
+			return err
+		}
+	}
+	if err := fdatasync(db); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	// Readers find the pages in the file now.
+	w.mu.Lock()
+	w.pages = make(map[pgid][]byte)
+	w.mu.Unlock()
+	return nil
+}
+
+// checkpointLoop takes checkpoints in the background, until the database is
+// closed.
+func (db *DB) checkpointLoop(w *wal) {
+	defer close(w.done)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+		case <-w.kick:
+		}
+		if err := db.Checkpoint(); err != nil && err != ErrDatabaseNotOpen {
+			log.Printf("bolt.Checkpoint(): %s", err)
+		}
+	}
+}
+
+// stopCheckpointer stops the checkpointLoop and waits for it to return.
+func (w *wal) stopCheckpointer() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// closeWAL takes a final checkpoint and removes the log. The log is kept for
+// recovery, if the checkpoint fails.
+func (db *DB) closeWAL() error {
+	w := db.wal
+	if w.file == nil {
+		return nil
+	}
+	err := db.checkpoint()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	return os.Remove(w.path)
+}
+
+// walPage returns the page with the given id from the write-ahead log, or nil
+// if it is not logged.
+func (db *DB) walPage(id pgid) *page {
+	if db.wal == nil {
+		return nil
+	}
+	if b := db.wal.page(id); b != nil {
+		return (*page)(unsafe.Pointer(&b[0]))
+	}
+	return nil
+}